@@ -7,6 +7,7 @@ import (
 	"chat-app/modules/token"
 	"chat-app/modules/webRequests"
 	"chat-app/modules/websocket"
+	"context"
 	"crypto/tls"
 	"encoding/json"
 	"fmt"
@@ -15,6 +16,7 @@ import (
 	"os"
 	"os/signal"
 	"strconv"
+	"sync"
 	"syscall"
 	"time"
 )
@@ -22,35 +24,33 @@ import (
 func main() {
 	fmt.Println("Starting server...")
 
-	// handle termination signal
+	// termination signal is handled once the server is listening
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-	go func() {
-		<-sigChan
-		fmt.Println("Received termination signal...")
-		err := database.CloseDatabaseConnection()
-		if err != nil {
-			log.Error("Error closing db connection")
-		}
-		fmt.Println("Closed main db connection successfully")
-		os.Exit(0)
-	}()
 
 	// reading config file
 
 	type ConfigFile struct {
-		LocalhostOnly              bool
-		Port                       uint32
-		TLS                        bool
-		LogConsole                 bool
-		LogFile                    bool
-		Sqlite                     bool
-		ImageServerAddressWithPort string
-		DatabaseAddress            string
-		DatabasePort               uint32
-		DatabaseUsername           string
-		DatabasePassword           string
-		DatabaseName               string
+		LocalhostOnly               bool
+		Port                        uint32
+		TLS                         bool
+		LogConsole                  bool
+		LogFile                     bool
+		Sqlite                      bool
+		ImageServerAddressWithPort  string
+		DatabaseAddress             string
+		DatabasePort                uint32
+		DatabaseUsername            string
+		DatabasePassword            string
+		DatabaseName                string
+		NodeID                      uint64
+		ClusterAddress              string
+		ClusterPeers                []string
+		ClusterSecret               string
+		RateLimits                  websocket.RateLimits
+		ModeratorOnlyRevisions      bool
+		DeletedMessageRetentionDays int
+		MaxHistoryPageSize          int
 	}
 
 	readConfigFile := func() ConfigFile {
@@ -91,11 +91,21 @@ func main() {
 	}
 	database.CreateTables()
 
-	// snowflake
-	snowflake.SetSnowflakeWorkerID(0)
+	// snowflake, every instance needs its own worker ID so IDs won't collide
+	snowflake.SetSnowflakeWorkerID(config.NodeID)
 
-	// websocket
-	websocket.Init()
+	// websocket, broadcasts are shared with the other instances if there are any
+	var broadcaster websocket.Broadcaster
+	if len(config.ClusterPeers) > 0 {
+		broadcaster = websocket.NewMeshBroadcaster(config.NodeID, config.ClusterAddress, config.ClusterPeers, config.ClusterSecret)
+	} else {
+		broadcaster = websocket.NewLocalBroadcaster()
+	}
+	websocket.Init(broadcaster, config.RateLimits)
+	websocket.ModeratorOnlyRevisions = config.ModeratorOnlyRevisions
+	if config.MaxHistoryPageSize > 0 {
+		websocket.MaxHistoryPageSize = config.MaxHistoryPageSize
+	}
 
 	//websocket.ImageHost = config.ImageServerAddressWithPort
 	//
@@ -113,7 +123,8 @@ func main() {
 	http.HandleFunc("/", webRequests.MainHandler)
 
 	// maintenance goroutine
-	go maintenance()
+	maintenanceWg.Add(1)
+	go maintenance(config.DeletedMessageRetentionDays)
 
 	var address string
 	if config.LocalhostOnly {
@@ -122,6 +133,9 @@ func main() {
 		address = fmt.Sprintf("%s:%d", "0.0.0.0", config.Port)
 	}
 
+	var server *http.Server
+	var redirectServer *http.Server // only used with TLS
+
 	if config.TLS {
 		//const certFile = "./sslcert/cert.crt"
 		//const keyFile = "./sslcert/key.key"
@@ -136,7 +150,7 @@ func main() {
 			Cache:      autocert.DirCache("certs"),
 		}
 
-		server := &http.Server{
+		server = &http.Server{
 			Addr: ":https",
 			TLSConfig: &tls.Config{
 				GetCertificate: certManager.GetCertificate,
@@ -148,34 +162,104 @@ func main() {
 		//	log.FatalError(err.Error(), "Error starting TLS server")
 		//}
 
+		redirectServer = &http.Server{
+			Addr:    ":http",
+			Handler: certManager.HTTPHandler(nil),
+		}
+	} else {
+		server = &http.Server{
+			Addr: address,
+		}
+	}
+
+	shutdownFinished := make(chan bool)
+	go func() {
+		<-sigChan
+		fmt.Println("Received termination signal...")
+		shutdown(server, redirectServer)
+		close(shutdownFinished)
+	}()
+
+	if config.TLS {
 		go func() {
-			err := http.ListenAndServe(":http", certManager.HTTPHandler(nil))
-			if err != nil {
+			err := redirectServer.ListenAndServe()
+			if err != nil && err != http.ErrServerClosed {
 				log.FatalError(err.Error(), "Error serving HTTPS server")
 				return
 			}
 		}()
 
-		if err := server.ListenAndServeTLS("", ""); err != nil {
+		if err := server.ListenAndServeTLS("", ""); err != http.ErrServerClosed {
 			log.FatalError(err.Error(), "Error starting TLS server")
 		}
-
 	} else {
 		log.Info("Listening on http://%s", address)
-		if err := http.ListenAndServe(address, nil); err != nil {
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
 			log.FatalError(err.Error(), "Error starting non-TLS server")
 		}
 	}
+
+	// wait until the database is closed too
+	<-shutdownFinished
+}
+
+// shutdown stops things in order, websocket sessions first since http.Server.Shutdown
+// doesn't wait for them, then http requests, database is closed last
+func shutdown(servers ...*http.Server) {
+	const shutdownTimeout = 10 * time.Second
+
+	websocket.Shutdown(shutdownTimeout)
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	for i := 0; i < len(servers); i++ {
+		if servers[i] == nil {
+			continue
+		}
+		if err := servers[i].Shutdown(ctx); err != nil {
+			log.WarnError(err.Error(), "Error shutting down http server [%s]", servers[i].Addr)
+		}
+	}
+	fmt.Println("Stopped http server")
+
+	// maintenance that already started is finished, it can't be left halfway through a batch
+	close(stopMaintenance)
+	maintenanceWg.Wait()
+	fmt.Println("Stopped maintenance")
+
+	err := database.CloseDatabaseConnection()
+	if err != nil {
+		log.Error("Error closing db connection")
+	}
+	fmt.Println("Closed main db connection successfully")
 }
 
-func maintenance() {
-	time.Sleep(1 * time.Second)
+// deletedMessageRetentionDays is how long content of deleted messages is kept for appeals,
+// used if not set in config.json
+const deletedMessageRetentionDays = 30
+
+var stopMaintenance = make(chan bool) // closed when shutting down
+var maintenanceWg sync.WaitGroup
+
+func maintenance(retentionDays int) {
+	defer maintenanceWg.Done()
+
+	if retentionDays <= 0 {
+		retentionDays = deletedMessageRetentionDays
+	}
+
+	select {
+	case <-stopMaintenance:
+		return
+	case <-time.After(1 * time.Second):
+	}
 	ticker := time.NewTicker(24 * time.Hour)
 	defer ticker.Stop()
 
 	task := func() {
 		startMaintetance := time.Now().UnixMilli()
 		token.DeleteExpiredTokens()
+		websocket.PurgeDeletedMessages(time.Now().AddDate(0, 0, -retentionDays).UnixMilli())
 		finished := time.Now().UnixMilli() - startMaintetance
 		log.Info("Maintenance finished in %d ms or %d seconds", finished, finished/1000)
 	}
@@ -184,6 +268,8 @@ func maintenance() {
 
 	for {
 		select {
+		case <-stopMaintenance:
+			return
 		case <-ticker.C:
 			task()
 		}
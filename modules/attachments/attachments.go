@@ -4,6 +4,9 @@ import (
 	log "chat-app/modules/logging"
 	"chat-app/modules/macros"
 	"crypto/rand"
+	"encoding/hex"
+	"os"
+	"path/filepath"
 	"sync"
 	"time"
 )
@@ -67,3 +70,18 @@ func removeUnusedAttachmentToken(attachmentToken [64]byte) {
 		awaitingAttachmentsMap.Delete(attachmentToken)
 	}
 }
+
+// FilePath is where the file of an attachment is saved, messages sending the same file share it
+func FilePath(hash []byte, name string) string {
+	return "./public/content/attachments/" + hex.EncodeToString(hash) + filepath.Ext(name)
+}
+
+// RemoveFile deletes the file of an attachment that no message has anymore
+func RemoveFile(hash []byte, name string) {
+	path := FilePath(hash, name)
+	log.Trace("Removing attachment file [%s]", path)
+	err := os.Remove(path)
+	if err != nil && !os.IsNotExist(err) {
+		log.WarnError(err.Error(), "Error removing attachment file [%s]", path)
+	}
+}
@@ -8,15 +8,78 @@ import (
 )
 
 type Client struct {
-	UserID           uint64
-	CurrentChannelID uint64
-	CurrentServerID  uint64
-	Status           byte
+	UserID                 uint64
+	CurrentChannelID       uint64
+	CurrentChannelServerID uint64 // server of CurrentChannelID, it may not be CurrentServerID
+	CurrentServerID        uint64
+	Status                 byte
+	Subscriptions          map[uint64]uint64 // channel ID -> server ID of channels subscribed to besides the current one
 }
 
+// how many channels a single session can subscribe to at the same time
+const MaxChannelSubscriptions = 10
+
 // accessed using session id
 var Clients sync.Map
 
+// indexes that are kept in sync with Clients, so broadcasting can look up
+// the affected sessions directly instead of going through every session
+var indexMutex sync.RWMutex
+var channelIndex = make(map[uint64]map[uint64]bool) // channel ID -> session IDs
+var serverIndex = make(map[uint64]map[uint64]bool)  // server ID -> session IDs
+var userIndex = make(map[uint64]map[uint64]bool)    // user ID -> session IDs
+
+// users that have sessions on other instances of chat-app
+var remoteMutex sync.RWMutex
+var remoteUsers = make(map[uint64]map[uint64]bool) // user ID -> node IDs
+var remoteNodes = make(map[uint64]map[uint64]bool) // node ID -> user IDs
+
+func addToIndex(index map[uint64]map[uint64]bool, key uint64, sessionID uint64) {
+	sessions, exists := index[key]
+	if !exists {
+		sessions = make(map[uint64]bool)
+		index[key] = sessions
+	}
+	sessions[sessionID] = true
+}
+
+func removeFromIndex(index map[uint64]map[uint64]bool, key uint64, sessionID uint64) {
+	sessions, exists := index[key]
+	if !exists {
+		return
+	}
+	delete(sessions, sessionID)
+	if len(sessions) == 0 {
+		delete(index, key)
+	}
+}
+
+func getFromIndex(index map[uint64]map[uint64]bool, keys []uint64) []uint64 {
+	indexMutex.RLock()
+	defer indexMutex.RUnlock()
+
+	var sessionIDs []uint64
+	for i := 0; i < len(keys); i++ {
+		for sessionID := range index[keys[i]] {
+			sessionIDs = append(sessionIDs, sessionID)
+		}
+	}
+	return sessionIDs
+}
+
+func loadClient(sessionID uint64) (*Client, bool) {
+	value, found := Clients.Load(sessionID)
+	if !found {
+		return nil, false
+	}
+	client, ok := value.(*Client)
+	if !ok {
+		log.Warn("[Session %d] Invalid Client type", sessionID)
+		return nil, false
+	}
+	return client, true
+}
+
 func AddClient(userID uint64) uint64 {
 	var sessionID uint64 = snowflake.Generate()
 	log.Trace("Adding user ID [%d] as session ID [%d] to Clients", userID, sessionID)
@@ -25,32 +88,44 @@ func AddClient(userID uint64) uint64 {
 		CurrentChannelID: 0,
 		CurrentServerID:  2000,
 		Status:           1,
+		Subscriptions:    make(map[uint64]uint64),
 	}
+
+	indexMutex.Lock()
 	Clients.Store(sessionID, client)
+	addToIndex(userIndex, userID, sessionID)
+	addToIndex(serverIndex, client.CurrentServerID, sessionID)
+	indexMutex.Unlock()
 
 	return sessionID
 }
 
 func RemoveClient(sessionID uint64) {
 	log.Trace("Removing session ID [%d] from Clients", sessionID)
+	indexMutex.Lock()
+	defer indexMutex.Unlock()
+
+	client, found := loadClient(sessionID)
+	if !found {
+		return
+	}
+	removeFromIndex(userIndex, client.UserID, sessionID)
+	removeFromIndex(serverIndex, client.CurrentServerID, sessionID)
+	removeFromIndex(channelIndex, client.CurrentChannelID, sessionID)
+	for channelID := range client.Subscriptions {
+		removeFromIndex(channelIndex, channelID, sessionID)
+	}
 	Clients.Delete(sessionID)
 }
 
 func CheckIfUserIsOnline(userID uint64) bool {
-	var online bool = false
+	var online bool = CheckIfUserIsOnlineLocally(userID)
+	if !online {
+		remoteMutex.RLock()
+		online = len(remoteUsers[userID]) > 0
+		remoteMutex.RUnlock()
+	}
 
-	Clients.Range(func(key, value interface{}) bool {
-		client, ok := value.(*Client)
-		if !ok {
-			log.Warn("Invalid WsClient")
-			return true
-		}
-		if client.UserID == userID {
-			online = true
-			return false
-		}
-		return true
-	})
 	if online {
 		log.Trace("User ID [%d] is online", userID)
 	} else {
@@ -60,6 +135,50 @@ func CheckIfUserIsOnline(userID uint64) bool {
 	return online
 }
 
+// CheckIfUserIsOnlineLocally only looks at the sessions connected to this instance
+func CheckIfUserIsOnlineLocally(userID uint64) bool {
+	indexMutex.RLock()
+	defer indexMutex.RUnlock()
+	return len(userIndex[userID]) > 0
+}
+
+// GetLocalOnlineUsers returns the users that have sessions connected to this instance
+func GetLocalOnlineUsers() []uint64 {
+	indexMutex.RLock()
+	defer indexMutex.RUnlock()
+
+	var userIDs []uint64 = make([]uint64, 0, len(userIndex))
+	for userID := range userIndex {
+		userIDs = append(userIDs, userID)
+	}
+	return userIDs
+}
+
+// SetRemoteUserOnline keeps track of which users are connected to another instance
+func SetRemoteUserOnline(nodeID uint64, userID uint64, online bool) {
+	remoteMutex.Lock()
+	defer remoteMutex.Unlock()
+
+	if online {
+		addToIndex(remoteUsers, userID, nodeID)
+		addToIndex(remoteNodes, nodeID, userID)
+	} else {
+		removeFromIndex(remoteUsers, userID, nodeID)
+		removeFromIndex(remoteNodes, nodeID, userID)
+	}
+}
+
+// RemoveRemoteNode forgets every user of an instance that is no longer reachable
+func RemoveRemoteNode(nodeID uint64) {
+	remoteMutex.Lock()
+	defer remoteMutex.Unlock()
+
+	for userID := range remoteNodes[nodeID] {
+		removeFromIndex(remoteUsers, userID, nodeID)
+	}
+	delete(remoteNodes, nodeID)
+}
+
 func FilterOnlineMembers(members []database.ServerMember) []uint64 {
 	var onlineMembers []uint64
 
@@ -73,95 +192,173 @@ func FilterOnlineMembers(members []database.ServerMember) []uint64 {
 }
 
 func GetUserSessions(userID uint64) []uint64 {
-	var sessionIDs []uint64
+	return getFromIndex(userIndex, []uint64{userID})
+}
 
-	Clients.Range(func(key, value interface{}) bool {
-		sessionID, ok := key.(uint64)
-		if !ok {
-			log.Warn("Invalid key type")
-			return true
-		}
-		client, ok := value.(*Client)
-		if !ok {
-			log.Warn("Invalid WsClient type while getting user sessions")
-			return true
-		}
-		if client.UserID == userID {
-			sessionIDs = append(sessionIDs, sessionID)
-			return false
-		}
-		return true
-	})
+// GetSessionsOfUsers returns every session of the given users
+func GetSessionsOfUsers(userIDs []uint64) []uint64 {
+	return getFromIndex(userIndex, userIDs)
+}
 
-	return sessionIDs
+// GetChannelSessions returns the sessions that are currently viewing the given channel
+func GetChannelSessions(channelID uint64) []uint64 {
+	if channelID == 0 {
+		return nil
+	}
+	return getFromIndex(channelIndex, []uint64{channelID})
+}
+
+// GetServerSessions returns the sessions that are currently viewing any of the given servers
+func GetServerSessions(serverIDs []uint64) []uint64 {
+	return getFromIndex(serverIndex, serverIDs)
 }
 
 func GetCurrentChannelID(sessionID uint64) uint64 {
 	log.Trace("[Session %d] Getting current channel ID", sessionID)
-	client, found := Clients.Load(sessionID)
-	if found {
-		client, ok := client.(*Client)
-		if !ok {
-			log.Warn("[Session %d] Invalid Client type while getting current channel ID for session", sessionID)
-			return 0
-		}
-		log.Trace("[Session %d] Current channel is: [%d]", sessionID, client.CurrentChannelID)
-		return client.CurrentChannelID
-	} else {
+	indexMutex.RLock()
+	defer indexMutex.RUnlock()
+
+	client, found := loadClient(sessionID)
+	if !found {
 		log.Trace("[Session %d] Session was not found while looking for current channel ID", sessionID)
 		return 0
 	}
+	log.Trace("[Session %d] Current channel is: [%d]", sessionID, client.CurrentChannelID)
+	return client.CurrentChannelID
 }
 
-func SetCurrentChannelID(sessionID uint64, channelID uint64) bool {
+// SetCurrentChannelID sets the channel the session is viewing, serverID is the server of the channel
+func SetCurrentChannelID(sessionID uint64, channelID uint64, serverID uint64) bool {
 	log.Trace("[Session %d] Setting current channel", sessionID)
-	client, found := Clients.Load(sessionID)
-	if found {
-		client, ok := client.(*Client)
-		if !ok {
-			log.Warn("[Session %d] Invalid Client type while setting current channel ID for session", sessionID)
-			return false
-		}
-		client.CurrentChannelID = channelID
-		log.Trace("[Session %d] Current channel set to channel ID [%d]", sessionID, channelID)
-		return true
-	} else {
+	indexMutex.Lock()
+	defer indexMutex.Unlock()
+
+	client, found := loadClient(sessionID)
+	if !found {
 		log.Trace("[Session %d] Session was not found while setting current channel ID", sessionID)
 		return false
 	}
+	// the previous channel stays in the index if it was also subscribed to explicitly
+	if _, subscribed := client.Subscriptions[client.CurrentChannelID]; !subscribed {
+		removeFromIndex(channelIndex, client.CurrentChannelID, sessionID)
+	}
+	client.CurrentChannelID = channelID
+	client.CurrentChannelServerID = serverID
+	if channelID != 0 {
+		addToIndex(channelIndex, channelID, sessionID)
+	}
+	log.Trace("[Session %d] Current channel set to channel ID [%d]", sessionID, channelID)
+	return true
 }
 
 func GetCurrentServerID(sessionID uint64) (uint64, bool) {
 	log.Trace("[Session %d] Getting current server ID", sessionID)
-	client, found := Clients.Load(sessionID)
-	if found {
-		client, ok := client.(*Client)
-		if !ok {
-			log.Warn("[Session %d] Invalid Client type while getting current server ID", sessionID)
-			return 0, false
-		}
-		log.Trace("[Session %d] Current server is: [%d]", sessionID, client.CurrentServerID)
-		return client.CurrentServerID, true
-	} else {
+	indexMutex.RLock()
+	defer indexMutex.RUnlock()
+
+	client, found := loadClient(sessionID)
+	if !found {
 		log.Trace("[Session %d] Session was not found while looking for current server ID", sessionID)
 		return 0, false
 	}
+	log.Trace("[Session %d] Current server is: [%d]", sessionID, client.CurrentServerID)
+	return client.CurrentServerID, true
 }
 
 func SetCurrentServerID(sessionID uint64, serverID uint64) bool {
 	log.Trace("[Session %d] Setting current server", sessionID)
-	client, found := Clients.Load(sessionID)
-	if found {
-		client, ok := client.(*Client)
-		if !ok {
-			log.Warn("[Session %d] Invalid Client type while setting current server ID", sessionID)
-			return false
-		}
-		client.CurrentServerID = serverID
-		log.Trace("[Session %d] Current server set to server ID [%d]", sessionID, serverID)
-		return true
-	} else {
+	indexMutex.Lock()
+	defer indexMutex.Unlock()
+
+	client, found := loadClient(sessionID)
+	if !found {
 		log.Trace("[Session %d] Session was not found while setting current server ID", sessionID)
 		return false
 	}
+	removeFromIndex(serverIndex, client.CurrentServerID, sessionID)
+	client.CurrentServerID = serverID
+	addToIndex(serverIndex, serverID, sessionID)
+	log.Trace("[Session %d] Current server set to server ID [%d]", sessionID, serverID)
+	return true
+}
+
+// SubscribeChannel makes the session receive events of the given channel besides the current one,
+// returns false if the session doesn't exist or already reached MaxChannelSubscriptions
+func SubscribeChannel(sessionID uint64, channelID uint64, serverID uint64) bool {
+	log.Trace("[Session %d] Subscribing to channel ID [%d]", sessionID, channelID)
+	indexMutex.Lock()
+	defer indexMutex.Unlock()
+
+	client, found := loadClient(sessionID)
+	if !found {
+		log.Trace("[Session %d] Session was not found while subscribing to channel ID [%d]", sessionID, channelID)
+		return false
+	}
+	if _, subscribed := client.Subscriptions[channelID]; subscribed {
+		return true
+	}
+	if len(client.Subscriptions) >= MaxChannelSubscriptions {
+		log.Hack("[Session %d] Tried to subscribe to more than [%d] channels", sessionID, MaxChannelSubscriptions)
+		return false
+	}
+	client.Subscriptions[channelID] = serverID
+	addToIndex(channelIndex, channelID, sessionID)
+	log.Trace("[Session %d] Subscribed to channel ID [%d]", sessionID, channelID)
+	return true
+}
+
+func UnsubscribeChannel(sessionID uint64, channelID uint64) bool {
+	log.Trace("[Session %d] Unsubscribing from channel ID [%d]", sessionID, channelID)
+	indexMutex.Lock()
+	defer indexMutex.Unlock()
+
+	client, found := loadClient(sessionID)
+	if !found {
+		log.Trace("[Session %d] Session was not found while unsubscribing from channel ID [%d]", sessionID, channelID)
+		return false
+	}
+	if _, subscribed := client.Subscriptions[channelID]; !subscribed {
+		return false
+	}
+	delete(client.Subscriptions, channelID)
+	if client.CurrentChannelID != channelID {
+		removeFromIndex(channelIndex, channelID, sessionID)
+	}
+	log.Trace("[Session %d] Unsubscribed from channel ID [%d]", sessionID, channelID)
+	return true
+}
+
+// UnsubscribeUserFromServer removes every channel subscription of the user's sessions that belong to the given server,
+// used when user leaves or is kicked from a server so they won't receive its messages anymore
+func UnsubscribeUserFromServer(userID uint64, serverID uint64) {
+	log.Trace("Removing subscriptions of user ID [%d] to channels of server ID [%d]", userID, serverID)
+	indexMutex.Lock()
+	defer indexMutex.Unlock()
+
+	for sessionID := range userIndex[userID] {
+		client, found := loadClient(sessionID)
+		if !found {
+			continue
+		}
+		for channelID, channelServerID := range client.Subscriptions {
+			if channelServerID != serverID {
+				continue
+			}
+			delete(client.Subscriptions, channelID)
+			if client.CurrentChannelID != channelID {
+				removeFromIndex(channelIndex, channelID, sessionID)
+			}
+		}
+
+		// sessions still looking at the server or one of its channels stop receiving its events too
+		if client.CurrentServerID == serverID {
+			removeFromIndex(serverIndex, serverID, sessionID)
+			client.CurrentServerID = 0
+		}
+		if client.CurrentChannelID != 0 && client.CurrentChannelServerID == serverID {
+			removeFromIndex(channelIndex, client.CurrentChannelID, sessionID)
+			client.CurrentChannelID = 0
+			client.CurrentChannelServerID = 0
+		}
+	}
 }
@@ -0,0 +1,82 @@
+package clients
+
+import (
+	"fmt"
+	"testing"
+)
+
+// how many sessions view the channel or server being broadcast to, the rest are elsewhere
+const benchSubscribers = 50
+
+var benchTotals = []int{1_000, 10_000, 100_000}
+
+// addBenchSessions connects total sessions, benchSubscribers of them view the given channel and server,
+// returns a function that disconnects all of them
+func addBenchSessions(total int, channelID uint64, serverID uint64) func() {
+	var sessionIDs = make([]uint64, total)
+	for i := 0; i < total; i++ {
+		sessionIDs[i] = AddClient(uint64(i + 1))
+		if i < benchSubscribers {
+			SetCurrentServerID(sessionIDs[i], serverID)
+			SetCurrentChannelID(sessionIDs[i], channelID, serverID)
+		} else {
+			// everyone else is spread over other servers and channels
+			SetCurrentServerID(sessionIDs[i], serverID+1+uint64(i%100))
+			SetCurrentChannelID(sessionIDs[i], channelID+1+uint64(i%1000), serverID+1+uint64(i%100))
+		}
+	}
+
+	return func() {
+		for i := 0; i < len(sessionIDs); i++ {
+			RemoveClient(sessionIDs[i])
+		}
+	}
+}
+
+// cost of finding who receives a channel broadcast shouldn't grow with the total amount of sessions
+func BenchmarkGetChannelSessions(b *testing.B) {
+	const channelID uint64 = 1_000_000
+	const serverID uint64 = 2_000_000
+
+	for _, total := range benchTotals {
+		b.Run(fmt.Sprintf("sessions=%d", total), func(b *testing.B) {
+			cleanup := addBenchSessions(total, channelID, serverID)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if sessions := GetChannelSessions(channelID); len(sessions) != benchSubscribers {
+					b.Fatalf("got %d sessions, want %d", len(sessions), benchSubscribers)
+				}
+			}
+
+			// disconnecting the sessions isn't part of the measurement
+			b.StopTimer()
+			cleanup()
+		})
+	}
+}
+
+// cost of finding who receives a server broadcast shouldn't grow with the total amount of sessions
+func BenchmarkGetServerSessions(b *testing.B) {
+	const channelID uint64 = 1_000_000
+	const serverID uint64 = 2_000_000
+
+	for _, total := range benchTotals {
+		b.Run(fmt.Sprintf("sessions=%d", total), func(b *testing.B) {
+			cleanup := addBenchSessions(total, channelID, serverID)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if sessions := GetServerSessions([]uint64{serverID}); len(sessions) != benchSubscribers {
+					b.Fatalf("got %d sessions, want %d", len(sessions), benchSubscribers)
+				}
+			}
+
+			// disconnecting the sessions isn't part of the measurement
+			b.StopTimer()
+			cleanup()
+		})
+	}
+}
@@ -33,33 +33,44 @@ func CreateAttachmentsTable() {
 	}
 }
 
-func GetAttachmentsOfMessage(messageID uint64) []AttachmentResponse {
-	const query string = "SELECT hash, name FROM attachments WHERE message_id = ?"
-	log.Query(query, messageID)
+// GetAttachmentsOfMessages returns attachments of every given message in a single query,
+// only messages flagged as having attachments should be given
+func GetAttachmentsOfMessages(messageIDs []uint64) map[uint64][]AttachmentResponse {
+	var attachments = make(map[uint64][]AttachmentResponse)
+	if len(messageIDs) == 0 {
+		return attachments
+	}
+
+	var query = "SELECT message_id, hash, name FROM attachments WHERE message_id IN (" + placeholders(len(messageIDs)) + ")"
+	var args = make([]any, len(messageIDs))
+	for i := 0; i < len(messageIDs); i++ {
+		args[i] = messageIDs[i]
+	}
+	log.Query(query, args...)
 
-	log.Trace("Running query")
-	rows, err := Conn.Query(query, messageID)
-	log.Trace("Checking for error")
+	rows, err := Conn.Query(query, args...)
 	DatabaseErrorCheck(err)
+	if err != nil {
+		return attachments
+	}
 	defer rows.Close()
 
-	log.Trace("Starting rows next")
-	var attachments []AttachmentResponse
 	for rows.Next() {
-		log.Trace("Next row")
-		//var hash []byte
-		//var name string
+		var messageID uint64
 		attachment := AttachmentResponse{}
-		err := rows.Scan(&attachment.Hash, &attachment.Name)
+		err := rows.Scan(&messageID, &attachment.Hash, &attachment.Name)
 		DatabaseErrorCheck(err)
 
-		attachments = append(attachments, attachment)
+		attachments[messageID] = append(attachments[messageID], attachment)
 	}
 	DatabaseErrorCheck(rows.Err())
+	rows.Close()
 
-	if len(attachments) == 0 {
-		log.Error("Error in GetAttachmentsOfMessage, somehow message ID [%d] has no attachments despite it being flagged having, removing flag from database...", messageID)
-		RemoveHasAttachmentFlag(messageID)
+	for i := 0; i < len(messageIDs); i++ {
+		if len(attachments[messageIDs[i]]) == 0 {
+			log.Error("Error in GetAttachmentsOfMessages, somehow message ID [%d] has no attachments despite it being flagged having, removing flag from database...", messageIDs[i])
+			RemoveHasAttachmentFlag(messageIDs[i])
+		}
 	}
 	return attachments
 }
@@ -6,9 +6,11 @@ import (
 )
 
 type Channel struct {
-	ChannelID uint64
-	ServerID  uint64
-	Name      string
+	ChannelID     uint64
+	ServerID      uint64
+	Name          string
+	RetentionDays int // messages older than this are deleted, 0 if the policy of the server applies
+	Topic         string
 }
 
 type ChannelDelete struct {
@@ -26,14 +28,19 @@ func CreateChannelsTable() {
 			channel_id BIGINT UNSIGNED PRIMARY KEY,
 			server_id BIGINT UNSIGNED NOT NULL,
 			name TEXT NOT NULL,
+			retention_days INT NOT NULL DEFAULT 0,
+			topic TEXT NOT NULL DEFAULT '',
 			FOREIGN KEY (server_id) REFERENCES servers(server_id) ON DELETE CASCADE
 		)`)
 	if err != nil {
 		log.FatalError(err.Error(), "Error creating channels table")
 	}
+
+	addColumnIfMissing("channels", "retention_days", "INT NOT NULL DEFAULT 0")
+	addColumnIfMissing("channels", "topic", "TEXT NOT NULL DEFAULT ''")
 }
 func GetChannelList(serverID uint64) []byte {
-	const query string = "SELECT * FROM channels WHERE server_id = ?"
+	const query string = "SELECT channel_id, server_id, name, retention_days, topic FROM channels WHERE server_id = ?"
 	log.Query(query, serverID)
 
 	var channels []Channel
@@ -43,7 +50,7 @@ func GetChannelList(serverID uint64) []byte {
 
 	for rows.Next() {
 		var channel Channel
-		err := rows.Scan(&channel.ChannelID, &channel.ServerID, &channel.Name)
+		err := rows.Scan(&channel.ChannelID, &channel.ServerID, &channel.Name, &channel.RetentionDays, &channel.Topic)
 		DatabaseErrorCheck(err)
 		channels = append(channels, channel)
 	}
@@ -96,3 +103,18 @@ func ChangeChannelName(channelID uint64, name string) bool {
 		return false
 	}
 }
+
+func SetChannelTopic(channelID uint64, topic string) bool {
+	const query string = "UPDATE channels SET topic = ? WHERE channel_id = ?"
+	log.Query(query, topic, channelID)
+
+	result, err := Conn.Exec(query, topic, channelID)
+	DatabaseErrorCheck(err)
+	if err != nil {
+		return false
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	DatabaseErrorCheck(err)
+	return rowsAffected == 1
+}
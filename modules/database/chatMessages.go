@@ -3,8 +3,10 @@ package database
 import (
 	log "chat-app/modules/logging"
 	"chat-app/modules/macros"
+	"chat-app/modules/snowflake"
+	"database/sql"
 	"encoding/json"
-	"fmt"
+	"sort"
 )
 
 type Message struct {
@@ -14,6 +16,7 @@ type Message struct {
 	Message        string
 	HasAttachments bool
 	ReplyID        uint64
+	ThreadID       uint64 // 0 if message isn't a thread reply
 }
 
 type RetrievedMessage struct {
@@ -23,6 +26,11 @@ type RetrievedMessage struct {
 	HasAttachments bool
 	Edited         bool
 	ReplyID        uint64
+	ReplyCount     uint32 // replies in the thread started from the message
+	LastReply      int64
+	Reactions      []ReactionCount
+	DeletedBy      uint64 // 0 if message wasn't deleted, otherwise the author or a moderator
+	Poll           *PollState
 }
 
 type UserMessages struct {
@@ -30,13 +38,7 @@ type UserMessages struct {
 	Msgs   []interface{}
 }
 
-type DeleteMessage struct {
-	MessageID uint64
-	UserID    uint64
-}
-
-const insertChatMessageQuery = "INSERT INTO messages (message_id, channel_id, user_id, message, has_attachments, edited, reply_id) VALUES (?, ?, ?, ?, ?, ?, ?)"
-const deleteChatMessageQuery = "DELETE FROM messages WHERE message_id = ? AND user_id = ?"
+const insertChatMessageQuery = "INSERT INTO messages (message_id, channel_id, user_id, message, has_attachments, edited, reply_id, thread_id) VALUES (?, ?, ?, ?, ?, ?, ?, ?)"
 
 func CreateChatMessagesTable() {
 	_, err := Conn.Exec(`CREATE TABLE IF NOT EXISTS messages (
@@ -47,31 +49,67 @@ func CreateChatMessagesTable() {
 			edited BOOLEAN NOT NULL,
 			has_attachments BOOLEAN NOT NULL,
 			reply_id BIGINT UNSIGNED NOT NULL default 0,
+			thread_id BIGINT UNSIGNED NOT NULL default 0,
+			deleted_by BIGINT UNSIGNED NOT NULL default 0,
+			deleted_at BIGINT NOT NULL default 0,
 			FOREIGN KEY (channel_id) REFERENCES channels(channel_id) ON DELETE CASCADE,
 			FOREIGN KEY (user_id) REFERENCES users(user_id) ON DELETE CASCADE
 		)`)
 	if err != nil {
 		log.FatalError(err.Error(), "Error creating messages table")
 	}
+
+	addColumnIfMissing("messages", "thread_id", "BIGINT UNSIGNED NOT NULL default 0")
+	addColumnIfMissing("messages", "deleted_by", "BIGINT UNSIGNED NOT NULL default 0")
+	addColumnIfMissing("messages", "deleted_at", "BIGINT NOT NULL default 0")
 }
 
-func GetChatHistory(channelID uint64, fromMessageID uint64, older bool, userID uint64) []byte {
-	const query = "SELECT message_id, user_id, message, has_attachments, edited, reply_id FROM messages WHERE channel_id = ? AND (message_id < ? OR ? = 0) ORDER BY message_id DESC LIMIT 50"
-	log.Query(query, channelID, fromMessageID, fromMessageID)
+// GetChatHistory returns a page of messages of the channel grouped by their authors, newest first,
+// with whether there are more messages older and newer than the page
+func GetChatHistory(channelID uint64, page HistoryPage, userID uint64) []byte {
+	// thread replies are left out, the messages they belong to come with the reply count of their thread
+	const query = "SELECT m.message_id, m.user_id, m.message, m.has_attachments, m.edited, m.reply_id, COALESCE(t.reply_count, 0), COALESCE(t.last_reply, 0), m.deleted_by FROM messages m LEFT JOIN threads t ON t.thread_id = m.message_id WHERE m.channel_id = ? AND m.thread_id = 0"
 
-	rows, err := Conn.Query(query, channelID, fromMessageID, fromMessageID)
-	DatabaseErrorCheck(err)
 	var retrievedMsgs []RetrievedMessage
-	for rows.Next() {
+	moreOlder, moreNewer := queryPage(query, []any{channelID}, page, func(rows *sql.Rows) error {
 		retrievedMsg := RetrievedMessage{}
 
-		err := rows.Scan(&retrievedMsg.MessageID, &retrievedMsg.UserID, &retrievedMsg.Message, &retrievedMsg.HasAttachments, &retrievedMsg.Edited, &retrievedMsg.ReplyID)
-		DatabaseErrorCheck(err)
+		err := rows.Scan(&retrievedMsg.MessageID, &retrievedMsg.UserID, &retrievedMsg.Message, &retrievedMsg.HasAttachments, &retrievedMsg.Edited, &retrievedMsg.ReplyID, &retrievedMsg.ReplyCount, &retrievedMsg.LastReply, &retrievedMsg.DeletedBy)
+
+		// deleted messages are left in history as tombstones without their content
+		if retrievedMsg.DeletedBy != 0 {
+			retrievedMsg.Message = ""
+			retrievedMsg.HasAttachments = false
+		}
 
 		retrievedMsgs = append(retrievedMsgs, retrievedMsg)
+		return err
+	})
+
+	// pages going forward or around a message come partly in ascending order
+	sort.Slice(retrievedMsgs, func(i, j int) bool {
+		return retrievedMsgs[i].MessageID > retrievedMsgs[j].MessageID
+	})
+
+	var messageIDs = make([]uint64, len(retrievedMsgs))
+	var withAttachments []uint64
+	for m := 0; m < len(retrievedMsgs); m++ {
+		messageIDs[m] = retrievedMsgs[m].MessageID
+		if retrievedMsgs[m].HasAttachments {
+			withAttachments = append(withAttachments, retrievedMsgs[m].MessageID)
+		}
+	}
+	reactions := GetReactionsOfMessages(messageIDs, userID)
+	attachments := GetAttachmentsOfMessages(withAttachments)
+	polls := GetPollsOfMessages(messageIDs, userID)
+	for m := 0; m < len(retrievedMsgs); m++ {
+		if retrievedMsgs[m].DeletedBy == 0 {
+			retrievedMsgs[m].Reactions = reactions[retrievedMsgs[m].MessageID]
+			retrievedMsgs[m].Poll = polls[retrievedMsgs[m].MessageID]
+		}
 	}
 
-	var userMessages []UserMessages
+	var userMessages = []UserMessages{}
 	for m := 0; m < len(retrievedMsgs); m++ {
 		found := false
 		index := 0
@@ -88,25 +126,19 @@ func GetChatHistory(channelID uint64, fromMessageID uint64, older bool, userID u
 			index = len(userMessages) - 1
 		}
 
-		var attachmentHistory []AttachmentResponse
-		if retrievedMsgs[m].HasAttachments {
-			attachmentHistory = GetAttachmentsOfMessage(retrievedMsgs[m].MessageID)
-		}
-
+		attachmentHistory := attachments[retrievedMsgs[m].MessageID]
 		log.Trace("Message ID [%d] has [%d] attachments", retrievedMsgs[m].MessageID, len(attachmentHistory))
 
-		userMessages[index].Msgs = append(userMessages[index].Msgs, []interface{}{retrievedMsgs[m].MessageID, retrievedMsgs[m].Message, retrievedMsgs[m].Edited, attachmentHistory, retrievedMsgs[m].ReplyID})
+		userMessages[index].Msgs = append(userMessages[index].Msgs, []interface{}{retrievedMsgs[m].MessageID, retrievedMsgs[m].Message, retrievedMsgs[m].Edited, attachmentHistory, retrievedMsgs[m].ReplyID, retrievedMsgs[m].ReplyCount, retrievedMsgs[m].LastReply, retrievedMsgs[m].Reactions, retrievedMsgs[m].DeletedBy, retrievedMsgs[m].Poll})
 	}
 
 	if len(userMessages) == 0 {
 		log.Trace("Channel ID [%d] does not have any messages or user reached top of chat", channelID)
-		var emptyResponse []byte = []byte(fmt.Sprintf("[%d, []]", channelID))
-		return emptyResponse
 	} else {
 		log.Trace("Retrieved [%d] messages from channel ID [%d]", len(userMessages), channelID)
 	}
 
-	var chatHistory = []interface{}{channelID, userMessages}
+	var chatHistory = []interface{}{channelID, userMessages, moreOlder, moreNewer}
 
 	jsonResult, err := json.Marshal(chatHistory)
 	if err != nil {
@@ -127,18 +159,206 @@ func GetChannelOfMessageID(messageID uint64, userID uint64) uint64 {
 	return channelID
 }
 
-func EditChatMessage(messageID uint64, userID uint64, message string) uint64 {
-	const query string = "UPDATE messages SET message = ?, edited = true WHERE user_id = ? AND message_id = ? RETURNING channel_id"
-	log.Query(query, message, userID, messageID)
+// EditChatMessage replaces the content of the message and keeps the previous one as a revision,
+// returns the channel of the message, 0 if the user has no such message
+func EditChatMessage(messageID uint64, userID uint64, message string, editedAt int64) uint64 {
+	tx, err := Conn.Begin()
+	transactionErrorCheck(err)
+
+	defer tx.Rollback()
+
+	const query1 string = "SELECT channel_id, message FROM messages WHERE user_id = ? AND message_id = ? AND deleted_at = 0"
+	log.Query(query1, userID, messageID)
 
 	var channelID uint64
+	var previous string
+	err = tx.QueryRow(query1, userID, messageID).Scan(&channelID, &previous)
+	DatabaseErrorCheck(err)
+	if err != nil {
+		return 0
+	}
+
+	const query2 string = "INSERT INTO message_revisions (revision_id, message_id, message, edited_at) VALUES (?, ?, ?, ?)"
+	revisionID := snowflake.Generate()
+	log.Query(query2, revisionID, messageID, previous, editedAt)
 
-	err := Conn.QueryRow(query, message, userID, messageID).Scan(&channelID)
+	_, err = tx.Exec(query2, revisionID, messageID, previous, editedAt)
 	DatabaseErrorCheck(err)
+	if err != nil {
+		return 0
+	}
+
+	const query3 string = "UPDATE messages SET message = ?, edited = true WHERE message_id = ?"
+	log.Query(query3, message, messageID)
+
+	_, err = tx.Exec(query3, message, messageID)
+	DatabaseErrorCheck(err)
+	if err != nil {
+		return 0
+	}
+
+	err = tx.Commit()
+	transactionErrorCheck(err)
 
 	return channelID
 }
 
+// DeleteChatMessage leaves a tombstone of the message in history, its content is kept
+// until PurgeDeletedMessages removes it, returns false if message was already deleted
+func DeleteChatMessage(messageID uint64, deletedBy uint64, deletedAt int64) bool {
+	tx, err := Conn.Begin()
+	transactionErrorCheck(err)
+
+	defer tx.Rollback()
+
+	const query1 string = "UPDATE messages SET deleted_by = ?, deleted_at = ? WHERE message_id = ? AND deleted_at = 0"
+	log.Query(query1, deletedBy, deletedAt, messageID)
+
+	result, err := tx.Exec(query1, deletedBy, deletedAt, messageID)
+	DatabaseErrorCheck(err)
+	if err != nil {
+		return false
+	}
+	rowsAffected, err := result.RowsAffected()
+	DatabaseErrorCheck(err)
+	if rowsAffected != 1 {
+		log.Trace("Message ID [%d] doesn't exist or was already deleted", messageID)
+		return false
+	}
+
+	// tombstones can't stay pinned
+	const query2 string = "DELETE FROM pins WHERE message_id = ?"
+	log.Query(query2, messageID)
+
+	_, err = tx.Exec(query2, messageID)
+	DatabaseErrorCheck(err)
+	if err != nil {
+		return false
+	}
+
+	err = tx.Commit()
+	transactionErrorCheck(err)
+
+	return true
+}
+
+// GetDeletedMessage returns the channel and content of a deleted message that wasn't purged yet,
+// channel is 0 if there is no such message
+func GetDeletedMessage(messageID uint64) (uint64, string, int64) {
+	const query string = "SELECT channel_id, message, deleted_at FROM messages WHERE message_id = ? AND deleted_at != 0"
+	log.Query(query, messageID)
+
+	var channelID uint64
+	var message string
+	var deletedAt int64
+	err := Conn.QueryRow(query, messageID).Scan(&channelID, &message, &deletedAt)
+	DatabaseErrorCheck(err)
+
+	return channelID, message, deletedAt
+}
+
+// PurgedMessages is what was removed from deleted messages in one batch
+type PurgedMessages struct {
+	Count    int
+	Orphaned []AttachmentResponse // attachments no other message uses, their files can be removed
+}
+
+// PurgeDeletedMessages removes content of up to limit messages that were deleted before the given time,
+// their tombstones stay in history
+func PurgeDeletedMessages(deletedBefore int64, limit int) PurgedMessages {
+	var purged PurgedMessages
+
+	tx, err := Conn.Begin()
+	DatabaseErrorCheck(err)
+	if err != nil {
+		return purged
+	}
+
+	defer tx.Rollback()
+
+	// purged tombstones have nothing left, so they aren't selected again
+	const query1 string = "SELECT m.message_id FROM messages m WHERE m.deleted_at != 0 AND m.deleted_at < ? AND (m.message != '' OR m.has_attachments OR EXISTS (SELECT 1 FROM message_revisions r WHERE r.message_id = m.message_id) OR EXISTS (SELECT 1 FROM reactions r WHERE r.message_id = m.message_id) OR EXISTS (SELECT 1 FROM polls p WHERE p.message_id = m.message_id)) ORDER BY m.message_id ASC LIMIT ?"
+	log.Query(query1, deletedBefore, limit)
+
+	rows, err := tx.Query(query1, deletedBefore, limit)
+	DatabaseErrorCheck(err)
+	if err != nil {
+		return purged
+	}
+
+	var args []any
+	for rows.Next() {
+		var messageID uint64
+		DatabaseErrorCheck(rows.Scan(&messageID))
+		args = append(args, messageID)
+	}
+	DatabaseErrorCheck(rows.Err())
+	rows.Close()
+
+	if len(args) == 0 {
+		return purged
+	}
+
+	var inClause = "(" + placeholders(len(args)) + ")"
+
+	const query2 string = "SELECT DISTINCT hash, name FROM attachments WHERE message_id IN "
+	log.Query(query2+inClause, args...)
+
+	rows, err = tx.Query(query2+inClause, args...)
+	DatabaseErrorCheck(err)
+	if err != nil {
+		return purged
+	}
+
+	var attachments []AttachmentResponse
+	for rows.Next() {
+		var attachment AttachmentResponse
+		DatabaseErrorCheck(rows.Scan(&attachment.Hash, &attachment.Name))
+		attachments = append(attachments, attachment)
+	}
+	DatabaseErrorCheck(rows.Err())
+	rows.Close()
+
+	queries := []string{
+		"DELETE FROM message_revisions WHERE message_id IN ",
+		"DELETE FROM attachments WHERE message_id IN ",
+		"DELETE FROM reactions WHERE message_id IN ",
+		"DELETE FROM polls WHERE message_id IN ",
+		"UPDATE messages SET message = '', has_attachments = FALSE WHERE message_id IN ",
+	}
+	for i := 0; i < len(queries); i++ {
+		log.Query(queries[i]+inClause, args...)
+
+		_, err := tx.Exec(queries[i]+inClause, args...)
+		DatabaseErrorCheck(err)
+		if err != nil {
+			return PurgedMessages{}
+		}
+	}
+
+	// files are shared between messages that sent the same file
+	const query3 string = "SELECT EXISTS (SELECT 1 FROM attachments WHERE hash = ?) OR EXISTS (SELECT 1 FROM scheduled_attachments WHERE hash = ?)"
+	for i := 0; i < len(attachments); i++ {
+		log.Query(query3, attachments[i].Hash, attachments[i].Hash)
+
+		var used bool
+		err := tx.QueryRow(query3, attachments[i].Hash, attachments[i].Hash).Scan(&used)
+		DatabaseErrorCheck(err)
+		if err == nil && !used {
+			purged.Orphaned = append(purged.Orphaned, attachments[i])
+		}
+	}
+
+	err = tx.Commit()
+	DatabaseErrorCheck(err)
+	if err != nil {
+		return PurgedMessages{}
+	}
+
+	purged.Count = len(args)
+	return purged
+}
+
 func RemoveHasAttachmentFlag(messageID uint64) {
 	const query string = "UPDATE messages SET has_attachments = FALSE WHERE message_id = ?"
 	log.Query(query, messageID)
@@ -8,6 +8,7 @@ import (
 	"github.com/mattn/go-sqlite3"
 	_ "github.com/mattn/go-sqlite3"
 	_ "github.com/sijms/go-ora/v2"
+	"strings"
 )
 
 var Conn *sql.DB
@@ -73,8 +74,18 @@ func CreateTables() {
 	CreateTokensTable()
 	CreateServersTable()
 	CreateServerMembersTable()
+	CreateServerEmojiTable()
 	CreateChannelsTable()
 	CreateChatMessagesTable()
+	CreateSearchIndex()
+	CreateMessageRevisionsTable()
+	CreateThreadsTable()
+	CreateReactionsTable()
+	CreatePinsTable()
+	CreatePollsTable()
+	CreateMentionsTable()
+	CreateReadStatesTable()
+	CreateScheduledMessagesTable()
 	CreateFriendshipsTable()
 	CreateBlockListTable()
 	CreateDmChatTable()
@@ -84,6 +95,41 @@ func CreateTables() {
 	CreateBotTable()
 }
 
+// addColumnIfMissing adds a column that was introduced after the table was first created,
+// CREATE TABLE IF NOT EXISTS leaves tables of existing databases as they were
+func addColumnIfMissing(table string, column string, definition string) {
+	var query string
+	if sqlite {
+		query = "SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?"
+	} else {
+		query = "SELECT COUNT(*) FROM information_schema.columns WHERE table_schema = DATABASE() AND table_name = ? AND column_name = ?"
+	}
+	log.Query(query, table, column)
+
+	var count int
+	err := Conn.QueryRow(query, table, column).Scan(&count)
+	if err != nil {
+		log.FatalError(err.Error(), "Error checking if column [%s] exists in table [%s]", column, table)
+	}
+	if count != 0 {
+		return
+	}
+
+	alter := fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition)
+	log.Query(alter)
+
+	_, err = Conn.Exec(alter)
+	if err != nil {
+		log.FatalError(err.Error(), "Error adding column [%s] to table [%s]", column, table)
+	}
+	log.Info("Added column [%s] to table [%s]", column, table)
+}
+
+// placeholders returns n comma separated question marks for an IN clause
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
+
 func DatabaseErrorCheck(err error) {
 	if err != nil {
 		log.WarnError(err.Error(), "Error in db")
@@ -112,8 +158,14 @@ func Insert(structs any) error {
 		log.Query(insertChannelQuery, s.ChannelID, s.ServerID, s.Name)
 		_, err = Conn.Exec(insertChannelQuery, s.ChannelID, s.ServerID, s.Name)
 	case Message:
-		log.Query(insertChatMessageQuery, s.MessageID, s.ChannelID, s.UserID, s.Message, s.HasAttachments, 0, s.ReplyID)
-		_, err = Conn.Exec(insertChatMessageQuery, s.MessageID, s.ChannelID, s.UserID, s.Message, s.HasAttachments, 0, s.ReplyID)
+		log.Query(insertChatMessageQuery, s.MessageID, s.ChannelID, s.UserID, s.Message, s.HasAttachments, 0, s.ReplyID, s.ThreadID)
+		_, err = Conn.Exec(insertChatMessageQuery, s.MessageID, s.ChannelID, s.UserID, s.Message, s.HasAttachments, 0, s.ReplyID, s.ThreadID)
+	case Thread:
+		log.Query(insertThreadQuery, s.ThreadID, s.ChannelID, s.UserID, s.ReplyCount, s.LastReply)
+		_, err = Conn.Exec(insertThreadQuery, s.ThreadID, s.ChannelID, s.UserID, s.ReplyCount, s.LastReply)
+	case Reaction:
+		log.Query(insertReactionQuery, s.MessageID, s.UserID, s.Emoji, s.ReactedAt)
+		_, err = Conn.Exec(insertReactionQuery, s.MessageID, s.UserID, s.Emoji, s.ReactedAt)
 	case Attachment:
 		log.Query(insertAttachmentQuery, s.Hash, s.MessageID, s.Name)
 		_, err = Conn.Exec(insertAttachmentQuery, s.Hash, s.MessageID, s.Name)
@@ -205,9 +257,12 @@ func Delete(structo any) bool {
 	case Token:
 		log.Query(deleteTokenQuery, s.Token, s.UserID)
 		result, err = Conn.Exec(deleteTokenQuery, s.Token, s.UserID)
-	case DeleteMessage:
-		log.Query(deleteChatMessageQuery, s.MessageID, s.UserID)
-		result, err = Conn.Exec(deleteChatMessageQuery, s.MessageID, s.UserID)
+	case Reaction:
+		log.Query(deleteReactionQuery, s.MessageID, s.UserID, s.Emoji)
+		result, err = Conn.Exec(deleteReactionQuery, s.MessageID, s.UserID, s.Emoji)
+	case Pin:
+		log.Query(deletePinQuery, s.MessageID, s.ChannelID)
+		result, err = Conn.Exec(deletePinQuery, s.MessageID, s.ChannelID)
 	case ServerMemberShort:
 		log.Query(deleteServerMemberQuery, s.ServerID, s.UserID)
 		result, err = Conn.Exec(deleteServerMemberQuery, s.ServerID, s.UserID)
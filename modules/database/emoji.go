@@ -0,0 +1,184 @@
+package database
+
+import (
+	log "chat-app/modules/logging"
+)
+
+type ServerEmoji struct {
+	EmojiID   uint64
+	ServerID  uint64
+	Shortcode string // written as :shortcode: in messages
+	FileName  string // under ./public/content/emoji
+	AddedBy   uint64
+}
+
+const MaxEmojiPerServer = 50
+
+func CreateServerEmojiTable() {
+	_, err := Conn.Exec(`CREATE TABLE IF NOT EXISTS server_emoji (
+		emoji_id BIGINT UNSIGNED PRIMARY KEY,
+		server_id BIGINT UNSIGNED NOT NULL,
+		shortcode VARCHAR(32) NOT NULL,
+		file_name TEXT NOT NULL,
+		added_by BIGINT UNSIGNED NOT NULL,
+		UNIQUE (server_id, shortcode),
+		FOREIGN KEY (server_id) REFERENCES servers(server_id) ON DELETE CASCADE
+	)`)
+	if err != nil {
+		log.FatalError(err.Error(), "Error creating server_emoji table")
+	}
+}
+
+func CountServerEmoji(serverID uint64) int {
+	const query = "SELECT COUNT(*) FROM server_emoji WHERE server_id = ?"
+	log.Query(query, serverID)
+
+	var count int
+	err := Conn.QueryRow(query, serverID).Scan(&count)
+	DatabaseErrorCheck(err)
+
+	return count
+}
+
+type AddEmojiResult int
+
+const (
+	EmojiAdded          AddEmojiResult = iota
+	EmojiLimitReached                  // server already has MaxEmojiPerServer emoji
+	EmojiShortcodeTaken                // server already has an emoji with the same shortcode
+	EmojiFailed
+)
+
+// AddServerEmoji counts the emoji of the server in the same transaction as the insert,
+// so uploads at the same time can't go over MaxEmojiPerServer
+func AddServerEmoji(emoji ServerEmoji) AddEmojiResult {
+	tx, err := Conn.Begin()
+	DatabaseErrorCheck(err)
+	if err != nil {
+		return EmojiFailed
+	}
+
+	defer tx.Rollback()
+
+	// sqlite runs one transaction at a time, mysql locks the server until the emoji is inserted
+	if !sqlite {
+		const query1 = "SELECT server_id FROM servers WHERE server_id = ? FOR UPDATE"
+		log.Query(query1, emoji.ServerID)
+
+		var serverID uint64
+		err := tx.QueryRow(query1, emoji.ServerID).Scan(&serverID)
+		DatabaseErrorCheck(err)
+		if err != nil {
+			return EmojiFailed
+		}
+	}
+
+	const query2 = "SELECT COUNT(*) FROM server_emoji WHERE server_id = ?"
+	log.Query(query2, emoji.ServerID)
+
+	var count int
+	err = tx.QueryRow(query2, emoji.ServerID).Scan(&count)
+	DatabaseErrorCheck(err)
+	if err != nil {
+		return EmojiFailed
+	}
+	if count >= MaxEmojiPerServer {
+		return EmojiLimitReached
+	}
+
+	const query3 = "INSERT INTO server_emoji (emoji_id, server_id, shortcode, file_name, added_by) VALUES (?, ?, ?, ?, ?)"
+	log.Query(query3, emoji.EmojiID, emoji.ServerID, emoji.Shortcode, emoji.FileName, emoji.AddedBy)
+
+	_, err = tx.Exec(query3, emoji.EmojiID, emoji.ServerID, emoji.Shortcode, emoji.FileName, emoji.AddedBy)
+	DatabaseErrorCheck(err)
+	if err != nil {
+		return EmojiShortcodeTaken
+	}
+
+	err = tx.Commit()
+	DatabaseErrorCheck(err)
+	if err != nil {
+		return EmojiFailed
+	}
+
+	return EmojiAdded
+}
+
+func GetServerEmoji(serverID uint64) []ServerEmoji {
+	const query = "SELECT emoji_id, server_id, shortcode, file_name, added_by FROM server_emoji WHERE server_id = ? ORDER BY shortcode"
+	log.Query(query, serverID)
+
+	var emoji = []ServerEmoji{}
+
+	rows, err := Conn.Query(query, serverID)
+	DatabaseErrorCheck(err)
+	if err != nil {
+		return emoji
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var e ServerEmoji
+		err := rows.Scan(&e.EmojiID, &e.ServerID, &e.Shortcode, &e.FileName, &e.AddedBy)
+		DatabaseErrorCheck(err)
+		emoji = append(emoji, e)
+	}
+	DatabaseErrorCheck(rows.Err())
+
+	return emoji
+}
+
+func GetEmoji(emojiID uint64, serverID uint64) (ServerEmoji, bool) {
+	const query = "SELECT emoji_id, server_id, shortcode, file_name, added_by FROM server_emoji WHERE emoji_id = ? AND server_id = ?"
+	log.Query(query, emojiID, serverID)
+
+	var e ServerEmoji
+	err := Conn.QueryRow(query, emojiID, serverID).Scan(&e.EmojiID, &e.ServerID, &e.Shortcode, &e.FileName, &e.AddedBy)
+	DatabaseErrorCheck(err)
+
+	return e, err == nil
+}
+
+// RenameServerEmoji returns false if the emoji doesn't exist or the shortcode is already used in the server
+func RenameServerEmoji(emojiID uint64, serverID uint64, shortcode string) bool {
+	const query = "UPDATE server_emoji SET shortcode = ? WHERE emoji_id = ? AND server_id = ?"
+	log.Query(query, shortcode, emojiID, serverID)
+
+	result, err := Conn.Exec(query, shortcode, emojiID, serverID)
+	DatabaseErrorCheck(err)
+	if err != nil {
+		return false
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	DatabaseErrorCheck(err)
+	return rowsAffected == 1
+}
+
+func DeleteServerEmoji(emojiID uint64, serverID uint64) bool {
+	const query = "DELETE FROM server_emoji WHERE emoji_id = ? AND server_id = ?"
+	log.Query(query, emojiID, serverID)
+
+	result, err := Conn.Exec(query, emojiID, serverID)
+	DatabaseErrorCheck(err)
+	if err != nil {
+		return false
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	DatabaseErrorCheck(err)
+	return rowsAffected == 1
+}
+
+// IsEmojiFileUsed checks if any server still has an emoji with the file, the same picture can be uploaded to many servers
+func IsEmojiFileUsed(fileName string) bool {
+	const query = "SELECT EXISTS (SELECT 1 FROM server_emoji WHERE file_name = ?)"
+	log.Query(query, fileName)
+
+	var used bool
+	err := Conn.QueryRow(query, fileName).Scan(&used)
+	DatabaseErrorCheck(err)
+
+	// if it couldn't be checked the file is kept
+	return used || err != nil
+}
@@ -0,0 +1,88 @@
+package database
+
+import (
+	log "chat-app/modules/logging"
+	"database/sql"
+)
+
+// HistoryDirection is which messages of a channel or thread are requested relative to a message ID
+type HistoryDirection byte
+
+const (
+	HistoryLatest HistoryDirection = iota // the newest messages
+	HistoryBefore                         // messages older than FromID
+	HistoryAfter                          // messages newer than FromID
+	HistoryAround                         // FromID itself with messages from both sides of it
+)
+
+type HistoryPage struct {
+	FromID    uint64
+	Direction HistoryDirection
+	Limit     int
+}
+
+// queryPage runs the query for a page of messages, query selects from messages m and ends with its WHERE conditions,
+// scan is called for every row, returns if there are messages older and newer than the ones on the page,
+// each is only known for the direction the page went in, pages going back start from messages client already has
+func queryPage(query string, args []any, page HistoryPage, scan func(rows *sql.Rows) error) (bool, bool) {
+	type part struct {
+		condition string
+		order     string
+		limit     int
+		older     bool // going towards older messages, otherwise newer
+	}
+
+	var parts []part
+	switch page.Direction {
+	case HistoryBefore:
+		parts = []part{{"m.message_id < ?", "DESC", page.Limit, true}}
+	case HistoryAfter:
+		parts = []part{{"m.message_id > ?", "ASC", page.Limit, false}}
+	case HistoryAround:
+		parts = []part{
+			{"m.message_id < ?", "DESC", page.Limit / 2, true},
+			{"m.message_id >= ?", "ASC", page.Limit - page.Limit/2, false},
+		}
+	default:
+		parts = []part{{"", "DESC", page.Limit, true}}
+	}
+
+	var moreOlder, moreNewer bool
+	for i := 0; i < len(parts); i++ {
+		var partQuery = query
+		var partArgs = append([]any{}, args...)
+		if parts[i].condition != "" {
+			partQuery += " AND " + parts[i].condition
+			partArgs = append(partArgs, page.FromID)
+		}
+		partQuery += " ORDER BY m.message_id " + parts[i].order + " LIMIT ?"
+
+		// one more is requested to know if there are any left
+		partArgs = append(partArgs, parts[i].limit+1)
+		log.Query(partQuery, partArgs...)
+
+		rows, err := Conn.Query(partQuery, partArgs...)
+		DatabaseErrorCheck(err)
+		if err != nil {
+			return false, false
+		}
+
+		var count int
+		for rows.Next() {
+			count++
+			if count > parts[i].limit {
+				if parts[i].older {
+					moreOlder = true
+				} else {
+					moreNewer = true
+				}
+				break
+			}
+			DatabaseErrorCheck(scan(rows))
+		}
+		DatabaseErrorCheck(rows.Err())
+		rows.Close()
+	}
+
+	return moreOlder, moreNewer
+}
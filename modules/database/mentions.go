@@ -0,0 +1,111 @@
+package database
+
+import (
+	log "chat-app/modules/logging"
+	"encoding/json"
+)
+
+// MentionedMessage is a message a user was mentioned in
+type MentionedMessage struct {
+	MessageID uint64
+	ChannelID uint64
+	ServerID  uint64
+	ThreadID  uint64
+	UserID    uint64 // author of the message
+	Message   string
+}
+
+const mentionInboxLimit = 50
+
+func CreateMentionsTable() {
+	_, err := Conn.Exec(`CREATE TABLE IF NOT EXISTS mentions (
+		message_id BIGINT UNSIGNED NOT NULL,
+		user_id BIGINT UNSIGNED NOT NULL,
+		channel_id BIGINT UNSIGNED NOT NULL,
+		acknowledged BOOLEAN NOT NULL DEFAULT FALSE,
+		PRIMARY KEY (message_id, user_id),
+		FOREIGN KEY (message_id) REFERENCES messages(message_id) ON DELETE CASCADE,
+		FOREIGN KEY (user_id) REFERENCES users(user_id) ON DELETE CASCADE
+	)`)
+	if err != nil {
+		log.FatalError(err.Error(), "Error creating mentions table")
+	}
+}
+
+// AddMentions saves that the users were mentioned in the message
+func AddMentions(messageID uint64, channelID uint64, userIDs []uint64) bool {
+	tx, err := Conn.Begin()
+	transactionErrorCheck(err)
+
+	defer tx.Rollback()
+
+	const query = "INSERT INTO mentions (message_id, user_id, channel_id) VALUES (?, ?, ?)"
+	statement, err := tx.Prepare(query)
+	DatabaseErrorCheck(err)
+	if err != nil {
+		return false
+	}
+	defer statement.Close()
+
+	for i := 0; i < len(userIDs); i++ {
+		log.Query(query, messageID, userIDs[i], channelID)
+		_, err = statement.Exec(messageID, userIDs[i], channelID)
+		DatabaseErrorCheck(err)
+		if err != nil {
+			return false
+		}
+	}
+
+	err = tx.Commit()
+	transactionErrorCheck(err)
+
+	log.Trace("Saved [%d] mentions of message ID [%d]", len(userIDs), messageID)
+	return true
+}
+
+// GetMentionInbox returns the newest mentions of the user that weren't acknowledged,
+// mentions from servers the user left are left out
+func GetMentionInbox(userID uint64) []byte {
+	const query = "SELECT m.message_id, m.channel_id, c.server_id, m.thread_id, m.user_id, m.message FROM mentions mn JOIN messages m ON m.message_id = mn.message_id JOIN channels c ON c.channel_id = m.channel_id JOIN server_members sm ON sm.server_id = c.server_id AND sm.user_id = mn.user_id WHERE mn.user_id = ? AND mn.acknowledged = FALSE AND m.deleted_at = 0 ORDER BY mn.message_id DESC LIMIT ?"
+	log.Query(query, userID, mentionInboxLimit)
+
+	rows, err := Conn.Query(query, userID, mentionInboxLimit)
+	DatabaseErrorCheck(err)
+	if err != nil {
+		return nil
+	}
+	defer rows.Close()
+
+	var mentions = []MentionedMessage{}
+	for rows.Next() {
+		var mention MentionedMessage
+		err := rows.Scan(&mention.MessageID, &mention.ChannelID, &mention.ServerID, &mention.ThreadID, &mention.UserID, &mention.Message)
+		DatabaseErrorCheck(err)
+
+		mentions = append(mentions, mention)
+	}
+	DatabaseErrorCheck(rows.Err())
+
+	jsonResult, err := json.Marshal(mentions)
+	if err != nil {
+		log.FatalError(err.Error(), "Error serializing mention inbox of user ID [%d]", userID)
+	}
+
+	log.Trace("Retrieved [%d] unacknowledged mentions of user ID [%d]", len(mentions), userID)
+	return jsonResult
+}
+
+func AcknowledgeMention(messageID uint64, userID uint64) bool {
+	const query = "UPDATE mentions SET acknowledged = TRUE WHERE message_id = ? AND user_id = ? AND acknowledged = FALSE"
+	log.Query(query, messageID, userID)
+
+	result, err := Conn.Exec(query, messageID, userID)
+	DatabaseErrorCheck(err)
+	if err != nil {
+		return false
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	DatabaseErrorCheck(err)
+	return rowsAffected == 1
+}
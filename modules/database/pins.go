@@ -0,0 +1,170 @@
+package database
+
+import (
+	log "chat-app/modules/logging"
+	"encoding/json"
+)
+
+type Pin struct {
+	MessageID uint64
+	ChannelID uint64
+	PinnedBy  uint64
+	PinnedAt  int64 // unix milliseconds
+}
+
+type PinnedMessage struct {
+	MessageID   uint64
+	UserID      uint64
+	Message     string
+	Edited      bool
+	Attachments []AttachmentResponse
+	ReplyID     uint64
+	ThreadID    uint64
+	PinnedBy    uint64
+	PinnedAt    int64
+}
+
+type PinnedList struct {
+	ChannelID uint64
+	Msgs      []PinnedMessage
+}
+
+const MaxPinsPerChannel = 50
+
+const insertPinQuery = "INSERT INTO pins (message_id, channel_id, pinned_by, pinned_at) VALUES (?, ?, ?, ?)"
+const deletePinQuery = "DELETE FROM pins WHERE message_id = ? AND channel_id = ?"
+
+func CreatePinsTable() {
+	_, err := Conn.Exec(`CREATE TABLE IF NOT EXISTS pins (
+		message_id BIGINT UNSIGNED PRIMARY KEY,
+		channel_id BIGINT UNSIGNED NOT NULL,
+		pinned_by BIGINT UNSIGNED NOT NULL,
+		pinned_at BIGINT NOT NULL,
+		FOREIGN KEY (message_id) REFERENCES messages(message_id) ON DELETE CASCADE,
+		FOREIGN KEY (channel_id) REFERENCES channels(channel_id) ON DELETE CASCADE
+	)`)
+	if err != nil {
+		log.FatalError(err.Error(), "Error creating pins table")
+	}
+}
+
+type AddPinResult int
+
+const (
+	PinAdded        AddPinResult = iota
+	PinLimitReached              // channel already has MaxPinsPerChannel pinned messages
+	PinAlreadyPinned
+	PinFailed
+)
+
+// AddPin counts the pins of the channel in the same transaction as the insert,
+// so pins at the same time can't go over MaxPinsPerChannel
+func AddPin(pin Pin) AddPinResult {
+	tx, err := Conn.Begin()
+	DatabaseErrorCheck(err)
+	if err != nil {
+		return PinFailed
+	}
+
+	defer tx.Rollback()
+
+	// sqlite runs one transaction at a time, mysql locks the channel until the pin is inserted
+	if !sqlite {
+		const query1 = "SELECT channel_id FROM channels WHERE channel_id = ? FOR UPDATE"
+		log.Query(query1, pin.ChannelID)
+
+		var channelID uint64
+		err := tx.QueryRow(query1, pin.ChannelID).Scan(&channelID)
+		DatabaseErrorCheck(err)
+		if err != nil {
+			return PinFailed
+		}
+	}
+
+	const query2 = "SELECT EXISTS (SELECT 1 FROM pins WHERE message_id = ?)"
+	log.Query(query2, pin.MessageID)
+
+	var pinned bool
+	err = tx.QueryRow(query2, pin.MessageID).Scan(&pinned)
+	DatabaseErrorCheck(err)
+	if err != nil {
+		return PinFailed
+	}
+	if pinned {
+		return PinAlreadyPinned
+	}
+
+	const query3 = "SELECT COUNT(*) FROM pins WHERE channel_id = ?"
+	log.Query(query3, pin.ChannelID)
+
+	var count int
+	err = tx.QueryRow(query3, pin.ChannelID).Scan(&count)
+	DatabaseErrorCheck(err)
+	if err != nil {
+		return PinFailed
+	}
+	if count >= MaxPinsPerChannel {
+		return PinLimitReached
+	}
+
+	log.Query(insertPinQuery, pin.MessageID, pin.ChannelID, pin.PinnedBy, pin.PinnedAt)
+	_, err = tx.Exec(insertPinQuery, pin.MessageID, pin.ChannelID, pin.PinnedBy, pin.PinnedAt)
+	DatabaseErrorCheck(err)
+	if err != nil {
+		return PinFailed
+	}
+
+	err = tx.Commit()
+	DatabaseErrorCheck(err)
+	if err != nil {
+		return PinFailed
+	}
+
+	return PinAdded
+}
+
+// GetPinnedMessages returns the pinned messages of the channel, most recently pinned first
+func GetPinnedMessages(channelID uint64) []byte {
+	const query = "SELECT m.message_id, m.user_id, m.message, m.has_attachments, m.edited, m.reply_id, m.thread_id, p.pinned_by, p.pinned_at FROM pins p JOIN messages m ON m.message_id = p.message_id WHERE p.channel_id = ? ORDER BY p.pinned_at DESC"
+	log.Query(query, channelID)
+
+	rows, err := Conn.Query(query, channelID)
+	DatabaseErrorCheck(err)
+	if err != nil {
+		return nil
+	}
+	defer rows.Close()
+
+	var list = PinnedList{ChannelID: channelID, Msgs: []PinnedMessage{}}
+	var hasAttachments []bool
+	for rows.Next() {
+		var msg PinnedMessage
+		var attachments bool
+		err := rows.Scan(&msg.MessageID, &msg.UserID, &msg.Message, &attachments, &msg.Edited, &msg.ReplyID, &msg.ThreadID, &msg.PinnedBy, &msg.PinnedAt)
+		DatabaseErrorCheck(err)
+
+		list.Msgs = append(list.Msgs, msg)
+		hasAttachments = append(hasAttachments, attachments)
+	}
+	DatabaseErrorCheck(rows.Err())
+	rows.Close()
+
+	var withAttachments []uint64
+	for i := 0; i < len(list.Msgs); i++ {
+		if hasAttachments[i] {
+			withAttachments = append(withAttachments, list.Msgs[i].MessageID)
+		}
+	}
+	attachments := GetAttachmentsOfMessages(withAttachments)
+	for i := 0; i < len(list.Msgs); i++ {
+		list.Msgs[i].Attachments = attachments[list.Msgs[i].MessageID]
+	}
+
+	jsonResult, err := json.Marshal(list)
+	if err != nil {
+		log.FatalError(err.Error(), "Error serializing pinned messages of channel ID [%d]", channelID)
+	}
+
+	log.Trace("Retrieved [%d] pinned messages of channel ID [%d]", len(list.Msgs), channelID)
+	return jsonResult
+}
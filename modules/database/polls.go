@@ -0,0 +1,285 @@
+package database
+
+import (
+	log "chat-app/modules/logging"
+)
+
+type Poll struct {
+	MessageID uint64
+	Options   []string
+	Multiple  bool  // users can vote for more than one option
+	Anonymous bool  // who voted for what isn't shown
+	ClosesAt  int64 // unix milliseconds, 0 if it stays open
+}
+
+// PollState is a poll with the votes it has so far
+type PollState struct {
+	MessageID uint64
+	Options   []string
+	Multiple  bool
+	Anonymous bool
+	ClosesAt  int64
+	Closed    bool
+	Counts    []uint32
+	Voters    [][]uint64 // who voted for each option, nil if the poll is anonymous
+	Voted     []int      // options the user requesting it voted for
+}
+
+func CreatePollsTable() {
+	_, err := Conn.Exec(`CREATE TABLE IF NOT EXISTS polls (
+		message_id BIGINT UNSIGNED PRIMARY KEY,
+		multiple BOOLEAN NOT NULL,
+		anonymous BOOLEAN NOT NULL,
+		closes_at BIGINT NOT NULL,
+		closed BOOLEAN NOT NULL default false,
+		FOREIGN KEY (message_id) REFERENCES messages(message_id) ON DELETE CASCADE
+	)`)
+	if err != nil {
+		log.FatalError(err.Error(), "Error creating polls table")
+	}
+
+	_, err = Conn.Exec(`CREATE TABLE IF NOT EXISTS poll_options (
+		message_id BIGINT UNSIGNED NOT NULL,
+		option_index INT NOT NULL,
+		text VARCHAR(100) NOT NULL,
+		PRIMARY KEY (message_id, option_index),
+		FOREIGN KEY (message_id) REFERENCES polls(message_id) ON DELETE CASCADE
+	)`)
+	if err != nil {
+		log.FatalError(err.Error(), "Error creating poll_options table")
+	}
+
+	_, err = Conn.Exec(`CREATE TABLE IF NOT EXISTS poll_votes (
+		message_id BIGINT UNSIGNED NOT NULL,
+		user_id BIGINT UNSIGNED NOT NULL,
+		option_index INT NOT NULL,
+		PRIMARY KEY (message_id, user_id, option_index),
+		FOREIGN KEY (message_id) REFERENCES polls(message_id) ON DELETE CASCADE,
+		FOREIGN KEY (user_id) REFERENCES users(user_id) ON DELETE CASCADE
+	)`)
+	if err != nil {
+		log.FatalError(err.Error(), "Error creating poll_votes table")
+	}
+}
+
+// AddPoll attaches the poll to its message, returns false if the message already has one
+func AddPoll(poll Poll) bool {
+	tx, err := Conn.Begin()
+	transactionErrorCheck(err)
+
+	defer tx.Rollback()
+
+	const query1 string = "INSERT INTO polls (message_id, multiple, anonymous, closes_at) VALUES (?, ?, ?, ?)"
+	log.Query(query1, poll.MessageID, poll.Multiple, poll.Anonymous, poll.ClosesAt)
+
+	_, err = tx.Exec(query1, poll.MessageID, poll.Multiple, poll.Anonymous, poll.ClosesAt)
+	DatabaseErrorCheck(err)
+	if err != nil {
+		return false
+	}
+
+	const query2 string = "INSERT INTO poll_options (message_id, option_index, text) VALUES (?, ?, ?)"
+	for i := 0; i < len(poll.Options); i++ {
+		log.Query(query2, poll.MessageID, i, poll.Options[i])
+		_, err = tx.Exec(query2, poll.MessageID, i, poll.Options[i])
+		DatabaseErrorCheck(err)
+		if err != nil {
+			return false
+		}
+	}
+
+	err = tx.Commit()
+	transactionErrorCheck(err)
+
+	return true
+}
+
+// VotePoll replaces the votes of the user with the given options, no options takes the vote back,
+// returns false if the poll doesn't exist or is closed
+func VotePoll(messageID uint64, userID uint64, options []int, now int64) bool {
+	tx, err := Conn.Begin()
+	transactionErrorCheck(err)
+
+	defer tx.Rollback()
+
+	// results are locked once the poll is closed
+	const query1 string = "SELECT EXISTS (SELECT 1 FROM polls WHERE message_id = ? AND closed = FALSE AND (closes_at = 0 OR closes_at > ?))"
+	log.Query(query1, messageID, now)
+
+	var open bool
+	err = tx.QueryRow(query1, messageID, now).Scan(&open)
+	DatabaseErrorCheck(err)
+	if !open {
+		return false
+	}
+
+	const query2 string = "DELETE FROM poll_votes WHERE message_id = ? AND user_id = ?"
+	log.Query(query2, messageID, userID)
+
+	_, err = tx.Exec(query2, messageID, userID)
+	DatabaseErrorCheck(err)
+	if err != nil {
+		return false
+	}
+
+	const query3 string = "INSERT INTO poll_votes (message_id, user_id, option_index) VALUES (?, ?, ?)"
+	for i := 0; i < len(options); i++ {
+		log.Query(query3, messageID, userID, options[i])
+		_, err = tx.Exec(query3, messageID, userID, options[i])
+		DatabaseErrorCheck(err)
+		if err != nil {
+			return false
+		}
+	}
+
+	err = tx.Commit()
+	transactionErrorCheck(err)
+
+	return true
+}
+
+func GetPoll(messageID uint64, userID uint64) (PollState, bool) {
+	polls := GetPollsOfMessages([]uint64{messageID}, userID)
+	poll, exists := polls[messageID]
+	if !exists {
+		return PollState{}, false
+	}
+	return *poll, true
+}
+
+// GetPollsOfMessages returns the polls of the given messages with their votes, messages without a poll are left out,
+// Voted is filled for the given user
+func GetPollsOfMessages(messageIDs []uint64, userID uint64) map[uint64]*PollState {
+	var polls = make(map[uint64]*PollState)
+	if len(messageIDs) == 0 {
+		return polls
+	}
+
+	var inClause = "(" + placeholders(len(messageIDs)) + ")"
+	var args = make([]any, len(messageIDs))
+	for i := 0; i < len(messageIDs); i++ {
+		args[i] = messageIDs[i]
+	}
+
+	var query1 = "SELECT message_id, multiple, anonymous, closes_at, closed FROM polls WHERE message_id IN " + inClause
+	log.Query(query1, args...)
+
+	rows, err := Conn.Query(query1, args...)
+	DatabaseErrorCheck(err)
+	if err != nil {
+		return polls
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var poll PollState
+		err := rows.Scan(&poll.MessageID, &poll.Multiple, &poll.Anonymous, &poll.ClosesAt, &poll.Closed)
+		DatabaseErrorCheck(err)
+
+		poll.Voted = []int{}
+		polls[poll.MessageID] = &poll
+	}
+	DatabaseErrorCheck(rows.Err())
+	rows.Close()
+
+	if len(polls) == 0 {
+		return polls
+	}
+
+	var query2 = "SELECT message_id, text FROM poll_options WHERE message_id IN " + inClause + " ORDER BY message_id, option_index"
+	log.Query(query2, args...)
+
+	rows, err = Conn.Query(query2, args...)
+	DatabaseErrorCheck(err)
+	if err != nil {
+		return polls
+	}
+
+	for rows.Next() {
+		var messageID uint64
+		var text string
+		DatabaseErrorCheck(rows.Scan(&messageID, &text))
+
+		poll := polls[messageID]
+		poll.Options = append(poll.Options, text)
+		poll.Counts = append(poll.Counts, 0)
+		if !poll.Anonymous {
+			poll.Voters = append(poll.Voters, []uint64{})
+		}
+	}
+	DatabaseErrorCheck(rows.Err())
+	rows.Close()
+
+	var query3 = "SELECT message_id, user_id, option_index FROM poll_votes WHERE message_id IN " + inClause + " ORDER BY message_id, option_index"
+	log.Query(query3, args...)
+
+	rows, err = Conn.Query(query3, args...)
+	DatabaseErrorCheck(err)
+	if err != nil {
+		return polls
+	}
+
+	for rows.Next() {
+		var messageID, voterID uint64
+		var option int
+		DatabaseErrorCheck(rows.Scan(&messageID, &voterID, &option))
+
+		poll := polls[messageID]
+		if option < 0 || option >= len(poll.Counts) {
+			continue
+		}
+		poll.Counts[option]++
+		if !poll.Anonymous {
+			poll.Voters[option] = append(poll.Voters[option], voterID)
+		}
+		if voterID == userID {
+			poll.Voted = append(poll.Voted, option)
+		}
+	}
+	DatabaseErrorCheck(rows.Err())
+
+	return polls
+}
+
+// CloseExpiredPolls closes the polls whose close time has come,
+// returns the ones this call closed so their final results are sent only once
+func CloseExpiredPolls(now int64) []uint64 {
+	const query1 string = "SELECT message_id FROM polls WHERE closed = FALSE AND closes_at != 0 AND closes_at <= ?"
+	log.Query(query1, now)
+
+	rows, err := Conn.Query(query1, now)
+	DatabaseErrorCheck(err)
+	if err != nil {
+		return nil
+	}
+	defer rows.Close()
+
+	var expired []uint64
+	for rows.Next() {
+		var messageID uint64
+		DatabaseErrorCheck(rows.Scan(&messageID))
+		expired = append(expired, messageID)
+	}
+	DatabaseErrorCheck(rows.Err())
+	rows.Close()
+
+	// another server instance may close the same polls at the same time
+	const query2 string = "UPDATE polls SET closed = TRUE WHERE message_id = ? AND closed = FALSE"
+	var closed []uint64
+	for i := 0; i < len(expired); i++ {
+		log.Query(query2, expired[i])
+		result, err := Conn.Exec(query2, expired[i])
+		DatabaseErrorCheck(err)
+		if err != nil {
+			continue
+		}
+
+		rowsAffected, err := result.RowsAffected()
+		DatabaseErrorCheck(err)
+		if rowsAffected == 1 {
+			closed = append(closed, expired[i])
+		}
+	}
+
+	return closed
+}
@@ -0,0 +1,75 @@
+package database
+
+import (
+	log "chat-app/modules/logging"
+)
+
+type Reaction struct {
+	MessageID uint64
+	UserID    uint64
+	Emoji     string
+	ReactedAt int64 // unix milliseconds, reactions are listed in the order they were first added
+}
+
+// ReactionCount is how many users reacted to a message with the emoji,
+// Me is true if the user requesting it is one of them
+type ReactionCount struct {
+	Emoji string
+	Count uint32
+	Me    bool
+}
+
+const insertReactionQuery = "INSERT INTO reactions (message_id, user_id, emoji, reacted_at) VALUES (?, ?, ?, ?)"
+const deleteReactionQuery = "DELETE FROM reactions WHERE message_id = ? AND user_id = ? AND emoji = ?"
+
+func CreateReactionsTable() {
+	_, err := Conn.Exec(`CREATE TABLE IF NOT EXISTS reactions (
+		message_id BIGINT UNSIGNED NOT NULL,
+		user_id BIGINT UNSIGNED NOT NULL,
+		emoji VARCHAR(64) NOT NULL,
+		reacted_at BIGINT NOT NULL,
+		PRIMARY KEY (message_id, user_id, emoji),
+		FOREIGN KEY (message_id) REFERENCES messages(message_id) ON DELETE CASCADE,
+		FOREIGN KEY (user_id) REFERENCES users(user_id) ON DELETE CASCADE
+	)`)
+	if err != nil {
+		log.FatalError(err.Error(), "Error creating reactions table")
+	}
+}
+
+// GetReactionsOfMessages returns the reactions of every given message in a single query,
+// messages without reactions are left out of the map
+func GetReactionsOfMessages(messageIDs []uint64, userID uint64) map[uint64][]ReactionCount {
+	var reactions = make(map[uint64][]ReactionCount)
+	if len(messageIDs) == 0 {
+		return reactions
+	}
+
+	var query = "SELECT message_id, emoji, COUNT(*), MAX(user_id = ?) FROM reactions WHERE message_id IN (" + placeholders(len(messageIDs)) + ") GROUP BY message_id, emoji ORDER BY MIN(reacted_at)"
+
+	var args = make([]any, 0, len(messageIDs)+1)
+	args = append(args, userID)
+	for i := 0; i < len(messageIDs); i++ {
+		args = append(args, messageIDs[i])
+	}
+	log.Query(query, args...)
+
+	rows, err := Conn.Query(query, args...)
+	DatabaseErrorCheck(err)
+	if err != nil {
+		return reactions
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var messageID uint64
+		var reaction ReactionCount
+		err := rows.Scan(&messageID, &reaction.Emoji, &reaction.Count, &reaction.Me)
+		DatabaseErrorCheck(err)
+
+		reactions[messageID] = append(reactions[messageID], reaction)
+	}
+	DatabaseErrorCheck(rows.Err())
+
+	return reactions
+}
@@ -0,0 +1,142 @@
+package database
+
+import (
+	log "chat-app/modules/logging"
+	"database/sql"
+)
+
+// ChannelUnread is how many messages and mentions in the channel the user hasn't read yet
+type ChannelUnread struct {
+	ChannelID uint64
+	Unread    uint32
+	Mentions  uint32
+}
+
+// channels of the servers the user is in, and the user's dms
+const accessibleChannelsCondition = "(m.channel_id IN (SELECT c.channel_id FROM channels c JOIN server_members sm ON sm.server_id = c.server_id WHERE sm.user_id = ?) OR m.channel_id IN (SELECT dm_id FROM dm_chats WHERE user1_id = ? OR user2_id = ?))"
+
+func CreateReadStatesTable() {
+	// channel_id can be a dm, so it doesn't reference channels
+	_, err := Conn.Exec(`CREATE TABLE IF NOT EXISTS read_states (
+		user_id BIGINT UNSIGNED NOT NULL,
+		channel_id BIGINT UNSIGNED NOT NULL,
+		last_read BIGINT UNSIGNED NOT NULL,
+		PRIMARY KEY (user_id, channel_id),
+		FOREIGN KEY (user_id) REFERENCES users(user_id) ON DELETE CASCADE
+	)`)
+	if err != nil {
+		log.FatalError(err.Error(), "Error creating read_states table")
+	}
+}
+
+// CanAccessChannel returns true if the user is a member of the server of the channel,
+// or is in the dm
+func CanAccessChannel(userID uint64, channelID uint64) bool {
+	const query = "SELECT EXISTS (SELECT 1 FROM channels c JOIN server_members sm ON sm.server_id = c.server_id WHERE c.channel_id = ? AND sm.user_id = ?) OR EXISTS (SELECT 1 FROM dm_chats WHERE dm_id = ? AND (user1_id = ? OR user2_id = ?))"
+	log.Query(query, channelID, userID, channelID, userID, userID)
+
+	var canAccess bool
+	err := Conn.QueryRow(query, channelID, userID, channelID, userID, userID).Scan(&canAccess)
+	DatabaseErrorCheck(err)
+
+	return canAccess
+}
+
+// MarkChannelRead moves the read marker of the user forward to the message, never back,
+// mentions up to it are acknowledged too, returns where the marker is now
+func MarkChannelRead(userID uint64, channelID uint64, messageID uint64) (uint64, bool) {
+	tx, err := Conn.Begin()
+	transactionErrorCheck(err)
+
+	defer tx.Rollback()
+
+	var query1 string
+	if sqlite {
+		query1 = "INSERT INTO read_states (user_id, channel_id, last_read) VALUES (?, ?, ?) ON CONFLICT (user_id, channel_id) DO UPDATE SET last_read = excluded.last_read WHERE excluded.last_read > read_states.last_read"
+	} else {
+		query1 = "INSERT INTO read_states (user_id, channel_id, last_read) VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE last_read = GREATEST(last_read, VALUES(last_read))"
+	}
+	log.Query(query1, userID, channelID, messageID)
+
+	_, err = tx.Exec(query1, userID, channelID, messageID)
+	DatabaseErrorCheck(err)
+	if err != nil {
+		return 0, false
+	}
+
+	const query2 = "SELECT last_read FROM read_states WHERE user_id = ? AND channel_id = ?"
+	log.Query(query2, userID, channelID)
+
+	var lastRead uint64
+	err = tx.QueryRow(query2, userID, channelID).Scan(&lastRead)
+	DatabaseErrorCheck(err)
+	if err != nil {
+		return 0, false
+	}
+
+	const query3 = "UPDATE mentions SET acknowledged = TRUE WHERE user_id = ? AND channel_id = ? AND message_id <= ? AND acknowledged = FALSE"
+	log.Query(query3, userID, channelID, lastRead)
+
+	_, err = tx.Exec(query3, userID, channelID, lastRead)
+	DatabaseErrorCheck(err)
+	if err != nil {
+		return 0, false
+	}
+
+	err = tx.Commit()
+	transactionErrorCheck(err)
+
+	return lastRead, true
+}
+
+// getUnreadCounts returns the channels of the user that have unread messages or mentions,
+// thread replies and the user's own messages aren't counted
+func getUnreadCounts(tx *sql.Tx, userID uint64) []ChannelUnread {
+	var unreads = []ChannelUnread{}
+	var indexOfChannel = make(map[uint64]int)
+
+	const query1 = "SELECT m.channel_id, COUNT(*) FROM messages m LEFT JOIN read_states rs ON rs.user_id = ? AND rs.channel_id = m.channel_id WHERE " + accessibleChannelsCondition + " AND m.thread_id = 0 AND m.deleted_at = 0 AND m.user_id != ? AND m.message_id > COALESCE(rs.last_read, 0) GROUP BY m.channel_id"
+	log.Query(query1, userID, userID, userID, userID, userID)
+
+	rows1, err := tx.Query(query1, userID, userID, userID, userID, userID)
+	DatabaseErrorCheck(err)
+	if err != nil {
+		return unreads
+	}
+	for rows1.Next() {
+		var unread ChannelUnread
+		err := rows1.Scan(&unread.ChannelID, &unread.Unread)
+		DatabaseErrorCheck(err)
+
+		indexOfChannel[unread.ChannelID] = len(unreads)
+		unreads = append(unreads, unread)
+	}
+	DatabaseErrorCheck(rows1.Err())
+	rows1.Close()
+
+	const query2 = "SELECT m.channel_id, COUNT(*) FROM mentions mn JOIN messages m ON m.message_id = mn.message_id WHERE mn.user_id = ? AND mn.acknowledged = FALSE AND m.deleted_at = 0 AND " + accessibleChannelsCondition + " GROUP BY m.channel_id"
+	log.Query(query2, userID, userID, userID, userID)
+
+	rows2, err := tx.Query(query2, userID, userID, userID, userID)
+	DatabaseErrorCheck(err)
+	if err != nil {
+		return unreads
+	}
+	defer rows2.Close()
+	for rows2.Next() {
+		var channelID uint64
+		var mentions uint32
+		err := rows2.Scan(&channelID, &mentions)
+		DatabaseErrorCheck(err)
+
+		index, found := indexOfChannel[channelID]
+		if !found {
+			index = len(unreads)
+			unreads = append(unreads, ChannelUnread{ChannelID: channelID})
+		}
+		unreads[index].Mentions = mentions
+	}
+	DatabaseErrorCheck(rows2.Err())
+
+	return unreads
+}
@@ -0,0 +1,168 @@
+package database
+
+import (
+	log "chat-app/modules/logging"
+)
+
+type RetentionPolicy struct {
+	ChannelID uint64
+	Days      int
+}
+
+// PrunedMessages is what was removed from a channel in one batch
+type PrunedMessages struct {
+	Count     int
+	ThreadIDs []uint64             // threads that lost replies
+	Orphaned  []AttachmentResponse // attachments no other message uses, their files can be removed
+}
+
+func SetChannelRetention(channelID uint64, days int) bool {
+	const query string = "UPDATE channels SET retention_days = ? WHERE channel_id = ?"
+	log.Query(query, days, channelID)
+
+	result, err := Conn.Exec(query, days, channelID)
+	DatabaseErrorCheck(err)
+	if err != nil {
+		return false
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	DatabaseErrorCheck(err)
+	return rowsAffected == 1
+}
+
+func SetServerRetention(userID uint64, serverID uint64, days int) bool {
+	const query string = "UPDATE servers SET retention_days = ? WHERE user_id = ? AND server_id = ?"
+	log.Query(query, days, userID, serverID)
+
+	result, err := Conn.Exec(query, days, userID, serverID)
+	DatabaseErrorCheck(err)
+	if err != nil {
+		return false
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	DatabaseErrorCheck(err)
+	return rowsAffected == 1
+}
+
+// GetRetentionPolicies returns every channel that has a retention period,
+// its own if it has one, otherwise the one of its server
+func GetRetentionPolicies() []RetentionPolicy {
+	const query string = "SELECT c.channel_id, c.retention_days, s.retention_days FROM channels c JOIN servers s ON s.server_id = c.server_id WHERE c.retention_days > 0 OR s.retention_days > 0"
+	log.Query(query)
+
+	rows, err := Conn.Query(query)
+	DatabaseErrorCheck(err)
+	if err != nil {
+		return nil
+	}
+	defer rows.Close()
+
+	var policies []RetentionPolicy
+	for rows.Next() {
+		var policy RetentionPolicy
+		var serverDays int
+		err := rows.Scan(&policy.ChannelID, &policy.Days, &serverDays)
+		DatabaseErrorCheck(err)
+
+		if policy.Days == 0 {
+			policy.Days = serverDays
+		}
+		policies = append(policies, policy)
+	}
+	DatabaseErrorCheck(rows.Err())
+
+	return policies
+}
+
+// PruneChannelMessages deletes up to limit messages of the channel older than beforeID, oldest first,
+// everything belonging to them goes with them through foreign keys
+func PruneChannelMessages(channelID uint64, beforeID uint64, limit int) PrunedMessages {
+	var pruned PrunedMessages
+
+	tx, err := Conn.Begin()
+	transactionErrorCheck(err)
+
+	defer tx.Rollback()
+
+	// replies are always newer than the message their thread started from, so a thread loses its
+	// replies only if it is pruned too, its replies that aren't expired yet are left without a thread
+	const query1 string = "SELECT message_id, thread_id FROM messages WHERE channel_id = ? AND message_id < ? ORDER BY message_id ASC LIMIT ?"
+	log.Query(query1, channelID, beforeID, limit)
+
+	rows, err := tx.Query(query1, channelID, beforeID, limit)
+	DatabaseErrorCheck(err)
+	if err != nil {
+		return pruned
+	}
+
+	var args []any
+	var threads = make(map[uint64]bool)
+	for rows.Next() {
+		var messageID, threadID uint64
+		DatabaseErrorCheck(rows.Scan(&messageID, &threadID))
+
+		args = append(args, messageID)
+		if threadID != 0 && !threads[threadID] {
+			threads[threadID] = true
+			pruned.ThreadIDs = append(pruned.ThreadIDs, threadID)
+		}
+	}
+	DatabaseErrorCheck(rows.Err())
+	rows.Close()
+
+	if len(args) == 0 {
+		return pruned
+	}
+
+	var inClause = "(" + placeholders(len(args)) + ")"
+
+	const query2 string = "SELECT DISTINCT hash, name FROM attachments WHERE message_id IN "
+	log.Query(query2+inClause, args...)
+
+	rows, err = tx.Query(query2+inClause, args...)
+	DatabaseErrorCheck(err)
+	if err != nil {
+		return PrunedMessages{}
+	}
+
+	var attachments []AttachmentResponse
+	for rows.Next() {
+		var attachment AttachmentResponse
+		DatabaseErrorCheck(rows.Scan(&attachment.Hash, &attachment.Name))
+		attachments = append(attachments, attachment)
+	}
+	DatabaseErrorCheck(rows.Err())
+	rows.Close()
+
+	const query3 string = "DELETE FROM messages WHERE message_id IN "
+	log.Query(query3+inClause, args...)
+
+	result, err := tx.Exec(query3+inClause, args...)
+	DatabaseErrorCheck(err)
+	if err != nil {
+		return PrunedMessages{}
+	}
+	rowsAffected, err := result.RowsAffected()
+	DatabaseErrorCheck(err)
+	pruned.Count = int(rowsAffected)
+
+	// files are shared between messages that sent the same file
+	const query4 string = "SELECT EXISTS (SELECT 1 FROM attachments WHERE hash = ?) OR EXISTS (SELECT 1 FROM scheduled_attachments WHERE hash = ?)"
+	for i := 0; i < len(attachments); i++ {
+		log.Query(query4, attachments[i].Hash, attachments[i].Hash)
+
+		var used bool
+		err := tx.QueryRow(query4, attachments[i].Hash, attachments[i].Hash).Scan(&used)
+		DatabaseErrorCheck(err)
+		if err == nil && !used {
+			pruned.Orphaned = append(pruned.Orphaned, attachments[i])
+		}
+	}
+
+	err = tx.Commit()
+	transactionErrorCheck(err)
+
+	return pruned
+}
@@ -0,0 +1,66 @@
+package database
+
+import (
+	log "chat-app/modules/logging"
+	"encoding/json"
+)
+
+// Revision is the content a message had before it was edited
+type Revision struct {
+	Message  string
+	EditedAt int64 // unix milliseconds, when this content was replaced or deleted
+}
+
+type MessageRevisions struct {
+	MessageID uint64
+	Revs      []Revision // oldest first
+}
+
+func CreateMessageRevisionsTable() {
+	_, err := Conn.Exec(`CREATE TABLE IF NOT EXISTS message_revisions (
+		revision_id BIGINT UNSIGNED PRIMARY KEY,
+		message_id BIGINT UNSIGNED NOT NULL,
+		message TEXT NOT NULL,
+		edited_at BIGINT NOT NULL,
+		FOREIGN KEY (message_id) REFERENCES messages(message_id) ON DELETE CASCADE
+	)`)
+	if err != nil {
+		log.FatalError(err.Error(), "Error creating message_revisions table")
+	}
+}
+
+// GetMessageRevisions returns earlier contents of the message,
+// content of a deleted message is given as its last revision
+func GetMessageRevisions(messageID uint64, deletedContent *Revision) []byte {
+	const query = "SELECT message, edited_at FROM message_revisions WHERE message_id = ? ORDER BY revision_id"
+	log.Query(query, messageID)
+
+	rows, err := Conn.Query(query, messageID)
+	DatabaseErrorCheck(err)
+	if err != nil {
+		return nil
+	}
+	defer rows.Close()
+
+	var revisions = MessageRevisions{MessageID: messageID, Revs: []Revision{}}
+	for rows.Next() {
+		var revision Revision
+		err := rows.Scan(&revision.Message, &revision.EditedAt)
+		DatabaseErrorCheck(err)
+
+		revisions.Revs = append(revisions.Revs, revision)
+	}
+	DatabaseErrorCheck(rows.Err())
+
+	if deletedContent != nil {
+		revisions.Revs = append(revisions.Revs, *deletedContent)
+	}
+
+	jsonResult, err := json.Marshal(revisions)
+	if err != nil {
+		log.FatalError(err.Error(), "Error serializing revisions of message ID [%d]", messageID)
+	}
+
+	log.Trace("Retrieved [%d] revisions of message ID [%d]", len(revisions.Revs), messageID)
+	return jsonResult
+}
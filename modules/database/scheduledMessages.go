@@ -0,0 +1,273 @@
+package database
+
+import (
+	log "chat-app/modules/logging"
+	"encoding/json"
+)
+
+type ScheduledMessage struct {
+	ScheduledID uint64
+	ChannelID   uint64
+	UserID      uint64
+	Message     string
+	Attachments []AttachmentResponse
+	ReplyID     uint64
+	ThreadID    uint64
+	SendAt      int64 // unix milliseconds
+}
+
+const MaxScheduledMessagesPerUser = 100
+
+func CreateScheduledMessagesTable() {
+	_, err := Conn.Exec(`CREATE TABLE IF NOT EXISTS scheduled_messages (
+		scheduled_id BIGINT UNSIGNED PRIMARY KEY,
+		channel_id BIGINT UNSIGNED NOT NULL,
+		user_id BIGINT UNSIGNED NOT NULL,
+		message TEXT NOT NULL,
+		reply_id BIGINT UNSIGNED NOT NULL default 0,
+		thread_id BIGINT UNSIGNED NOT NULL default 0,
+		send_at BIGINT NOT NULL,
+		FOREIGN KEY (channel_id) REFERENCES channels(channel_id) ON DELETE CASCADE,
+		FOREIGN KEY (user_id) REFERENCES users(user_id) ON DELETE CASCADE
+	)`)
+	if err != nil {
+		log.FatalError(err.Error(), "Error creating scheduled_messages table")
+	}
+
+	// attachments are claimed when the message is scheduled, the attachment token would expire long before it's sent
+	_, err = Conn.Exec(`CREATE TABLE IF NOT EXISTS scheduled_attachments (
+		scheduled_id BIGINT UNSIGNED NOT NULL,
+		hash BINARY(32) NOT NULL,
+		name VARCHAR(255) NOT NULL,
+		FOREIGN KEY (scheduled_id) REFERENCES scheduled_messages(scheduled_id) ON DELETE CASCADE
+	)`)
+	if err != nil {
+		log.FatalError(err.Error(), "Error creating scheduled_attachments table")
+	}
+}
+
+func AddScheduledMessage(msg ScheduledMessage) bool {
+	tx, err := Conn.Begin()
+	transactionErrorCheck(err)
+
+	defer tx.Rollback()
+
+	const query1 string = "INSERT INTO scheduled_messages (scheduled_id, channel_id, user_id, message, reply_id, thread_id, send_at) VALUES (?, ?, ?, ?, ?, ?, ?)"
+	log.Query(query1, msg.ScheduledID, msg.ChannelID, msg.UserID, msg.Message, msg.ReplyID, msg.ThreadID, msg.SendAt)
+
+	_, err = tx.Exec(query1, msg.ScheduledID, msg.ChannelID, msg.UserID, msg.Message, msg.ReplyID, msg.ThreadID, msg.SendAt)
+	DatabaseErrorCheck(err)
+	if err != nil {
+		return false
+	}
+
+	const query2 string = "INSERT INTO scheduled_attachments (scheduled_id, hash, name) VALUES (?, ?, ?)"
+	for i := 0; i < len(msg.Attachments); i++ {
+		log.Query(query2, msg.ScheduledID, msg.Attachments[i].Hash, msg.Attachments[i].Name)
+		_, err = tx.Exec(query2, msg.ScheduledID, msg.Attachments[i].Hash, msg.Attachments[i].Name)
+		DatabaseErrorCheck(err)
+		if err != nil {
+			return false
+		}
+	}
+
+	err = tx.Commit()
+	transactionErrorCheck(err)
+
+	return true
+}
+
+func CountScheduledMessagesOfUser(userID uint64) int {
+	const query = "SELECT COUNT(*) FROM scheduled_messages WHERE user_id = ?"
+	log.Query(query, userID)
+
+	var count int
+	err := Conn.QueryRow(query, userID).Scan(&count)
+	DatabaseErrorCheck(err)
+
+	return count
+}
+
+// EditScheduledMessage changes the text and send time of a pending message of the user,
+// returns false if the user has no such message, or it was already sent
+func EditScheduledMessage(scheduledID uint64, userID uint64, message string, sendAt int64) bool {
+	const query = "UPDATE scheduled_messages SET message = ?, send_at = ? WHERE scheduled_id = ? AND user_id = ?"
+	log.Query(query, message, sendAt, scheduledID, userID)
+
+	result, err := Conn.Exec(query, message, sendAt, scheduledID, userID)
+	DatabaseErrorCheck(err)
+	if err != nil {
+		return false
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	DatabaseErrorCheck(err)
+	return rowsAffected == 1
+}
+
+// CancelScheduledMessage removes a pending message of the user,
+// returns false if the user has no such message, or it was already sent
+func CancelScheduledMessage(scheduledID uint64, userID uint64) bool {
+	const query = "DELETE FROM scheduled_messages WHERE scheduled_id = ? AND user_id = ?"
+	log.Query(query, scheduledID, userID)
+
+	result, err := Conn.Exec(query, scheduledID, userID)
+	DatabaseErrorCheck(err)
+	if err != nil {
+		return false
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	DatabaseErrorCheck(err)
+	return rowsAffected == 1
+}
+
+// GetScheduledMessages returns the pending messages of the user, the ones sent soonest first
+func GetScheduledMessages(userID uint64) []byte {
+	const query = "SELECT scheduled_id, channel_id, user_id, message, reply_id, thread_id, send_at FROM scheduled_messages WHERE user_id = ? ORDER BY send_at ASC"
+	log.Query(query, userID)
+
+	rows, err := Conn.Query(query, userID)
+	DatabaseErrorCheck(err)
+	if err != nil {
+		return nil
+	}
+	defer rows.Close()
+
+	var scheduled = []ScheduledMessage{}
+	var scheduledIDs []uint64
+	for rows.Next() {
+		var msg ScheduledMessage
+		err := rows.Scan(&msg.ScheduledID, &msg.ChannelID, &msg.UserID, &msg.Message, &msg.ReplyID, &msg.ThreadID, &msg.SendAt)
+		DatabaseErrorCheck(err)
+
+		scheduled = append(scheduled, msg)
+		scheduledIDs = append(scheduledIDs, msg.ScheduledID)
+	}
+	DatabaseErrorCheck(rows.Err())
+	rows.Close()
+
+	attachments := getScheduledAttachments(scheduledIDs)
+	for i := 0; i < len(scheduled); i++ {
+		scheduled[i].Attachments = attachments[scheduled[i].ScheduledID]
+	}
+
+	jsonResult, err := json.Marshal(scheduled)
+	if err != nil {
+		log.FatalError(err.Error(), "Error serializing scheduled messages of user ID [%d]", userID)
+	}
+
+	return jsonResult
+}
+
+func getScheduledAttachments(scheduledIDs []uint64) map[uint64][]AttachmentResponse {
+	var attachments = make(map[uint64][]AttachmentResponse)
+	if len(scheduledIDs) == 0 {
+		return attachments
+	}
+
+	var query = "SELECT scheduled_id, hash, name FROM scheduled_attachments WHERE scheduled_id IN (" + placeholders(len(scheduledIDs)) + ")"
+	var args = make([]any, len(scheduledIDs))
+	for i := 0; i < len(scheduledIDs); i++ {
+		args[i] = scheduledIDs[i]
+	}
+	log.Query(query, args...)
+
+	rows, err := Conn.Query(query, args...)
+	DatabaseErrorCheck(err)
+	if err != nil {
+		return attachments
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var scheduledID uint64
+		attachment := AttachmentResponse{}
+		err := rows.Scan(&scheduledID, &attachment.Hash, &attachment.Name)
+		DatabaseErrorCheck(err)
+
+		attachments[scheduledID] = append(attachments[scheduledID], attachment)
+	}
+	DatabaseErrorCheck(rows.Err())
+
+	return attachments
+}
+
+// GetDueScheduledMessageIDs returns the messages whose send time has come
+func GetDueScheduledMessageIDs(now int64) []uint64 {
+	const query = "SELECT scheduled_id FROM scheduled_messages WHERE send_at <= ? ORDER BY send_at ASC"
+	log.Query(query, now)
+
+	rows, err := Conn.Query(query, now)
+	DatabaseErrorCheck(err)
+	if err != nil {
+		return nil
+	}
+	defer rows.Close()
+
+	var scheduledIDs []uint64
+	for rows.Next() {
+		var scheduledID uint64
+		DatabaseErrorCheck(rows.Scan(&scheduledID))
+		scheduledIDs = append(scheduledIDs, scheduledID)
+	}
+	DatabaseErrorCheck(rows.Err())
+
+	return scheduledIDs
+}
+
+// ClaimScheduledMessage removes the message from the schedule and returns it to be sent,
+// false if it was edited away, cancelled or claimed by another server instance in the meantime
+func ClaimScheduledMessage(scheduledID uint64, now int64) (ScheduledMessage, bool) {
+	tx, err := Conn.Begin()
+	transactionErrorCheck(err)
+
+	defer tx.Rollback()
+
+	var msg ScheduledMessage
+
+	const query1 string = "SELECT scheduled_id, channel_id, user_id, message, reply_id, thread_id, send_at FROM scheduled_messages WHERE scheduled_id = ? AND send_at <= ?"
+	log.Query(query1, scheduledID, now)
+
+	err = tx.QueryRow(query1, scheduledID, now).Scan(&msg.ScheduledID, &msg.ChannelID, &msg.UserID, &msg.Message, &msg.ReplyID, &msg.ThreadID, &msg.SendAt)
+	DatabaseErrorCheck(err)
+	if err != nil {
+		return msg, false
+	}
+
+	const query2 string = "SELECT hash, name FROM scheduled_attachments WHERE scheduled_id = ?"
+	log.Query(query2, scheduledID)
+
+	rows, err := tx.Query(query2, scheduledID)
+	DatabaseErrorCheck(err)
+	if err != nil {
+		return msg, false
+	}
+	for rows.Next() {
+		attachment := AttachmentResponse{}
+		DatabaseErrorCheck(rows.Scan(&attachment.Hash, &attachment.Name))
+		msg.Attachments = append(msg.Attachments, attachment)
+	}
+	DatabaseErrorCheck(rows.Err())
+	rows.Close()
+
+	// the instance whose delete goes through is the one sending it
+	const query3 string = "DELETE FROM scheduled_messages WHERE scheduled_id = ?"
+	log.Query(query3, scheduledID)
+
+	result, err := tx.Exec(query3, scheduledID)
+	DatabaseErrorCheck(err)
+	if err != nil {
+		return msg, false
+	}
+	rowsAffected, err := result.RowsAffected()
+	DatabaseErrorCheck(err)
+	if rowsAffected != 1 {
+		return msg, false
+	}
+
+	err = tx.Commit()
+	transactionErrorCheck(err)
+
+	return msg, true
+}
@@ -0,0 +1,272 @@
+package database
+
+import (
+	log "chat-app/modules/logging"
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+// SearchFilter is what messages have to match, zero values are left out
+type SearchFilter struct {
+	Text           string
+	AuthorID       uint64
+	ChannelID      uint64
+	ServerID       uint64
+	HasAttachments bool
+	MinMessageID   uint64 // date range as snowflake IDs
+	MaxMessageID   uint64
+	BeforeID       uint64 // Next of the previous page
+}
+
+type FoundMessage struct {
+	MessageID   uint64
+	ChannelID   uint64
+	UserID      uint64
+	Message     string
+	Edited      bool
+	Attachments []AttachmentResponse
+	ReplyID     uint64
+	ThreadID    uint64
+}
+
+type SearchResults struct {
+	Msgs []FoundMessage
+	Next uint64 // message ID to continue from, 0 if there are no more results
+}
+
+const searchResultLimit = 25
+
+// messageSearch is the full-text search of the database backend
+type messageSearch interface {
+	createIndex() error
+	// matchClause returns the condition on messages m that matches messages containing the words of the text
+	matchClause() string
+	matchArg(text string) string
+}
+
+var search messageSearch
+
+// sqlite uses an FTS5 table that triggers keep in sync with the messages table,
+// go-sqlite3 only has FTS5 if it was built with the sqlite_fts5 tag
+type sqliteSearch struct{}
+
+// names of the triggers that keep the FTS5 table in sync
+var ftsTriggers = []string{"messages_fts_insert", "messages_fts_delete", "messages_fts_update"}
+
+var errNoFTS5 = errors.New("go-sqlite3 was built without FTS5")
+
+func (sqliteSearch) createIndex() error {
+	var fts5 bool
+	err := Conn.QueryRow("SELECT sqlite_compileoption_used('ENABLE_FTS5')").Scan(&fts5)
+	if err != nil {
+		return err
+	}
+	if !fts5 {
+		// triggers made by a build with FTS5 would make every insert and edit of a message fail,
+		// the index is brought up to date again by the next build with FTS5
+		for i := 0; i < len(ftsTriggers); i++ {
+			if _, err := Conn.Exec("DROP TRIGGER IF EXISTS " + ftsTriggers[i]); err != nil {
+				return err
+			}
+		}
+		return errNoFTS5
+	}
+
+	var exists bool
+	err = Conn.QueryRow("SELECT EXISTS (SELECT 1 FROM sqlite_master WHERE type = 'trigger' AND name = ?)", ftsTriggers[0]).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+
+	statements := []string{
+		"CREATE VIRTUAL TABLE IF NOT EXISTS messages_fts USING fts5(message, content = 'messages', content_rowid = 'message_id')",
+		`CREATE TRIGGER IF NOT EXISTS messages_fts_insert AFTER INSERT ON messages BEGIN
+			INSERT INTO messages_fts (rowid, message) VALUES (new.message_id, new.message);
+		END`,
+		`CREATE TRIGGER IF NOT EXISTS messages_fts_delete AFTER DELETE ON messages BEGIN
+			INSERT INTO messages_fts (messages_fts, rowid, message) VALUES ('delete', old.message_id, old.message);
+		END`,
+		`CREATE TRIGGER IF NOT EXISTS messages_fts_update AFTER UPDATE OF message ON messages BEGIN
+			INSERT INTO messages_fts (messages_fts, rowid, message) VALUES ('delete', old.message_id, old.message);
+			INSERT INTO messages_fts (rowid, message) VALUES (new.message_id, new.message);
+		END`,
+		// messages sent before the index existed or while the triggers were dropped
+		"INSERT INTO messages_fts (messages_fts) VALUES ('rebuild')",
+	}
+	for i := 0; i < len(statements); i++ {
+		if _, err := Conn.Exec(statements[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (sqliteSearch) matchClause() string {
+	return "m.message_id IN (SELECT rowid FROM messages_fts WHERE messages_fts MATCH ?)"
+}
+
+// every word is quoted so the text can't use the FTS5 query syntax
+func (sqliteSearch) matchArg(text string) string {
+	words := strings.Fields(text)
+	for i := 0; i < len(words); i++ {
+		words[i] = "\"" + strings.ReplaceAll(words[i], "\"", "\"\"") + "\""
+	}
+	return strings.Join(words, " ")
+}
+
+type mysqlSearch struct{}
+
+func (mysqlSearch) createIndex() error {
+	var exists bool
+	err := Conn.QueryRow("SELECT EXISTS (SELECT 1 FROM information_schema.statistics WHERE table_schema = DATABASE() AND table_name = 'messages' AND index_name = 'messages_fulltext')").Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+
+	_, err = Conn.Exec("ALTER TABLE messages ADD FULLTEXT INDEX messages_fulltext (message)")
+	return err
+}
+
+func (mysqlSearch) matchClause() string {
+	return "MATCH (m.message) AGAINST (? IN BOOLEAN MODE)"
+}
+
+// every word is required and quoted so the text can't use the boolean mode operators
+func (mysqlSearch) matchArg(text string) string {
+	words := strings.Fields(text)
+	for i := 0; i < len(words); i++ {
+		words[i] = "+\"" + strings.ReplaceAll(words[i], "\"", "") + "\""
+	}
+	return strings.Join(words, " ")
+}
+
+// likeSearch is used if the full-text index couldn't be made, slow on big tables
+type likeSearch struct{}
+
+func (likeSearch) createIndex() error {
+	return nil
+}
+
+func (likeSearch) matchClause() string {
+	return "m.message LIKE ? ESCAPE '\\'"
+}
+
+func (likeSearch) matchArg(text string) string {
+	escaped := strings.NewReplacer("\\", "\\\\", "%", "\\%", "_", "\\_").Replace(strings.TrimSpace(text))
+	return "%" + escaped + "%"
+}
+
+func CreateSearchIndex() {
+	if sqlite {
+		search = sqliteSearch{}
+	} else {
+		search = mysqlSearch{}
+	}
+
+	if err := search.createIndex(); err != nil {
+		if sqlite {
+			log.WarnError(err.Error(), "Error creating FTS5 search index, build with -tags sqlite_fts5 to enable it, searching without index")
+		} else {
+			log.WarnError(err.Error(), "Error creating FULLTEXT search index, searching without index")
+		}
+		search = likeSearch{}
+	}
+}
+
+// SearchMessages returns messages matching the filter from channels the user is a member of, newest first
+func SearchMessages(filter SearchFilter, userID uint64) []byte {
+	var query strings.Builder
+	query.WriteString("SELECT m.message_id, m.channel_id, m.user_id, m.message, m.has_attachments, m.edited, m.reply_id, m.thread_id FROM messages m WHERE m.deleted_at = 0 AND ")
+	query.WriteString("(m.channel_id IN (SELECT c.channel_id FROM channels c JOIN server_members sm ON sm.server_id = c.server_id WHERE sm.user_id = ?) OR m.channel_id IN (SELECT dm_id FROM dm_chats WHERE user1_id = ? OR user2_id = ?))")
+	var args = []any{userID, userID, userID}
+
+	if strings.TrimSpace(filter.Text) != "" {
+		query.WriteString(" AND " + search.matchClause())
+		args = append(args, search.matchArg(filter.Text))
+	}
+	if filter.AuthorID != 0 {
+		query.WriteString(" AND m.user_id = ?")
+		args = append(args, filter.AuthorID)
+	}
+	if filter.ChannelID != 0 {
+		query.WriteString(" AND m.channel_id = ?")
+		args = append(args, filter.ChannelID)
+	}
+	if filter.ServerID != 0 {
+		query.WriteString(" AND m.channel_id IN (SELECT channel_id FROM channels WHERE server_id = ?)")
+		args = append(args, filter.ServerID)
+	}
+	if filter.HasAttachments {
+		query.WriteString(" AND m.has_attachments = TRUE")
+	}
+	if filter.MinMessageID != 0 {
+		query.WriteString(" AND m.message_id >= ?")
+		args = append(args, filter.MinMessageID)
+	}
+	if filter.MaxMessageID != 0 {
+		query.WriteString(" AND m.message_id <= ?")
+		args = append(args, filter.MaxMessageID)
+	}
+	if filter.BeforeID != 0 {
+		query.WriteString(" AND m.message_id < ?")
+		args = append(args, filter.BeforeID)
+	}
+
+	// one more than the limit is requested to know if there are more results
+	query.WriteString(" ORDER BY m.message_id DESC LIMIT ?")
+	args = append(args, searchResultLimit+1)
+
+	log.Query(query.String(), args...)
+
+	rows, err := Conn.Query(query.String(), args...)
+	DatabaseErrorCheck(err)
+	if err != nil {
+		return nil
+	}
+	defer rows.Close()
+
+	var results = SearchResults{Msgs: []FoundMessage{}}
+	var hasAttachments []bool
+	for rows.Next() {
+		var msg FoundMessage
+		var attachments bool
+		err := rows.Scan(&msg.MessageID, &msg.ChannelID, &msg.UserID, &msg.Message, &attachments, &msg.Edited, &msg.ReplyID, &msg.ThreadID)
+		DatabaseErrorCheck(err)
+
+		results.Msgs = append(results.Msgs, msg)
+		hasAttachments = append(hasAttachments, attachments)
+	}
+	DatabaseErrorCheck(rows.Err())
+	rows.Close()
+
+	if len(results.Msgs) > searchResultLimit {
+		results.Msgs = results.Msgs[:searchResultLimit]
+		results.Next = results.Msgs[searchResultLimit-1].MessageID
+	}
+
+	var withAttachments []uint64
+	for i := 0; i < len(results.Msgs); i++ {
+		if hasAttachments[i] {
+			withAttachments = append(withAttachments, results.Msgs[i].MessageID)
+		}
+	}
+	attachments := GetAttachmentsOfMessages(withAttachments)
+	for i := 0; i < len(results.Msgs); i++ {
+		results.Msgs[i].Attachments = attachments[results.Msgs[i].MessageID]
+	}
+
+	jsonResult, err := json.Marshal(results)
+	if err != nil {
+		log.FatalError(err.Error(), "Error serializing search results of user ID [%d]", userID)
+	}
+
+	log.Trace("Found [%d] messages for user ID [%d]", len(results.Msgs), userID)
+	return jsonResult
+}
@@ -59,6 +59,30 @@ func GetServerMembersList(serverID uint64) []ServerMember {
 	log.Trace("Members of server ID [%d] were retrieved successfully", serverID)
 	return members
 }
+
+// GetServerMemberIDs returns only the user IDs of the members
+func GetServerMemberIDs(serverID uint64) []uint64 {
+	const query = "SELECT user_id FROM server_members WHERE server_id = ?"
+	log.Query(query, serverID)
+
+	rows, err := Conn.Query(query, serverID)
+	DatabaseErrorCheck(err)
+	if err != nil {
+		return nil
+	}
+	defer rows.Close()
+
+	var userIDs []uint64
+	for rows.Next() {
+		var userID uint64
+		DatabaseErrorCheck(rows.Scan(&userID))
+		userIDs = append(userIDs, userID)
+	}
+	DatabaseErrorCheck(rows.Err())
+
+	return userIDs
+}
+
 func ConfirmServerMembership(userID uint64, serverID uint64) bool {
 	const query string = "SELECT EXISTS (SELECT 1 FROM server_members WHERE server_id = ? AND user_id = ?)"
 	log.Query(query, serverID, userID)
@@ -6,19 +6,21 @@ import (
 )
 
 type Server struct {
-	ServerID uint64
-	UserID   uint64
-	Name     string
-	Picture  string
-	Banner   string
+	ServerID      uint64
+	UserID        uint64
+	Name          string
+	Picture       string
+	Banner        string
+	RetentionDays int // messages of channels without their own policy are deleted after this, 0 to keep them
 }
 
 type JoinedServer struct {
-	ServerID uint64
-	Owned    bool
-	Name     string
-	Picture  string
-	Banner   string
+	ServerID      uint64
+	Owned         bool
+	Name          string
+	Picture       string
+	Banner        string
+	RetentionDays int
 }
 
 type ServerDelete struct {
@@ -36,11 +38,14 @@ func CreateServersTable() {
 				name TEXT NOT NULL,
 				picture TEXT NOT NULL DEFAULT '',
 				banner TEXT NOT NULL DEFAULT '',
+				retention_days INT NOT NULL DEFAULT 0,
 				FOREIGN KEY (user_id) REFERENCES users(user_id) ON DELETE CASCADE
 			)`)
 	if err != nil {
 		log.FatalError(err.Error(), "Error creating servers table")
 	}
+
+	addColumnIfMissing("servers", "retention_days", "INT NOT NULL DEFAULT 0")
 }
 
 func GetServerOwner(serverID uint64) uint64 {
@@ -147,14 +152,14 @@ func ChangeServerName(userID uint64, serverID uint64, name string) bool {
 }
 
 func GetServerData(serverID uint64) Server {
-	const query = "SELECT user_id, name, picture, banner FROM servers WHERE server_id = ?"
+	const query = "SELECT user_id, name, picture, banner, retention_days FROM servers WHERE server_id = ?"
 	log.Query(query, serverID)
 
 	server := Server{
 		ServerID: serverID,
 	}
 
-	err := Conn.QueryRow(query, serverID).Scan(&server.UserID, &server.Name, &server.Picture, &server.Banner)
+	err := Conn.QueryRow(query, serverID).Scan(&server.UserID, &server.Name, &server.Picture, &server.Banner, &server.RetentionDays)
 	DatabaseErrorCheck(err)
 
 	return server
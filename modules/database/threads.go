@@ -0,0 +1,163 @@
+package database
+
+import (
+	log "chat-app/modules/logging"
+	"database/sql"
+	"encoding/json"
+	"sort"
+)
+
+// Thread is started from a message, its ID is the same as the message ID,
+// replies are messages that have the thread ID set
+type Thread struct {
+	ThreadID   uint64
+	ChannelID  uint64
+	UserID     uint64 // who started the thread
+	ReplyCount uint32
+	LastReply  int64 // unix milliseconds
+}
+
+type ThreadMessage struct {
+	MessageID   uint64
+	UserID      uint64
+	Message     string
+	Edited      bool
+	Attachments []AttachmentResponse
+	ReplyID     uint64
+	Reactions   []ReactionCount
+	DeletedBy   uint64 // 0 if reply wasn't deleted
+	Poll        *PollState
+
+	hasAttachments bool
+}
+
+type ThreadHistory struct {
+	ThreadID uint64
+	Msgs     []ThreadMessage
+	Next     uint64 // message ID to continue from towards older replies, 0 if there are none or the page went forward
+}
+
+const insertThreadQuery = "INSERT INTO threads (thread_id, channel_id, user_id, reply_count, last_reply) VALUES (?, ?, ?, ?, ?)"
+
+func CreateThreadsTable() {
+	_, err := Conn.Exec(`CREATE TABLE IF NOT EXISTS threads (
+		thread_id BIGINT UNSIGNED PRIMARY KEY,
+		channel_id BIGINT UNSIGNED NOT NULL,
+		user_id BIGINT UNSIGNED NOT NULL,
+		reply_count INT UNSIGNED NOT NULL DEFAULT 0,
+		last_reply BIGINT NOT NULL DEFAULT 0,
+		FOREIGN KEY (thread_id) REFERENCES messages(message_id) ON DELETE CASCADE,
+		FOREIGN KEY (channel_id) REFERENCES channels(channel_id) ON DELETE CASCADE
+	)`)
+	if err != nil {
+		log.FatalError(err.Error(), "Error creating threads table")
+	}
+}
+
+func GetThread(threadID uint64) (Thread, bool) {
+	const query = "SELECT thread_id, channel_id, user_id, reply_count, last_reply FROM threads WHERE thread_id = ?"
+	log.Query(query, threadID)
+
+	var thread Thread
+	err := Conn.QueryRow(query, threadID).Scan(&thread.ThreadID, &thread.ChannelID, &thread.UserID, &thread.ReplyCount, &thread.LastReply)
+	if err == sql.ErrNoRows {
+		log.Trace("Thread ID [%d] doesn't exist", threadID)
+		return thread, false
+	}
+	DatabaseErrorCheck(err)
+
+	return thread, err == nil
+}
+
+// GetMessageLocation returns the channel of the message, and its thread if it's a thread reply,
+// deleted messages aren't found
+func GetMessageLocation(messageID uint64) (uint64, uint64) {
+	const query = "SELECT channel_id, thread_id FROM messages WHERE message_id = ? AND deleted_at = 0"
+	log.Query(query, messageID)
+
+	var channelID uint64
+	var threadID uint64
+	err := Conn.QueryRow(query, messageID).Scan(&channelID, &threadID)
+	DatabaseErrorCheck(err)
+
+	return channelID, threadID
+}
+
+// AddThreadReply counts a new reply in the thread and returns the updated thread
+func AddThreadReply(threadID uint64, timestamp int64) (Thread, bool) {
+	const query = "UPDATE threads SET reply_count = reply_count + 1, last_reply = ? WHERE thread_id = ?"
+	log.Query(query, timestamp, threadID)
+
+	_, err := Conn.Exec(query, timestamp, threadID)
+	DatabaseErrorCheck(err)
+
+	return GetThread(threadID)
+}
+
+// RemoveThreadReply is called after a reply was deleted, returns the updated thread
+func RemoveThreadReply(threadID uint64) (Thread, bool) {
+	const query = "UPDATE threads SET reply_count = reply_count - 1 WHERE thread_id = ? AND reply_count > 0"
+	log.Query(query, threadID)
+
+	_, err := Conn.Exec(query, threadID)
+	DatabaseErrorCheck(err)
+
+	return GetThread(threadID)
+}
+
+// GetThreadHistory returns a page of replies of the thread, newest first
+func GetThreadHistory(threadID uint64, page HistoryPage, userID uint64) []byte {
+	const query = "SELECT m.message_id, m.user_id, m.message, m.has_attachments, m.edited, m.reply_id, m.deleted_by FROM messages m WHERE m.thread_id = ?"
+
+	var history = ThreadHistory{ThreadID: threadID, Msgs: []ThreadMessage{}}
+	moreOlder, _ := queryPage(query, []any{threadID}, page, func(rows *sql.Rows) error {
+		var msg ThreadMessage
+		err := rows.Scan(&msg.MessageID, &msg.UserID, &msg.Message, &msg.hasAttachments, &msg.Edited, &msg.ReplyID, &msg.DeletedBy)
+
+		// deleted replies are left as tombstones without their content
+		if msg.DeletedBy != 0 {
+			msg.Message = ""
+			msg.hasAttachments = false
+		}
+
+		history.Msgs = append(history.Msgs, msg)
+		return err
+	})
+
+	// pages going forward or around a reply come partly in ascending order
+	sort.Slice(history.Msgs, func(i, j int) bool {
+		return history.Msgs[i].MessageID > history.Msgs[j].MessageID
+	})
+
+	if moreOlder {
+		history.Next = history.Msgs[len(history.Msgs)-1].MessageID
+	}
+
+	var messageIDs = make([]uint64, len(history.Msgs))
+	var withAttachments []uint64
+	for i := 0; i < len(history.Msgs); i++ {
+		messageIDs[i] = history.Msgs[i].MessageID
+		if history.Msgs[i].hasAttachments {
+			withAttachments = append(withAttachments, history.Msgs[i].MessageID)
+		}
+	}
+	reactions := GetReactionsOfMessages(messageIDs, userID)
+	attachments := GetAttachmentsOfMessages(withAttachments)
+	polls := GetPollsOfMessages(messageIDs, userID)
+
+	for i := 0; i < len(history.Msgs); i++ {
+		history.Msgs[i].Attachments = attachments[history.Msgs[i].MessageID]
+		if history.Msgs[i].DeletedBy == 0 {
+			history.Msgs[i].Reactions = reactions[history.Msgs[i].MessageID]
+			history.Msgs[i].Poll = polls[history.Msgs[i].MessageID]
+		}
+	}
+
+	jsonResult, err := json.Marshal(history)
+	if err != nil {
+		log.FatalError(err.Error(), "Error serializing history of thread ID [%d]", threadID)
+	}
+
+	log.Trace("Retrieved [%d] replies of thread ID [%d]", len(history.Msgs), threadID)
+	return jsonResult
+}
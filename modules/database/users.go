@@ -19,6 +19,7 @@ type User struct {
 
 type InitialData struct {
 	UserID      uint64
+	SessionID   uint64
 	DisplayName string
 	ProfilePic  string
 	Pronouns    string
@@ -26,6 +27,7 @@ type InitialData struct {
 	Friends     []uint64
 	Blocks      []uint64
 	Servers     []JoinedServer
+	Unread      []ChannelUnread
 }
 
 type UserData struct {
@@ -218,7 +220,7 @@ func GetInitialData(userID uint64) (*InitialData, bool) {
 	}
 
 	// get servers
-	const query4 string = "SELECT s.* FROM servers s JOIN server_members m ON s.server_id = m.server_id WHERE m.user_id = ?"
+	const query4 string = "SELECT s.server_id, s.user_id, s.name, s.picture, s.banner, s.retention_days FROM servers s JOIN server_members m ON s.server_id = m.server_id WHERE m.user_id = ?"
 	log.Query(query4, userID)
 
 	rows4, err := tx.Query(query4, userID)
@@ -227,9 +229,9 @@ func GetInitialData(userID uint64) (*InitialData, bool) {
 	for rows4.Next() {
 		var server JoinedServer
 		var ownerID uint64
-		err := rows4.Scan(&server.ServerID, &ownerID, &server.Name, &server.Picture, &server.Banner)
+		err := rows4.Scan(&server.ServerID, &ownerID, &server.Name, &server.Picture, &server.Banner, &server.RetentionDays)
 		DatabaseErrorCheck(err)
-		log.Trace("Owner ID: ", ownerID, " User ID: ", userID, "")
+		log.Trace("Owner ID: [%d] User ID: [%d]", ownerID, userID)
 		if ownerID == userID {
 			server.Owned = true
 		} else {
@@ -239,6 +241,9 @@ func GetInitialData(userID uint64) (*InitialData, bool) {
 		initData.Servers = append(initData.Servers, server)
 	}
 
+	// get unread counts
+	initData.Unread = getUnreadCounts(tx, userID)
+
 	err = tx.Commit()
 	transactionErrorCheck(err)
 
@@ -12,6 +12,17 @@ import (
 
 const maxUsernameLength = 16
 
+// machine readable codes sent in failure packets next to the reason
+const (
+	CodeValidation  = "validation"   // request was malformed or had invalid values
+	CodeNotMember   = "not_member"   // user isn't a member of the server
+	CodeNotOwner    = "not_owner"    // user isn't the owner of the server
+	CodeForbidden   = "forbidden"    // user isn't allowed to do it for another reason
+	CodeNotFound    = "not_found"    // requested thing doesn't exist
+	CodeRateLimited = "rate_limited" // user sent too many requests
+	CodeFailed      = "failed"       // request was fine but the server couldn't complete it
+)
+
 // func GetTimestamp() int64 {
 // 	return time.Now().UnixMilli()
 // }
@@ -24,19 +35,32 @@ func MeasureTime(start int64, msg string) {
 
 func ErrorDeserializing(errStr string, packetType byte, userID uint64) []byte {
 	log.WarnError(errStr, "Error deserializing json packet type [%d] of user ID [%d]", packetType, userID)
-	return RespondFailureReason("%s", fmt.Sprintf("Couldn't deserialize json of type [%d] request", packetType))
+	return RespondFailureReason(CodeValidation, "%s", fmt.Sprintf("Couldn't deserialize json of type [%d] request", packetType))
 }
 
 func ErrorSerializing(errStr string, packetType byte, userID uint64) {
 	log.FatalError(errStr, "Fatal error serializing response to packet type [%d] for user ID [%d]", packetType, userID)
 }
 
-func RespondFailureReason(format string, v ...any) []byte {
+func RespondFailureReason(code string, format string, v ...any) []byte {
+	return respondFailure(code, 0, fmt.Sprintf(format, v...))
+}
+
+// RespondRateLimited tells client how many milliseconds to wait before sending the request again
+func RespondRateLimited(retryAfter int64, format string, v ...any) []byte {
+	return respondFailure(CodeRateLimited, retryAfter, fmt.Sprintf(format, v...))
+}
+
+func respondFailure(code string, retryAfter int64, reason string) []byte {
 	type Failure struct {
-		Reason string
+		Code       string
+		Reason     string
+		RetryAfter int64 `json:",omitempty"`
 	}
 	var failure = Failure{
-		Reason: fmt.Sprintf(format, v...),
+		Code:       code,
+		Reason:     reason,
+		RetryAfter: retryAfter,
 	}
 
 	json, err := json.Marshal(failure)
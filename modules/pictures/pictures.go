@@ -5,12 +5,18 @@ import (
 	log "chat-app/modules/logging"
 	"chat-app/modules/macros"
 	"image"
+	"image/gif"
 	"image/jpeg"
+	"image/png"
+	"os"
 	"time"
 
 	"github.com/disintegration/imaging"
 )
 
+// EmojiFolder is where custom emoji of servers are saved, named by the hash of their picture
+const EmojiFolder = "./public/content/emoji/"
+
 func CheckAvatarPic(imgBytes *[]byte, userID uint64) string {
 	start := time.Now().UnixMilli()
 	// decode
@@ -97,3 +103,104 @@ func CheckBanner(imgBytes *[]byte, userID uint64) string {
 	*imgBytes = buf.Bytes()
 	return ""
 }
+
+// CheckEmoji fits a custom emoji into 128x128 keeping its ratio, saved as png so transparency isn't lost
+func CheckEmoji(imgBytes *[]byte, userID uint64) string {
+	start := time.Now().UnixMilli()
+	// decode
+	img, _, err := image.Decode(bytes.NewReader(*imgBytes))
+	if err != nil {
+		log.Error("%s", err.Error())
+		log.Hack("Received emoji from user ID [%d] is not a picture", userID)
+		return "Not a picture"
+	}
+
+	// check if picture is too small
+	if img.Bounds().Dx() < 16 || img.Bounds().Dy() < 16 {
+		log.Trace("Received emoji from user ID [%d] is too small", userID)
+		return "Picture is too small, minimum 16x16"
+	}
+
+	// check if picture is either too wide or too tall
+	widthRatio := float64(img.Bounds().Dx()) / float64(img.Bounds().Dy())
+	heightRatio := float64(img.Bounds().Dy()) / float64(img.Bounds().Dx())
+	if widthRatio > 4 {
+		log.Trace("Received emoji from user ID [%d] is too wide", userID)
+		return "Picture is too wide, must be less than 1:4 ratio"
+	} else if heightRatio > 4 {
+		log.Trace("Received emoji from user ID [%d] is too tall", userID)
+		return "Picture is too tall, must be less than 1:4 ratio"
+	}
+
+	// shrink to fit in 128x128 if larger
+	if img.Bounds().Dx() > 128 || img.Bounds().Dy() > 128 {
+		img = imaging.Fit(img, 128, 128, imaging.Lanczos)
+	}
+
+	// recompress into png
+	var buf bytes.Buffer
+	err = png.Encode(&buf, img)
+	if err != nil {
+		log.FatalError(err.Error(), "Error compressing emoji from user ID [%d]", userID)
+		return ""
+	}
+
+	macros.MeasureTime(start, "checking emoji")
+	*imgBytes = buf.Bytes()
+	return ""
+}
+
+// CheckAnimatedEmoji checks a gif emoji without changing it, since resizing would lose its frames
+// it already has to fit into 128x128
+func CheckAnimatedEmoji(imgBytes []byte, userID uint64) string {
+	start := time.Now().UnixMilli()
+
+	// size is checked before decoding frames, so a small file can't make them take a lot of memory
+	config, err := gif.DecodeConfig(bytes.NewReader(imgBytes))
+	if err != nil {
+		log.Error("%s", err.Error())
+		log.Hack("Received animated emoji from user ID [%d] is not a gif", userID)
+		return "Not a picture"
+	}
+
+	// check if picture is too small or too large
+	if config.Width < 16 || config.Height < 16 {
+		log.Trace("Received animated emoji from user ID [%d] is too small", userID)
+		return "Picture is too small, minimum 16x16"
+	}
+	if config.Width > 128 || config.Height > 128 {
+		log.Trace("Received animated emoji from user ID [%d] is too large", userID)
+		return "Animated picture is too large, maximum 128x128"
+	}
+
+	// check if picture is either too wide or too tall
+	widthRatio := float64(config.Width) / float64(config.Height)
+	heightRatio := float64(config.Height) / float64(config.Width)
+	if widthRatio > 4 {
+		log.Trace("Received animated emoji from user ID [%d] is too wide", userID)
+		return "Picture is too wide, must be less than 1:4 ratio"
+	} else if heightRatio > 4 {
+		log.Trace("Received animated emoji from user ID [%d] is too tall", userID)
+		return "Picture is too tall, must be less than 1:4 ratio"
+	}
+
+	// every frame has to be valid and inside the size checked above
+	_, err = gif.DecodeAll(bytes.NewReader(imgBytes))
+	if err != nil {
+		log.Error("%s", err.Error())
+		log.Hack("Received animated emoji from user ID [%d] has invalid frames", userID)
+		return "Not a picture"
+	}
+
+	macros.MeasureTime(start, "checking animated emoji")
+	return ""
+}
+
+// RemoveEmoji deletes the file of an emoji that no server has anymore
+func RemoveEmoji(fileName string) {
+	log.Trace("Removing emoji file [%s]", fileName)
+	err := os.Remove(EmojiFolder + fileName)
+	if err != nil && !os.IsNotExist(err) {
+		log.WarnError(err.Error(), "Error removing emoji file [%s]", fileName)
+	}
+}
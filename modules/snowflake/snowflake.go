@@ -78,6 +78,11 @@ func ExtractTimestamp(snowflakeId uint64) uint64 {
 	return snowflakeId >> timestampPos
 }
 
+// FromTimestamp returns the lowest snowflake ID that can be generated at the unix millisecond timestamp
+func FromTimestamp(timestamp uint64) uint64 {
+	return timestamp << timestampPos
+}
+
 func Print(snowflakeId uint64) {
 	snowflake := Extract(snowflakeId)
 	// var realTimestamp = timestamp + timestampOffset
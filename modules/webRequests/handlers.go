@@ -18,7 +18,6 @@ import (
 	"io"
 	"net/http"
 	"os"
-	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
@@ -44,6 +43,28 @@ func websocketHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// on /sse GET request, fallback for clients that can't connect to websocket
+func sseHandler(w http.ResponseWriter, r *http.Request) {
+	userID := token.CheckIfTokenIsValid(w, r)
+	if userID == 0 {
+		log.Hack("Someone is trying to connect to sse directly without token")
+		redirect(w, r, "/")
+		return
+	}
+	websocket.AcceptSseClient(userID, w, r)
+}
+
+// on /sse POST request, a packet sent by a client connected with sse
+func ssePacketHandler(w http.ResponseWriter, r *http.Request) {
+	userID := token.CheckIfTokenIsValid(w, r)
+	if userID == 0 {
+		log.Hack("Someone is trying to send packets to sse without token")
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	websocket.OnSsePacket(userID, w, r)
+}
+
 // on /login-register GET request
 func loginRegisterHandler(w http.ResponseWriter, r *http.Request) {
 	// check if user requesting login/registration already has a token
@@ -438,7 +459,7 @@ func uploadBannerHandler(w http.ResponseWriter, r *http.Request) {
 	// check if avatar pic file exists already, otherwise save as new
 	_, err = os.Stat(filePath)
 	if os.IsNotExist(err) {
-		log.Trace("Server banner doesn't exist yet, creating...", fileName)
+		log.Trace("Server banner [%s] doesn't exist yet, creating...", fileName)
 		err = os.WriteFile(filePath, imgBytes, 0644)
 		if err != nil {
 			log.FatalError(err.Error(), "Error writing bytes to server banner file from user ID [%d]", userID)
@@ -470,6 +491,148 @@ func uploadBannerHandler(w http.ResponseWriter, r *http.Request) {
 	websocket.OnServerBannerChanged(serverID, fileName)
 }
 
+func uploadEmojiHandler(w http.ResponseWriter, r *http.Request) {
+	userID := token.CheckIfTokenIsValid(w, r)
+	if userID == 0 {
+		log.Hack("Someone is trying to upload an emoji without token")
+		http.Error(w, "Who are you?", http.StatusUnauthorized)
+		return
+	}
+
+	// limit size
+	const maxSizeKb int64 = 256
+	const maxSize int64 = 1024 * maxSizeKb
+	if r.ContentLength > maxSize {
+		log.Warn("User ID [%d] tries to upload an emoji larger than [%d] KB", userID, maxSizeKb)
+		http.Error(w, fmt.Sprintf("Uploaded emoji is larger than allowed %d KB", maxSizeKb), http.StatusBadRequest)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxSize)
+
+	serverID, err := strconv.ParseUint(r.FormValue("serverID"), 10, 64)
+	if err != nil {
+		log.WarnError(err.Error(), "Error parsing serverID as uint64 while adding emoji to server of user ID [%d]", userID)
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+	log.Trace("User ID [%d] wants to add an emoji to server ID [%d]", userID, serverID)
+
+	if database.GetServerOwner(serverID) != userID {
+		log.Hack("User ID [%d] tried to add an emoji to server ID [%d] that they don't own", userID, serverID)
+		http.Error(w, "Not the owner of the server", http.StatusForbidden)
+		return
+	}
+
+	shortcode := r.FormValue("shortcode")
+	if !websocket.CheckEmojiShortcode(shortcode) {
+		http.Error(w, "Shortcode has to be 2 to 32 letters, numbers or underscores", http.StatusBadRequest)
+		return
+	}
+
+	// checked again when inserting, this only saves work on a server that is already full
+	if database.CountServerEmoji(serverID) >= database.MaxEmojiPerServer {
+		http.Error(w, fmt.Sprintf("Server can't have more than %d emoji", database.MaxEmojiPerServer), http.StatusBadRequest)
+		return
+	}
+
+	// parse formfile
+	picFormFile, _, err := r.FormFile("emoji")
+	if err != nil {
+		log.WarnError(err.Error(), "Error parsing emoji formfile sent by user ID [%d]", userID)
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+	defer picFormFile.Close()
+
+	imgBytes, err := io.ReadAll(picFormFile)
+	if err != nil {
+		log.WarnError(err.Error(), "Error reading emoji formfile from user ID [%d]", userID)
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+
+	var extension string
+
+	mimeType := http.DetectContentType(imgBytes)
+	switch mimeType {
+	case "image/jpeg", "image/jpg", "image/png":
+		extension = ".png"
+	case "image/gif":
+		extension = ".gif"
+	default:
+		log.Hack("User ID [%d] tried to upload unsupported filetype as emoji", userID)
+		http.Error(w, "Unsupported filetype", http.StatusBadRequest)
+		return
+	}
+
+	var issue string
+	if extension == ".png" {
+		issue = pictures.CheckEmoji(&imgBytes, userID)
+	} else {
+		issue = pictures.CheckAnimatedEmoji(imgBytes, userID)
+	}
+	if issue != "" {
+		http.Error(w, issue, http.StatusBadRequest)
+		return
+	}
+
+	hash := sha256.Sum256(imgBytes)
+	fileName := hex.EncodeToString(hash[:]) + extension
+	var filePath = pictures.EmojiFolder + fileName
+
+	// the emoji folder is newer than the other content folders, existing setups may not have it yet
+	err = os.MkdirAll(pictures.EmojiFolder, 0755)
+	if err != nil {
+		log.FatalError(err.Error(), "Error creating emoji folder")
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	// check if emoji file exists already, otherwise save as new
+	_, err = os.Stat(filePath)
+	if os.IsNotExist(err) {
+		log.Trace("Emoji [%s] doesn't exist yet, creating...", fileName)
+		err = os.WriteFile(filePath, imgBytes, 0644)
+		if err != nil {
+			log.FatalError(err.Error(), "Error writing bytes to emoji file from user ID [%d]", userID)
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+	} else if err != nil {
+		log.FatalError(err.Error(), "Error creating file for emoji from user ID [%d]", userID)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	} else {
+		log.Trace("Emoji [%s] of same hash already exists, using that one...", fileName)
+	}
+
+	emoji := database.ServerEmoji{
+		EmojiID:   snowflake.Generate(),
+		ServerID:  serverID,
+		Shortcode: shortcode,
+		FileName:  fileName,
+		AddedBy:   userID,
+	}
+	result := database.AddServerEmoji(emoji)
+	if result != database.EmojiAdded {
+		if !database.IsEmojiFileUsed(fileName) {
+			pictures.RemoveEmoji(fileName)
+		}
+
+		switch result {
+		case database.EmojiLimitReached:
+			http.Error(w, fmt.Sprintf("Server can't have more than %d emoji", database.MaxEmojiPerServer), http.StatusBadRequest)
+		case database.EmojiShortcodeTaken:
+			http.Error(w, fmt.Sprintf("Server already has an emoji named [%s]", shortcode), http.StatusBadRequest)
+		default:
+			http.Error(w, "", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	websocket.OnServerEmojiAdded(emoji)
+}
+
 func uploadAvatarHandler(w http.ResponseWriter, r *http.Request) {
 	var picType string
 	switch r.URL.Path {
@@ -714,9 +877,7 @@ func uploadAttachmentHandler(w http.ResponseWriter, r *http.Request) {
 				Name: part.FileName(),
 			}
 
-			hashString := hex.EncodeToString(awaitingAttachment.Hash[:])
-			extension := filepath.Ext(part.FileName())
-			path := "./public/content/attachments/" + hashString + extension
+			path := attachments.FilePath(awaitingAttachment.Hash[:], part.FileName())
 
 			_, err = os.Stat(path)
 			if err == nil {
@@ -92,6 +92,9 @@ func MainHandler(w http.ResponseWriter, r *http.Request) {
 		case "/wss", "/ws":
 			websocketHandler(w, r)
 			return
+		case "/sse":
+			sseHandler(w, r)
+			return
 		case "/login-register.html":
 			loginRegisterHandler(w, r)
 			return
@@ -113,10 +116,14 @@ func MainHandler(w http.ResponseWriter, r *http.Request) {
 			uploadAvatarHandler(w, r)
 		case "/upload-banner-pic":
 			uploadBannerHandler(w, r)
+		case "/upload-emoji":
+			uploadEmojiHandler(w, r)
 		case "/upload-attachment":
 			uploadAttachmentHandler(w, r)
 		case "/check-attachment":
 			checkAttachmentHandler(w, r)
+		case "/sse":
+			ssePacketHandler(w, r)
 		}
 	}
 }
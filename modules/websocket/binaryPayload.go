@@ -0,0 +1,383 @@
+package websocket
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"strconv"
+	"unicode/utf8"
+)
+
+// binary payload encoding, payloads are CBOR (RFC 8949) instead of JSON in both directions,
+// packets are still built and handled as JSON, they are converted when written and read,
+// so the framing around the payload and the handlers don't change
+
+// major types of CBOR, the upper 3 bits of the first byte of every item
+const (
+	cborUint     byte = 0 << 5
+	cborNegative byte = 1 << 5
+	cborBytes    byte = 2 << 5
+	cborText     byte = 3 << 5
+	cborArray    byte = 4 << 5
+	cborMap      byte = 5 << 5
+	cborTag      byte = 6 << 5
+	cborSimple   byte = 7 << 5
+)
+
+const (
+	cborIndefinite byte = 31   // additional info of arrays, maps and strings whose length isn't given
+	cborBreak      byte = 0xff // ends an item of indefinite length
+	cborFalse      byte = cborSimple | 20
+	cborTrue       byte = cborSimple | 21
+	cborNull       byte = cborSimple | 22
+	cborUndefined  byte = cborSimple | 23
+	cborFloat16    byte = cborSimple | 25
+	cborFloat32    byte = cborSimple | 26
+	cborFloat64    byte = cborSimple | 27
+
+	maxCborDepth = 64 // arrays and maps nested deeper than this are refused
+)
+
+var errCborTruncated = errors.New("cbor payload ends in the middle of an item")
+
+// encodePayload converts the JSON payload of a packet to CBOR, reqID and sequence number after the endIndex are kept,
+// HELLO is left as JSON so client can read the reply before knowing if binary payloads were accepted
+func encodePayload(packet []byte) ([]byte, error) {
+	if len(packet) < 5 || packet[4] == HELLO {
+		return packet, nil
+	}
+	endIndex := binary.LittleEndian.Uint32(packet[:4])
+
+	payload, err := jsonToCbor(packet[5:endIndex])
+	if err != nil {
+		return nil, err
+	}
+
+	var encoded []byte = make([]byte, 5, 5+len(payload)+len(packet)-int(endIndex))
+	binary.LittleEndian.PutUint32(encoded[:4], uint32(5+len(payload)))
+	encoded[4] = packet[4]
+	encoded = append(encoded, payload...)
+	return append(encoded, packet[endIndex:]...), nil
+}
+
+// jsonToCbor converts a JSON value to CBOR, objects and arrays are sent with indefinite length
+// since their size isn't known until their end, integers keep all 64 bits
+func jsonToCbor(jsonBytes []byte) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(jsonBytes))
+	decoder.UseNumber()
+
+	var out = make([]byte, 0, len(jsonBytes))
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return out, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch value := token.(type) {
+		case json.Delim:
+			switch value {
+			case '{':
+				out = append(out, cborMap|cborIndefinite)
+			case '[':
+				out = append(out, cborArray|cborIndefinite)
+			default:
+				out = append(out, cborBreak)
+			}
+		case string:
+			out = appendCborHead(out, cborText, uint64(len(value)))
+			out = append(out, value...)
+		case json.Number:
+			out = appendCborNumber(out, value)
+		case bool:
+			if value {
+				out = append(out, cborTrue)
+			} else {
+				out = append(out, cborFalse)
+			}
+		case nil:
+			out = append(out, cborNull)
+		}
+	}
+}
+
+// appendCborHead appends the first byte of an item and its argument in as few bytes as it fits
+func appendCborHead(out []byte, major byte, n uint64) []byte {
+	switch {
+	case n < 24:
+		return append(out, major|byte(n))
+	case n <= math.MaxUint8:
+		return append(out, major|24, byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(out, major|25), uint16(n))
+	case n <= math.MaxUint32:
+		return binary.BigEndian.AppendUint32(append(out, major|26), uint32(n))
+	default:
+		return binary.BigEndian.AppendUint64(append(out, major|27), n)
+	}
+}
+
+func appendCborNumber(out []byte, number json.Number) []byte {
+	if n, err := strconv.ParseUint(number.String(), 10, 64); err == nil {
+		return appendCborHead(out, cborUint, n)
+	}
+	if n, err := strconv.ParseInt(number.String(), 10, 64); err == nil {
+		// negative integers are stored as -1 - n
+		return appendCborHead(out, cborNegative, uint64(-1-n))
+	}
+	f, _ := number.Float64()
+	return binary.BigEndian.AppendUint64(append(out, cborFloat64), math.Float64bits(f))
+}
+
+// decodePayload converts a CBOR payload client sent to the JSON the handlers decode
+func decodePayload(payload []byte) ([]byte, error) {
+	if len(payload) == 0 {
+		return payload, nil
+	}
+
+	r := cborReader{data: payload}
+	jsonBytes, err := r.value(make([]byte, 0, len(payload)*2), 0)
+	if err != nil {
+		return nil, err
+	}
+	if r.pos != len(r.data) {
+		return nil, errors.New("cbor payload has more than one item")
+	}
+	return jsonBytes, nil
+}
+
+type cborReader struct {
+	data []byte
+	pos  int
+}
+
+// head reads the first byte of an item and its argument,
+// the argument is a length, a number, or unused for items of indefinite length
+func (r *cborReader) head() (byte, byte, uint64, error) {
+	if r.pos >= len(r.data) {
+		return 0, 0, 0, errCborTruncated
+	}
+	major, info := r.data[r.pos]&0xe0, r.data[r.pos]&0x1f
+	r.pos++
+
+	switch {
+	case info < 24:
+		return major, info, uint64(info), nil
+	case info <= 27:
+		size := 1 << (info - 24)
+		if len(r.data)-r.pos < size {
+			return 0, 0, 0, errCborTruncated
+		}
+		argument := r.data[r.pos : r.pos+size]
+		r.pos += size
+		switch size {
+		case 1:
+			return major, info, uint64(argument[0]), nil
+		case 2:
+			return major, info, uint64(binary.BigEndian.Uint16(argument)), nil
+		case 4:
+			return major, info, uint64(binary.BigEndian.Uint32(argument)), nil
+		default:
+			return major, info, binary.BigEndian.Uint64(argument), nil
+		}
+	case info == cborIndefinite && major != cborUint && major != cborNegative && major != cborTag:
+		return major, info, 0, nil
+	default:
+		return 0, 0, 0, errors.New("cbor item has invalid additional info")
+	}
+}
+
+// atBreak consumes the end of an item of indefinite length if it's next
+func (r *cborReader) atBreak() (bool, error) {
+	if r.pos >= len(r.data) {
+		return false, errCborTruncated
+	}
+	if r.data[r.pos] == cborBreak {
+		r.pos++
+		return true, nil
+	}
+	return false, nil
+}
+
+// value reads the next item and appends it to out as JSON
+func (r *cborReader) value(out []byte, depth int) ([]byte, error) {
+	if depth > maxCborDepth {
+		return nil, errors.New("cbor payload is nested too deep")
+	}
+
+	start := r.pos
+	major, info, n, err := r.head()
+	if err != nil {
+		return nil, err
+	}
+
+	switch major {
+	case cborUint:
+		return strconv.AppendUint(out, n, 10), nil
+	case cborNegative:
+		if n > math.MaxInt64 {
+			return nil, errors.New("cbor negative integer doesn't fit in 64 bits")
+		}
+		return strconv.AppendInt(out, -1-int64(n), 10), nil
+	case cborBytes, cborText:
+		s, err := r.stringBytes(major, info, n)
+		if err != nil {
+			return nil, err
+		}
+		// byte strings are base64 in JSON, the same way encoding/json sends []byte
+		var quoted []byte
+		if major == cborBytes {
+			quoted, err = json.Marshal(s)
+		} else if utf8.Valid(s) {
+			quoted, err = json.Marshal(string(s))
+		} else {
+			return nil, errors.New("cbor text string isn't valid utf-8")
+		}
+		if err != nil {
+			return nil, err
+		}
+		return append(out, quoted...), nil
+	case cborArray:
+		return r.container(append(out, '['), ']', info, n, depth, false)
+	case cborMap:
+		return r.container(append(out, '{'), '}', info, n, depth, true)
+	case cborTag:
+		// tags only describe what the item means, the item itself is enough
+		return r.value(out, depth+1)
+	default:
+		return r.simple(out, r.data[start], n)
+	}
+}
+
+// container reads the elements of an array, or the key and value pairs of a map
+func (r *cborReader) container(out []byte, end byte, info byte, n uint64, depth int, isMap bool) ([]byte, error) {
+	// every element takes at least a byte, so a length larger than what's left can't be right
+	if info != cborIndefinite && n > uint64(len(r.data)-r.pos) {
+		return nil, errCborTruncated
+	}
+
+	var err error
+	for i := uint64(0); info == cborIndefinite || i < n; i++ {
+		if info == cborIndefinite {
+			done, err := r.atBreak()
+			if err != nil {
+				return nil, err
+			}
+			if done {
+				break
+			}
+		}
+		if i > 0 {
+			out = append(out, ',')
+		}
+
+		if isMap {
+			// JSON only has text keys
+			if r.pos >= len(r.data) {
+				return nil, errCborTruncated
+			}
+			if r.data[r.pos]&0xe0 != cborText {
+				return nil, errors.New("cbor map key isn't a text string")
+			}
+			if out, err = r.value(out, depth+1); err != nil {
+				return nil, err
+			}
+			out = append(out, ':')
+		}
+		if out, err = r.value(out, depth+1); err != nil {
+			return nil, err
+		}
+	}
+	return append(out, end), nil
+}
+
+// stringBytes reads the content of a string, strings of indefinite length are made of chunks of the same major type
+func (r *cborReader) stringBytes(major byte, info byte, n uint64) ([]byte, error) {
+	if info != cborIndefinite {
+		if n > uint64(len(r.data)-r.pos) {
+			return nil, errCborTruncated
+		}
+		s := r.data[r.pos : r.pos+int(n)]
+		r.pos += int(n)
+		return s, nil
+	}
+
+	var s []byte
+	for {
+		done, err := r.atBreak()
+		if err != nil {
+			return nil, err
+		}
+		if done {
+			return s, nil
+		}
+
+		chunkMajor, chunkInfo, chunkLength, err := r.head()
+		if err != nil {
+			return nil, err
+		}
+		if chunkMajor != major || chunkInfo == cborIndefinite {
+			return nil, errors.New("cbor string chunk has the wrong type")
+		}
+		chunk, err := r.stringBytes(chunkMajor, chunkInfo, chunkLength)
+		if err != nil {
+			return nil, err
+		}
+		s = append(s, chunk...)
+	}
+}
+
+// simple reads false, true, null and floats, undefined becomes null
+func (r *cborReader) simple(out []byte, first byte, n uint64) ([]byte, error) {
+	var f float64
+	switch first {
+	case cborFalse:
+		return append(out, "false"...), nil
+	case cborTrue:
+		return append(out, "true"...), nil
+	case cborNull, cborUndefined:
+		return append(out, "null"...), nil
+	case cborFloat16:
+		f = float16ToFloat64(uint16(n))
+	case cborFloat32:
+		f = float64(math.Float32frombits(uint32(n)))
+	case cborFloat64:
+		f = math.Float64frombits(n)
+	default:
+		return nil, errors.New("cbor simple value isn't supported")
+	}
+
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return nil, errors.New("cbor float can't be NaN or infinity in JSON")
+	}
+	return strconv.AppendFloat(out, f, 'g', -1, 64), nil
+}
+
+func float16ToFloat64(half uint16) float64 {
+	exponent := int(half>>10) & 0x1f
+	mantissa := float64(half & 0x3ff)
+
+	var f float64
+	switch exponent {
+	case 0:
+		f = math.Ldexp(mantissa, -24)
+	case 0x1f:
+		if mantissa == 0 {
+			f = math.Inf(1)
+		} else {
+			f = math.NaN()
+		}
+	default:
+		f = math.Ldexp(mantissa+1024, exponent-25)
+	}
+
+	if half&0x8000 != 0 {
+		return -f
+	}
+	return f
+}
@@ -0,0 +1,133 @@
+package websocket
+
+import (
+	"bytes"
+	"chat-app/modules/macros"
+	"encoding/binary"
+	"encoding/hex"
+	"testing"
+)
+
+// examples from appendix A of RFC 8949 and what the handlers get for them
+func TestDecodePayload(t *testing.T) {
+	tests := []struct {
+		cbor string
+		json string
+	}{
+		{"00", "0"},
+		{"17", "23"},
+		{"1818", "24"},
+		{"1903e8", "1000"},
+		{"1bffffffffffffffff", "18446744073709551615"},
+		{"20", "-1"},
+		{"3903e7", "-1000"},
+		{"f90001", "5.960464477539063e-08"},
+		{"f93e00", "1.5"},
+		{"fa47c35000", "100000"},
+		{"fb3ff199999999999a", "1.1"},
+		{"f4", "false"},
+		{"f5", "true"},
+		{"f6", "null"},
+		{"f7", "null"},
+		{"6449455446", `"IETF"`},
+		{"62225c", `"\"\\"`},
+		{"7f657374726561646d696e67ff", `"streaming"`},
+		{"4401020304", `"AQIDBA=="`},
+		{"80", "[]"},
+		{"83010203", "[1,2,3]"},
+		{"9f018202039f0405ffff", "[1,[2,3],[4,5]]"},
+		{"a26161016162820203", `{"a":1,"b":[2,3]}`},
+		{"bf61610161629f0203ffff", `{"a":1,"b":[2,3]}`},
+		{"c11a514b67b0", "1363896240"},
+	}
+
+	for _, test := range tests {
+		payload, _ := hex.DecodeString(test.cbor)
+		got, err := decodePayload(payload)
+		if err != nil {
+			t.Errorf("%s: %v", test.cbor, err)
+			continue
+		}
+		if string(got) != test.json {
+			t.Errorf("%s decoded to %s, want %s", test.cbor, got, test.json)
+		}
+	}
+}
+
+func TestDecodePayloadRefusesInvalid(t *testing.T) {
+	tests := []string{
+		"18",                 // argument is missing
+		"62ff",               // string is shorter than its length
+		"9f01",               // array never ends
+		"a10102",             // map key isn't text
+		"9bffffffffffffffff", // array can't be longer than the payload
+		"3bffffffffffffffff", // doesn't fit in int64
+		"f97e00",             // NaN
+		"62c328",             // not utf-8
+		"0000",               // more than one item
+		"1c",                 // reserved additional info
+		"ff",                 // break outside of an item
+	}
+
+	for _, test := range tests {
+		payload, _ := hex.DecodeString(test)
+		if got, err := decodePayload(payload); err == nil {
+			t.Errorf("%s was decoded to %s", test, got)
+		}
+	}
+
+	nested := append(bytes.Repeat([]byte{0x81}, maxCborDepth+1), 0x00)
+	if _, err := decodePayload(nested); err == nil {
+		t.Error("payload nested deeper than the limit was decoded")
+	}
+}
+
+// what the server sends comes back as the same JSON, IDs keep all 64 bits
+func TestPayloadRoundTrip(t *testing.T) {
+	tests := []string{
+		`{"MsgID":18446744073709551615,"UserID":7517551362788294656,"Msg":"héllo \"world\"","Att":null,"Edited":true,"Counts":[0,-5,2.5],"Empty":{}}`,
+		`[]`,
+		`""`,
+		`-9223372036854775808`,
+	}
+
+	for _, test := range tests {
+		cbor, err := jsonToCbor([]byte(test))
+		if err != nil {
+			t.Errorf("%s: %v", test, err)
+			continue
+		}
+		got, err := decodePayload(cbor)
+		if err != nil {
+			t.Errorf("%s: %v", test, err)
+			continue
+		}
+		if string(got) != test {
+			t.Errorf("%s came back as %s", test, got)
+		}
+	}
+}
+
+func TestEncodePayloadKeepsFraming(t *testing.T) {
+	packet := macros.PreparePacket(ADD_CHAT_MESSAGE, []byte(`{"Msg":"hi"}`))
+	packet = append(packet, 7, 0, 0, 0) // request ID
+
+	encoded, err := encodePayload(packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	endIndex := binary.LittleEndian.Uint32(encoded[:4])
+	want, _ := hex.DecodeString("bf634d7367626869ff")
+	if encoded[4] != ADD_CHAT_MESSAGE || !bytes.Equal(encoded[5:endIndex], want) {
+		t.Errorf("payload was encoded to %x, want %x", encoded[5:endIndex], want)
+	}
+	if !bytes.Equal(encoded[endIndex:], []byte{7, 0, 0, 0}) {
+		t.Errorf("bytes after the endIndex are %v, want the request ID", encoded[endIndex:])
+	}
+
+	hello := macros.PreparePacket(HELLO, []byte(`{"Version":1}`))
+	if encoded, _ := encodePayload(hello); !bytes.Equal(encoded, hello) {
+		t.Error("HELLO wasn't left as JSON")
+	}
+}
@@ -0,0 +1,37 @@
+package websocket
+
+// Broadcaster passes broadcasts between the instances of chat-app that share the users,
+// every instance delivers them to the sessions connected to it
+type Broadcaster interface {
+	// Start is called once before anything is published,
+	// deliver has to be called for every broadcast, including the ones published by this instance
+	Start(deliver func(BroadcastData)) error
+
+	// Publish sends a broadcast to every instance
+	Publish(broadcastData BroadcastData)
+
+	// PublishPresence tells the other instances if the user has sessions on this instance
+	PublishPresence(userID uint64)
+}
+
+var broadcaster Broadcaster
+
+// LocalBroadcaster is used when chat-app runs as a single instance
+type LocalBroadcaster struct {
+	deliver func(BroadcastData)
+}
+
+func NewLocalBroadcaster() *LocalBroadcaster {
+	return &LocalBroadcaster{}
+}
+
+func (b *LocalBroadcaster) Start(deliver func(BroadcastData)) error {
+	b.deliver = deliver
+	return nil
+}
+
+func (b *LocalBroadcaster) Publish(broadcastData BroadcastData) {
+	b.deliver(broadcastData)
+}
+
+func (b *LocalBroadcaster) PublishPresence(userID uint64) {}
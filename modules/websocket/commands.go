@@ -0,0 +1,267 @@
+package websocket
+
+import (
+	"chat-app/modules/clients"
+	"chat-app/modules/database"
+	log "chat-app/modules/logging"
+	"chat-app/modules/macros"
+	"chat-app/modules/snowflake"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// a command typed into the chat input as /name arguments, handled instead of being sent as a chat message
+type slashCommand struct {
+	Name        string
+	Usage       string // arguments of the command, shown by autocomplete
+	Description string
+	ownerOnly   bool // only the owner of the server can use it
+	minArgs     int
+	run         func(c *WsClient, call commandCall) commandOutcome
+}
+
+// commandCall is a command the user typed, with the chat message it came in
+type commandCall struct {
+	req  ClientChatMsg
+	ctx  packetContext
+	args []string // arguments split at whitespace
+	text string   // everything after the command name as it was typed
+}
+
+type commandOutcome struct {
+	post   string // sent to the channel as a chat message of the user if not empty
+	reply  string // shown only to the session that used the command
+	failed bool
+}
+
+// what only the session that used a command is shown, type 102
+type commandResult struct {
+	ChannelID uint64
+	Command   string
+	Success   bool
+	Text      string
+}
+
+type CommandListRequest struct {
+	ServerID uint64
+}
+
+var slashCommands = []slashCommand{
+	{Name: "me", Usage: "<action>", Description: "Send a message as an action", minArgs: 1, run: commandMe},
+	{Name: "shrug", Usage: "[message]", Description: "Send a message with a shrug", run: commandShrug},
+	{Name: "nick", Usage: "<display name>", Description: "Change your display name", minArgs: 1, run: commandNick},
+	{Name: "invite", Description: "Create an invite link to this server", run: commandInvite},
+	{Name: "topic", Usage: "<topic>", Description: "Change the topic of this channel", ownerOnly: true, run: commandTopic},
+	{Name: "kick", Usage: "<@user>", Description: "Remove a member from this server", ownerOnly: true, minArgs: 1, run: commandKick},
+}
+
+func findCommand(name string) (slashCommand, bool) {
+	for i := 0; i < len(slashCommands); i++ {
+		if slashCommands[i].Name == name {
+			return slashCommands[i], true
+		}
+	}
+	return slashCommand{}, false
+}
+
+// parseCommand splits /name arguments into the name and what comes after it
+func parseCommand(message string) (string, string) {
+	message = strings.TrimPrefix(message, "/")
+	name, text, _ := strings.Cut(message, " ")
+	return strings.ToLower(strings.TrimSpace(name)), strings.TrimSpace(text)
+}
+
+// parseUserArgument accepts a user as a mention or a plain user ID, returns 0 if it's neither
+func parseUserArgument(arg string) uint64 {
+	if strings.HasPrefix(arg, "<@") && strings.HasSuffix(arg, ">") {
+		arg = arg[2 : len(arg)-1]
+	}
+	userID, err := strconv.ParseUint(arg, 10, 64)
+	if err != nil {
+		return 0
+	}
+	return userID
+}
+
+// runCommand handles a chat message starting with a slash and returns the message to send instead if the command sends one.
+// A message starting with // isn't a command, it's sent with the first slash removed.
+func (c *WsClient) runCommand(req ClientChatMsg, ctx packetContext) (string, bool) {
+	if strings.HasPrefix(req.Message, "//") {
+		return req.Message[1:], true
+	}
+
+	name, text := parseCommand(req.Message)
+	command, found := findCommand(name)
+	if !found {
+		c.commandReply(req.ChannelID, name, false, fmt.Sprintf("Unknown command /%s, start the message with // to send it as it is", name))
+		return "", false
+	}
+
+	args := strings.Fields(text)
+	if len(args) < command.minArgs {
+		c.commandReply(req.ChannelID, name, false, strings.TrimSpace(fmt.Sprintf("Usage: /%s %s", command.Name, command.Usage)))
+		return "", false
+	}
+
+	if command.ownerOnly && database.GetServerOwner(ctx.serverID) != c.UserID {
+		c.commandReply(req.ChannelID, name, false, fmt.Sprintf("Only the owner of the server can use /%s", command.Name))
+		return "", false
+	}
+
+	log.Trace("User ID [%d] used command /%s in channel ID [%d]", c.UserID, command.Name, req.ChannelID)
+	outcome := command.run(c, commandCall{
+		req:  req,
+		ctx:  ctx,
+		args: args,
+		text: text,
+	})
+
+	if outcome.reply != "" || outcome.failed {
+		c.commandReply(req.ChannelID, name, !outcome.failed, outcome.reply)
+	}
+	if outcome.failed || outcome.post == "" {
+		return "", false
+	}
+	return outcome.post, true
+}
+
+// commandReply sends the result of a command only to this session
+func (c *WsClient) commandReply(channelID uint64, command string, success bool, text string) {
+	jsonBytes, err := json.Marshal(commandResult{
+		ChannelID: channelID,
+		Command:   command,
+		Success:   success,
+		Text:      text,
+	})
+	if err != nil {
+		macros.ErrorSerializing(err.Error(), COMMAND_RESULT, c.UserID)
+		return
+	}
+
+	c.reply(macros.PreparePacket(COMMAND_RESULT, jsonBytes))
+}
+
+// when client requests the commands it can use in a server for autocomplete, type 101
+func (c *WsClient) onCommandListRequest(req CommandListRequest, ctx packetContext) {
+	owner := database.GetServerOwner(ctx.serverID) == c.UserID
+
+	var available = []slashCommand{}
+	for i := 0; i < len(slashCommands); i++ {
+		if !slashCommands[i].ownerOnly || owner {
+			available = append(available, slashCommands[i])
+		}
+	}
+
+	type CommandListResponse struct {
+		ServerID uint64
+		Commands []slashCommand
+	}
+
+	jsonBytes, err := json.Marshal(CommandListResponse{
+		ServerID: ctx.serverID,
+		Commands: available,
+	})
+	if err != nil {
+		macros.ErrorSerializing(err.Error(), ctx.packetType, c.UserID)
+		return
+	}
+
+	c.reply(macros.PreparePacket(ctx.packetType, jsonBytes))
+}
+
+func commandMe(c *WsClient, call commandCall) commandOutcome {
+	return commandOutcome{post: "*" + call.text + "*"}
+}
+
+func commandShrug(c *WsClient, call commandCall) commandOutcome {
+	return commandOutcome{post: strings.TrimSpace(call.text + ` ¯\_(ツ)_/¯`)}
+}
+
+// the display name change is sent to every session of the user like when changed in settings
+func commandNick(c *WsClient, call commandCall) commandOutcome {
+	c.onUpdateUserDataRequest(UpdateUserDataRequest{
+		DisplayName: call.text,
+		NewDN:       true,
+	}, packetContext{packetType: UPDATE_USER_DATA})
+	return commandOutcome{}
+}
+
+func commandInvite(c *WsClient, call commandCall) commandOutcome {
+	inviteID := snowflake.Generate()
+
+	err := database.Insert(database.ServerInvite{
+		InviteID: inviteID,
+		ServerID: call.ctx.serverID,
+	})
+	if err != nil {
+		log.Error("Error creating invite for server ID [%d] for user ID [%d]", call.ctx.serverID, c.UserID)
+		return commandOutcome{reply: "Failed creating invite link", failed: true}
+	}
+
+	return commandOutcome{reply: fmt.Sprintf("Invite link: /invite/%d", inviteID)}
+}
+
+// an empty topic clears it, sessions viewing the server see the change like when changed in channel settings
+func commandTopic(c *WsClient, call commandCall) commandOutcome {
+	c.onChannelDataUpdateRequest(UpdateChannelDataRequest{
+		ChannelID: call.req.ChannelID,
+		Topic:     call.text,
+		NewTP:     true,
+	}, packetContext{packetType: UPDATE_CHANNEL_DATA, serverID: call.ctx.serverID, channelID: call.ctx.channelID})
+	return commandOutcome{}
+}
+
+func commandKick(c *WsClient, call commandCall) commandOutcome {
+	serverID := call.ctx.serverID
+
+	targetID := parseUserArgument(call.args[0])
+	if targetID == 0 {
+		return commandOutcome{reply: fmt.Sprintf("[%s] isn't a user", call.args[0]), failed: true}
+	}
+	if targetID == c.UserID {
+		return commandOutcome{reply: "Can't kick yourself, delete the server or leave it instead", failed: true}
+	}
+
+	member := database.ServerMemberShort{
+		ServerID: serverID,
+		UserID:   targetID,
+	}
+	if !database.ConfirmServerMembership(targetID, serverID) || !database.Delete(member) {
+		return commandOutcome{reply: fmt.Sprintf("User ID [%d] isn't a member of this server", targetID), failed: true}
+	}
+	log.Trace("User ID [%d] kicked user ID [%d] from server ID [%d]", c.UserID, targetID, serverID)
+
+	// sessions of the kicked user stop receiving events of the server right away,
+	// so they are only told the server is gone for them
+	clients.UnsubscribeUserFromServer(targetID, serverID)
+
+	memberBytes, err := json.Marshal(member)
+	if err != nil {
+		macros.ErrorSerializing(err.Error(), DELETE_SERVER_MEMBER, c.UserID)
+		return commandOutcome{}
+	}
+	broadcastChan <- BroadcastData{
+		MessageBytes:    macros.PreparePacket(DELETE_SERVER_MEMBER, memberBytes),
+		Type:            DELETE_SERVER_MEMBER,
+		AffectedServers: []uint64{serverID},
+		SourceUserID:    targetID,
+	}
+
+	serverBytes, err := json.Marshal(database.ServerDelete{
+		ServerID: serverID,
+		UserID:   c.UserID,
+	})
+	if err != nil {
+		macros.ErrorSerializing(err.Error(), DELETE_SERVER, c.UserID)
+		return commandOutcome{}
+	}
+	broadcastChan <- BroadcastData{
+		MessageBytes:   macros.PreparePacket(DELETE_SERVER, serverBytes),
+		Type:           DELETE_SERVER,
+		AffectedUserID: []uint64{targetID},
+	}
+
+	return commandOutcome{reply: fmt.Sprintf("Kicked <@%d> from the server", targetID)}
+}
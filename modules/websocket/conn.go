@@ -0,0 +1,63 @@
+package websocket
+
+import (
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// sessionConn is the transport a session sends and receives packets through,
+// a websocket normally, or server-sent events for clients that can't upgrade
+type sessionConn interface {
+	// ReadPacket blocks until client sends a packet, an error means the connection is unusable
+	ReadPacket() ([]byte, error)
+
+	// WritePacket sends a packet to client, only called from one goroutine at a time
+	WritePacket(packet []byte, compress bool) error
+
+	// Ping keeps the connection alive and finds out if client is gone
+	Ping() error
+
+	// Disconnect tells client why it's being disconnected,
+	// ReadPacket stops returning packets after the given time
+	Disconnect(code int, reason string, after time.Duration) error
+
+	Close() error
+}
+
+type wsConn struct {
+	conn *websocket.Conn
+}
+
+func newWsConn(conn *websocket.Conn) *wsConn {
+	conn.SetReadLimit(maxMessageSize) // received bytes after this limit will be discareded
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	conn.SetPongHandler(func(string) error { conn.SetReadDeadline(time.Now().Add(timeout)); return nil })
+	return &wsConn{conn: conn}
+}
+
+func (w *wsConn) ReadPacket() ([]byte, error) {
+	_, receivedBytes, err := w.conn.ReadMessage()
+	return receivedBytes, err
+}
+
+func (w *wsConn) WritePacket(packet []byte, compress bool) error {
+	w.conn.EnableWriteCompression(compress)
+	w.conn.SetWriteDeadline(time.Now().Add(timeoutWrite))
+	return w.conn.WriteMessage(websocket.BinaryMessage, packet)
+}
+
+func (w *wsConn) Ping() error {
+	w.conn.SetWriteDeadline(time.Now().Add(timeoutWrite))
+	return w.conn.WriteMessage(websocket.PingMessage, nil)
+}
+
+func (w *wsConn) Disconnect(code int, reason string, after time.Duration) error {
+	w.conn.SetReadDeadline(time.Now().Add(after))
+	closeMessage := websocket.FormatCloseMessage(code, reason)
+	return w.conn.WriteControl(websocket.CloseMessage, closeMessage, time.Now().Add(timeoutWrite))
+}
+
+func (w *wsConn) Close() error {
+	return w.conn.Close()
+}
@@ -0,0 +1,247 @@
+package websocket
+
+import (
+	"chat-app/modules/database"
+	log "chat-app/modules/logging"
+	"chat-app/modules/macros"
+	"encoding/json"
+	"fmt"
+	"runtime/debug"
+	"time"
+)
+
+// what a user has to be to send a packet, checked before the handler runs
+type authRule byte
+
+const (
+	authNone      authRule = iota // any connected user, handler only touches the user's own data
+	authSelf                      // user has to be the author of the message in MessageID
+	authMember                    // user has to be a member of the server in ServerID, or of the server of ChannelID
+	authOwner                     // user has to be the owner of the server in ServerID, or of the server of ChannelID
+	authModerator                 // user has to be the author of the message in MessageID, or the owner of its server
+)
+
+// packets of the same class share how often they can be sent
+type rateClass byte
+
+const (
+	rateSession rateClass = iota // handshake and data needed after connecting
+	rateMessage                  // sending, editing and deleting chat messages
+	rateTyping                   // typing indicators
+	rateRead                     // history, lists and subscriptions
+	rateProfile                  // status and user data updates
+	rateManage                   // changing servers, channels and friends
+
+	rateClassCount
+)
+
+// packetContext is what the middleware found out about the packet before the handler runs
+type packetContext struct {
+	packetType byte
+	serverID   uint64 // server the auth rule was checked against
+	channelID  uint64 // channel of ChannelID, or of MessageID with authSelf and authModerator
+}
+
+type packetRoute struct {
+	auth   authRule
+	rate   rateClass
+	decode func(packetJson []byte) (any, error)
+	handle func(c *WsClient, req any, ctx packetContext)
+}
+
+// handle makes a route for packets that have a request of type T
+func handle[T any](auth authRule, rate rateClass, handler func(*WsClient, T, packetContext)) packetRoute {
+	return packetRoute{
+		auth: auth,
+		rate: rate,
+		decode: func(packetJson []byte) (any, error) {
+			var req T
+			err := json.Unmarshal(packetJson, &req)
+			return req, err
+		},
+		handle: func(c *WsClient, req any, ctx packetContext) {
+			handler(c, req.(T), ctx)
+		},
+	}
+}
+
+// handleEmpty makes a route for packets without a request, their json isn't read
+func handleEmpty(rate rateClass, handler func(*WsClient, byte)) packetRoute {
+	return packetRoute{
+		auth: authNone,
+		rate: rate,
+		decode: func(packetJson []byte) (any, error) {
+			return nil, nil
+		},
+		handle: func(c *WsClient, req any, ctx packetContext) {
+			handler(c, ctx.packetType)
+		},
+	}
+}
+
+var packetRoutes = map[byte]packetRoute{
+	HELLO:                handle(authNone, rateSession, (*WsClient).onHelloRequest),                  // client tells what protocol version and features it supports
+	RESUME:               handle(authNone, rateSession, (*WsClient).onResumeRequest),                 // user wants to continue a session that disconnected
+	INITIAL_USER_DATA:    handleEmpty(rateSession, (*WsClient).onInitialDataRequest),                 // user requests initial data
+	IMAGE_HOST_ADDRESS:   handleEmpty(rateSession, (*WsClient).onImageHostAddressRequest),            // user requests address of image host
+	ADD_CHAT_MESSAGE:     handle(authMember, rateMessage, (*WsClient).onAddChatMessageRequest),       // user sent a chat message on x channel
+	DELETE_CHAT_MESSAGE:  handle(authModerator, rateMessage, (*WsClient).onChatMessageDeleteRequest), // user or server owner deleting a chat message
+	EDIT_CHAT_MESSAGE:    handle(authSelf, rateMessage, (*WsClient).onChatMessageEditRequest),        // user editing a chat message
+	STARTED_TYPING:       handle(authNone, rateTyping, (*WsClient).onChatMessageTyping),              // user started or stopped typing in current channel
+	START_THREAD:         handle(authMember, rateMessage, (*WsClient).onStartThreadRequest),          // user started a thread from a message, or opened an existing one
+	THREAD_HISTORY:       handle(authMember, rateRead, (*WsClient).onThreadHistoryRequest),           // user opened a thread, requesting its replies
+	UNSUBSCRIBE_THREAD:   handle(authNone, rateRead, (*WsClient).onUnsubscribeThreadRequest),         // user closed a thread
+	ADD_REACTION:         handle(authMember, rateMessage, (*WsClient).onAddReactionRequest),          // user reacted to a message
+	REMOVE_REACTION:      handle(authMember, rateMessage, (*WsClient).onRemoveReactionRequest),       // user took back a reaction
+	PIN_MESSAGE:          handle(authOwner, rateManage, (*WsClient).onPinMessageRequest),             // server owner pinned a message of a channel
+	UNPIN_MESSAGE:        handle(authOwner, rateManage, (*WsClient).onUnpinMessageRequest),           // server owner unpinned a message
+	PINNED_LIST:          handle(authMember, rateRead, (*WsClient).onPinnedListRequest),              // user requests pinned messages of a channel
+	SEARCH_MESSAGES:      handle(authNone, rateRead, (*WsClient).onSearchMessagesRequest),            // user searches messages of servers and dms they are in
+	MESSAGE_REVISIONS:    handle(authMember, rateRead, (*WsClient).onMessageRevisionsRequest),        // user requests edit history of a message
+	CREATE_POLL:          handle(authSelf, rateMessage, (*WsClient).onCreatePollRequest),             // user attached a poll to their message
+	VOTE_POLL:            handle(authMember, rateMessage, (*WsClient).onVotePollRequest),             // user voted in a poll or changed their vote
+	COMMAND_LIST:         handle(authMember, rateRead, (*WsClient).onCommandListRequest),             // user requests slash commands they can use in a server
+	SCHEDULE_MESSAGE:     handle(authMember, rateMessage, (*WsClient).onScheduleMessageRequest),      // user scheduled a chat message to be sent later
+	SCHEDULED_MESSAGES:   handleEmpty(rateRead, (*WsClient).onScheduledMessagesRequest),              // user requests their messages waiting to be sent
+	EDIT_SCHEDULED:       handle(authNone, rateMessage, (*WsClient).onEditScheduledRequest),          // user changed a scheduled message or its send time
+	CANCEL_SCHEDULED:     handle(authNone, rateMessage, (*WsClient).onCancelScheduledRequest),        // user cancelled a scheduled message
+	CHAT_HISTORY:         handle(authMember, rateRead, (*WsClient).onChatHistoryRequest),             // user entered a channel, requesting chat history
+	CHANNEL_LIST:         handle(authMember, rateRead, (*WsClient).onChannelListRequest),             // user entered a server, requesting channel list
+	SERVER_MEMBER_LIST:   handle(authMember, rateRead, (*WsClient).onServerMemberListRequest),        // user entered a server, requesting member list
+	SUBSCRIBE_CHANNEL:    handle(authMember, rateRead, (*WsClient).onSubscribeChannelRequest),        // user wants to receive events of a channel besides the one they are viewing
+	UNSUBSCRIBE_CHANNEL:  handle(authNone, rateRead, (*WsClient).onUnsubscribeChannelRequest),        // user no longer wants to receive events of a subscribed channel
+	REQUEST_DM_LIST:      handleEmpty(rateRead, (*WsClient).onDmListRequest),                         // user requests list of direct messages they have
+	ADD_SERVER:           handle(authNone, rateManage, (*WsClient).onAddServerRequest),               // user adding a server
+	DELETE_SERVER:        handle(authOwner, rateManage, (*WsClient).onServerDeleteRequest),           // user deleting a server
+	SERVER_INVITE_LINK:   handle(authMember, rateManage, (*WsClient).onServerInviteRequest),          // user requested an invite link for a server
+	UPDATE_SERVER_DATA:   handle(authOwner, rateManage, (*WsClient).onServerDataUpdateRequest),       // user is requesting to update server data of their server
+	EMOJI_LIST:           handle(authMember, rateRead, (*WsClient).onEmojiListRequest),               // user entered a server, requesting its custom emoji
+	EMOJI_UPDATE:         handle(authOwner, rateManage, (*WsClient).onEmojiUpdateRequest),            // user renamed or deleted a custom emoji of their server
+	DELETE_SERVER_MEMBER: handle(authMember, rateManage, (*WsClient).onLeaveServerRequest),           // a user left a server
+	ADD_CHANNEL:          handle(authOwner, rateManage, (*WsClient).onAddChannelRequest),             // user added a channel to their server
+	DELETE_CHANNEL:       handle(authOwner, rateManage, (*WsClient).onChannelDeleteRequest),          // user wants to delete a channel
+	UPDATE_CHANNEL_DATA:  handle(authOwner, rateManage, (*WsClient).onChannelDataUpdateRequest),      // user wants to change name of a channel
+	UPDATE_STATUS:        handle(authNone, rateProfile, (*WsClient).onUpdateUserStatusValue),         // user wants to update their status value
+	UPDATE_USER_DATA:     handle(authNone, rateProfile, (*WsClient).onUpdateUserDataRequest),         // user wants to update their account data
+	ADD_FRIEND:           handle(authNone, rateManage, (*WsClient).onAddFriendRequest),               // user wants to add another user as friend
+	BLOCK_USER:           handle(authNone, rateManage, (*WsClient).onBlockUserRequest),               // user wants to block a user
+	UNFRIEND:             handle(authNone, rateManage, (*WsClient).onUnfriendRequest),                // user wants to unfriend a user
+	OPEN_DM:              handle(authNone, rateManage, (*WsClient).onOpenDmRequest),                  // user wants to open a dm
+	MENTION_INBOX:        handleEmpty(rateRead, (*WsClient).onMentionInboxRequest),                   // user requests mentions they haven't acknowledged
+	ACK_MENTION:          handle(authNone, rateRead, (*WsClient).onAckMentionRequest),                // user dismissed a mention
+	ACK_CHANNEL:          handle(authNone, rateRead, (*WsClient).onAckChannelRequest),                // user read a channel or dm up to a message
+}
+
+// dispatch runs a received packet through the middleware, then its handler
+func (c *WsClient) dispatch(packetType byte, packetJson []byte) {
+	// a bug in a handler shouldn't take the whole server down
+	defer func() {
+		if r := recover(); r != nil {
+			log.Error("Panic while handling packet type [%d] of user ID [%d]: %v\n%s", packetType, c.UserID, r, debug.Stack())
+			c.reply(macros.RespondFailureReason(macros.CodeFailed, "Server failed handling packet type [%d]", packetType))
+		}
+	}()
+
+	start := time.Now().UnixMicro()
+	defer macros.MeasureTime(start, fmt.Sprintf("Handling packet type [%d] of user ID [%d]", packetType, c.UserID))
+
+	route, found := packetRoutes[packetType]
+	if !found {
+		log.Hack("User ID [%d] sent invalid packet type: [%d]", c.UserID, packetType)
+		if c.checkRate(packetType, rateSession) {
+			c.reply(macros.RespondFailureReason(macros.CodeValidation, "Packet type is invalid"))
+		}
+		return
+	}
+
+	if !c.checkRate(packetType, route.rate) {
+		return
+	}
+
+	req, err := route.decode(packetJson)
+	if err != nil {
+		c.reply(macros.ErrorDeserializing(err.Error(), packetType, c.UserID))
+		return
+	}
+
+	ctx := packetContext{packetType: packetType}
+	if !c.authorize(route.auth, packetJson, &ctx) {
+		return
+	}
+
+	route.handle(c, req, ctx)
+}
+
+// fields of requests the auth rules look at
+type authTarget struct {
+	ServerID  uint64
+	ChannelID uint64
+	MessageID uint64
+}
+
+// authorize checks the auth rule of the packet, replies to client if it fails
+func (c *WsClient) authorize(rule authRule, packetJson []byte, ctx *packetContext) bool {
+	if rule == authNone {
+		return true
+	}
+
+	var target authTarget
+	if err := json.Unmarshal(packetJson, &target); err != nil {
+		c.reply(macros.ErrorDeserializing(err.Error(), ctx.packetType, c.UserID))
+		return false
+	}
+
+	if rule == authSelf || rule == authModerator {
+		ctx.channelID = database.GetChannelOfMessageID(target.MessageID, c.UserID)
+		if ctx.channelID == 0 && rule == authModerator {
+			// owners can moderate any message in their server
+			channelID, _ := database.GetMessageLocation(target.MessageID)
+			if channelID != 0 && database.GetServerOwner(database.GetServerIdOfChannel(channelID)) == c.UserID {
+				ctx.channelID = channelID
+				return true
+			}
+		}
+		if ctx.channelID == 0 {
+			log.Hack("There is no message ID [%d] owned by user ID [%d]", target.MessageID, c.UserID)
+			c.reply(macros.RespondFailureReason(macros.CodeForbidden, "Message ID [%d] isn't yours", target.MessageID))
+			return false
+		}
+		return true
+	}
+
+	// requests about a channel are always checked against the server of the channel,
+	// handlers act on ChannelID so a ServerID sent along can't be trusted on its own
+	ctx.serverID = target.ServerID
+	if target.ChannelID != 0 {
+		ctx.channelID = target.ChannelID
+		ctx.serverID = database.GetServerIdOfChannel(target.ChannelID)
+		if ctx.serverID == 0 {
+			c.reply(macros.RespondFailureReason(macros.CodeNotFound, "Channel ID [%d] doesn't exist", target.ChannelID))
+			return false
+		}
+		if target.ServerID != 0 && target.ServerID != ctx.serverID {
+			log.Hack("User ID [%d] sent packet type [%d] with channel ID [%d] that isn't in server ID [%d]", c.UserID, ctx.packetType, target.ChannelID, target.ServerID)
+			c.reply(macros.RespondFailureReason(macros.CodeValidation, "Channel ID [%d] isn't in server ID [%d]", target.ChannelID, target.ServerID))
+			return false
+		}
+	}
+	if ctx.serverID == 0 {
+		c.reply(macros.RespondFailureReason(macros.CodeValidation, "Packet type [%d] needs a ServerID or ChannelID", ctx.packetType))
+		return false
+	}
+
+	switch rule {
+	case authMember:
+		if !database.ConfirmServerMembership(c.UserID, ctx.serverID) {
+			c.reply(macros.RespondFailureReason(macros.CodeNotMember, "Not a member of server ID [%d]", ctx.serverID))
+			return false
+		}
+	case authOwner:
+		if database.GetServerOwner(ctx.serverID) != c.UserID {
+			log.Hack("User ID [%d] sent packet type [%d] for server ID [%d] that they don't own", c.UserID, ctx.packetType, ctx.serverID)
+			c.reply(macros.RespondFailureReason(macros.CodeNotOwner, "Not the owner of server ID [%d]", ctx.serverID))
+			return false
+		}
+	}
+	return true
+}
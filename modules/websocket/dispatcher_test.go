@@ -0,0 +1,318 @@
+package websocket
+
+import (
+	"chat-app/modules/database"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const (
+	testOwnerID    uint64 = 101 // owns testServerID
+	testMemberID   uint64 = 102 // member of testServerID
+	testOutsiderID uint64 = 103 // owns otherServerID, not a member of testServerID
+
+	testServerID   uint64 = 201
+	testChannelID  uint64 = 301
+	otherServerID  uint64 = 202
+	otherChannelID uint64 = 302
+
+	memberMessageID uint64 = 401
+	ownerMessageID  uint64 = 402
+	otherMessageID  uint64 = 403
+)
+
+var authFixturesAdded bool
+
+func addAuthFixtures(t *testing.T) {
+	if authFixturesAdded {
+		return
+	}
+	authFixturesAdded = true
+
+	var rows = []any{
+		database.User{UserID: testOwnerID, Username: "owner", Password: []byte("x")},
+		database.User{UserID: testMemberID, Username: "member", Password: []byte("x")},
+		database.User{UserID: testOutsiderID, Username: "outsider", Password: []byte("x")},
+		database.Server{ServerID: testServerID, UserID: testOwnerID, Name: "server"},
+		database.Server{ServerID: otherServerID, UserID: testOutsiderID, Name: "other server"},
+		database.Channel{ChannelID: testChannelID, ServerID: testServerID, Name: "channel"},
+		database.Channel{ChannelID: otherChannelID, ServerID: otherServerID, Name: "other channel"},
+		database.ServerMemberShort{ServerID: testServerID, UserID: testOwnerID},
+		database.ServerMemberShort{ServerID: testServerID, UserID: testMemberID},
+		database.ServerMemberShort{ServerID: otherServerID, UserID: testOutsiderID},
+		database.Message{MessageID: memberMessageID, ChannelID: testChannelID, UserID: testMemberID, Message: "hi"},
+		database.Message{MessageID: ownerMessageID, ChannelID: testChannelID, UserID: testOwnerID, Message: "hello"},
+		database.Message{MessageID: otherMessageID, ChannelID: otherChannelID, UserID: testOutsiderID, Message: "hey"},
+	}
+	for i := 0; i < len(rows); i++ {
+		if err := database.Insert(rows[i]); err != nil {
+			t.Fatalf("inserting fixture %T: %v", rows[i], err)
+		}
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	addAuthFixtures(t)
+
+	tests := []struct {
+		name          string
+		rule          authRule
+		userID        uint64
+		json          string
+		allowed       bool
+		wantServerID  uint64
+		wantChannelID uint64
+	}{
+		{"none needs nothing", authNone, testOutsiderID, `{}`, true, 0, 0},
+
+		{"self on own message", authSelf, testMemberID, fmt.Sprintf(`{"MessageID":%d}`, memberMessageID), true, 0, testChannelID},
+		{"self on message of someone else", authSelf, testMemberID, fmt.Sprintf(`{"MessageID":%d}`, ownerMessageID), false, 0, 0},
+		{"self as owner on message of member", authSelf, testOwnerID, fmt.Sprintf(`{"MessageID":%d}`, memberMessageID), false, 0, 0},
+		{"self on missing message", authSelf, testMemberID, `{"MessageID":999}`, false, 0, 0},
+
+		{"moderator on own message", authModerator, testMemberID, fmt.Sprintf(`{"MessageID":%d}`, memberMessageID), true, 0, testChannelID},
+		{"moderator as owner on message of member", authModerator, testOwnerID, fmt.Sprintf(`{"MessageID":%d}`, memberMessageID), true, 0, testChannelID},
+		{"moderator as member on message of owner", authModerator, testMemberID, fmt.Sprintf(`{"MessageID":%d}`, ownerMessageID), false, 0, 0},
+		{"moderator as owner on message in another server", authModerator, testOwnerID, fmt.Sprintf(`{"MessageID":%d}`, otherMessageID), false, 0, 0},
+
+		{"member by server", authMember, testMemberID, fmt.Sprintf(`{"ServerID":%d}`, testServerID), true, testServerID, 0},
+		{"member by channel", authMember, testMemberID, fmt.Sprintf(`{"ChannelID":%d}`, testChannelID), true, testServerID, testChannelID},
+		{"member by matching server and channel", authMember, testMemberID, fmt.Sprintf(`{"ServerID":%d,"ChannelID":%d}`, testServerID, testChannelID), true, testServerID, testChannelID},
+		{"member of another server by server", authMember, testOutsiderID, fmt.Sprintf(`{"ServerID":%d}`, testServerID), false, 0, 0},
+		{"member of another server by channel", authMember, testOutsiderID, fmt.Sprintf(`{"ChannelID":%d}`, testChannelID), false, 0, 0},
+		{"member without server or channel", authMember, testMemberID, `{}`, false, 0, 0},
+		{"member on missing channel", authMember, testMemberID, `{"ChannelID":999}`, false, 0, 0},
+
+		{"owner by server", authOwner, testOwnerID, fmt.Sprintf(`{"ServerID":%d}`, testServerID), true, testServerID, 0},
+		{"owner by channel", authOwner, testOwnerID, fmt.Sprintf(`{"ChannelID":%d}`, testChannelID), true, testServerID, testChannelID},
+		{"owner as member", authOwner, testMemberID, fmt.Sprintf(`{"ChannelID":%d}`, testChannelID), false, 0, 0},
+
+		// the server of a channel comes from the channel, a ServerID sent along has to match it
+		{"member with own server and channel of another server", authMember, testMemberID, fmt.Sprintf(`{"ServerID":%d,"ChannelID":%d}`, testServerID, otherChannelID), false, 0, 0},
+		{"owner with own server and channel of another server", authOwner, testOwnerID, fmt.Sprintf(`{"ServerID":%d,"ChannelID":%d}`, testServerID, otherChannelID), false, 0, 0},
+		{"outsider with other server and channel of server", authOwner, testOutsiderID, fmt.Sprintf(`{"ServerID":%d,"ChannelID":%d}`, otherServerID, testChannelID), false, 0, 0},
+	}
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestClient(uint64(i+1), tt.userID)
+			ctx := packetContext{packetType: ADD_CHAT_MESSAGE}
+
+			allowed := c.authorize(tt.rule, []byte(tt.json), &ctx)
+			if allowed != tt.allowed {
+				t.Fatalf("authorize returned %v, want %v", allowed, tt.allowed)
+			}
+
+			if !tt.allowed {
+				// client is told why the packet was rejected
+				select {
+				case packet := <-c.WriteChan:
+					if packet[4] != 0 {
+						t.Fatalf("rejection sent as packet type %d, want 0", packet[4])
+					}
+				default:
+					t.Fatal("no rejection was sent to client")
+				}
+				return
+			}
+
+			if ctx.serverID != tt.wantServerID {
+				t.Errorf("ctx.serverID = %d, want %d", ctx.serverID, tt.wantServerID)
+			}
+			if ctx.channelID != tt.wantChannelID {
+				t.Errorf("ctx.channelID = %d, want %d", ctx.channelID, tt.wantChannelID)
+			}
+			if len(c.WriteChan) != 0 {
+				t.Errorf("[%d] packets were sent to client on an allowed packet", len(c.WriteChan))
+			}
+		})
+	}
+}
+
+// handlers whose result is only broadcast still answer a request that has an ID
+func TestBroadcastRepliesWithRequestID(t *testing.T) {
+	addAuthFixtures(t)
+
+	tests := []struct {
+		name       string
+		userID     uint64
+		packetType byte
+		json       string
+	}{
+		{"add reaction", testMemberID, ADD_REACTION, fmt.Sprintf(`{"ChannelID":%d,"MessageID":%d,"Emoji":"+1"}`, testChannelID, ownerMessageID)},
+		{"remove reaction", testMemberID, REMOVE_REACTION, fmt.Sprintf(`{"ChannelID":%d,"MessageID":%d,"Emoji":"+1"}`, testChannelID, ownerMessageID)},
+		{"pin", testOwnerID, PIN_MESSAGE, fmt.Sprintf(`{"ChannelID":%d,"MessageID":%d}`, testChannelID, memberMessageID)},
+		{"unpin", testOwnerID, UNPIN_MESSAGE, fmt.Sprintf(`{"ChannelID":%d,"MessageID":%d}`, testChannelID, memberMessageID)},
+		{"ack channel", testMemberID, ACK_CHANNEL, fmt.Sprintf(`{"ChannelID":%d,"MessageID":%d}`, testChannelID, ownerMessageID)},
+		{"update channel", testOwnerID, UPDATE_CHANNEL_DATA, fmt.Sprintf(`{"ChannelID":%d,"Topic":"about","NewTP":true}`, testChannelID)},
+	}
+
+	const reqID uint32 = 77
+	for i, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := newTestClient(uint64(9000+i), test.userID)
+			c.reqID = reqID
+			c.dispatch(test.packetType, []byte(test.json))
+
+			replies := drain(c)
+			for len(broadcastChan) > 0 {
+				<-broadcastChan
+			}
+			if len(replies) != 1 {
+				t.Fatalf("got %d replies, want 1", len(replies))
+			}
+			reply := replies[0]
+			endIndex := binary.LittleEndian.Uint32(reply[:4])
+			if reply[4] != test.packetType {
+				t.Errorf("reply is packet type %d, want %d: %s", reply[4], test.packetType, reply[5:endIndex])
+			}
+			if len(reply) != int(endIndex)+4 || binary.LittleEndian.Uint32(reply[endIndex:]) != reqID {
+				t.Errorf("reply isn't tagged with request ID %d", reqID)
+			}
+		})
+	}
+}
+
+// a channel update with one invalid field leaves the other fields as they were
+func TestRejectedChannelUpdateChangesNothing(t *testing.T) {
+	addAuthFixtures(t)
+
+	tests := []string{
+		fmt.Sprintf(`{"ChannelID":%d,"Name":"renamed","NewCN":true,"RetentionDays":-1,"NewRD":true}`, testChannelID),
+		fmt.Sprintf(`{"ChannelID":%d,"Name":"renamed","NewCN":true,"Topic":"%s","NewTP":true}`, testChannelID, strings.Repeat("a", maxTopicLength+1)),
+	}
+
+	for _, test := range tests {
+		c := newTestClient(9100, testOwnerID)
+		c.dispatch(UPDATE_CHANNEL_DATA, []byte(test))
+
+		replies := drain(c)
+		if len(replies) != 1 || replies[0][4] != 0 {
+			t.Errorf("%s wasn't rejected", test)
+		}
+		if len(broadcastChan) != 0 {
+			<-broadcastChan
+			t.Errorf("%s was broadcast", test)
+		}
+
+		var name string
+		if err := database.Conn.QueryRow("SELECT name FROM channels WHERE channel_id = ?", testChannelID).Scan(&name); err != nil {
+			t.Fatal(err)
+		}
+		if name != "channel" {
+			t.Errorf("%s changed the name to %s", test, name)
+		}
+	}
+}
+
+// owner pinning many messages at once can't go over the pin limit of the channel
+func TestConcurrentPinsStayUnderLimit(t *testing.T) {
+	addAuthFixtures(t)
+
+	const pinChannelID uint64 = 303
+	const firstMessageID uint64 = 5001
+	const messages = database.MaxPinsPerChannel + 10
+
+	if err := database.Insert(database.Channel{ChannelID: pinChannelID, ServerID: testServerID, Name: "pins"}); err != nil {
+		t.Fatal(err)
+	}
+	// messages and pins of the channel are deleted with it
+	defer database.Conn.Exec("DELETE FROM channels WHERE channel_id = ?", pinChannelID)
+	for i := uint64(0); i < messages; i++ {
+		message := database.Message{MessageID: firstMessageID + i, ChannelID: pinChannelID, UserID: testOwnerID, Message: "pin me"}
+		if err := database.Insert(message); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// handler is called directly, dispatching this many pins would be rate limited
+	var wg sync.WaitGroup
+	for i := uint64(0); i < messages; i++ {
+		wg.Add(1)
+		go func(messageID uint64) {
+			defer wg.Done()
+			c := newTestClient(9200+messageID, testOwnerID)
+			c.onPinMessageRequest(PinRequest{ChannelID: pinChannelID, MessageID: messageID}, packetContext{packetType: PIN_MESSAGE})
+		}(firstMessageID + i)
+	}
+	wg.Wait()
+
+	var broadcasts int
+	for len(broadcastChan) > 0 {
+		<-broadcastChan
+		broadcasts++
+	}
+	if broadcasts != database.MaxPinsPerChannel {
+		t.Errorf("%d pins were broadcast, want %d", broadcasts, database.MaxPinsPerChannel)
+	}
+
+	var count int
+	if err := database.Conn.QueryRow("SELECT COUNT(*) FROM pins WHERE channel_id = ?", pinChannelID).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != database.MaxPinsPerChannel {
+		t.Errorf("channel has %d pins, want %d", count, database.MaxPinsPerChannel)
+	}
+
+	var pinnedID uint64
+	if err := database.Conn.QueryRow("SELECT message_id FROM pins WHERE channel_id = ? LIMIT 1", pinChannelID).Scan(&pinnedID); err != nil {
+		t.Fatal(err)
+	}
+	if result := database.AddPin(database.Pin{MessageID: pinnedID, ChannelID: pinChannelID}); result != database.PinAlreadyPinned {
+		t.Errorf("pinning message ID [%d] again returned %d, want PinAlreadyPinned", pinnedID, result)
+	}
+}
+
+// chat history tells if there are more messages on either side of the page
+func TestChatHistoryMoreFlags(t *testing.T) {
+	addAuthFixtures(t)
+
+	const historyChannelID uint64 = 304
+	const firstMessageID uint64 = 6001
+	const messages = 5
+
+	if err := database.Insert(database.Channel{ChannelID: historyChannelID, ServerID: testServerID, Name: "history"}); err != nil {
+		t.Fatal(err)
+	}
+	defer database.Conn.Exec("DELETE FROM channels WHERE channel_id = ?", historyChannelID)
+	for i := uint64(0); i < messages; i++ {
+		message := database.Message{MessageID: firstMessageID + i, ChannelID: historyChannelID, UserID: testMemberID, Message: "hi"}
+		if err := database.Insert(message); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name      string
+		page      database.HistoryPage
+		moreOlder bool
+		moreNewer bool
+	}{
+		{"latest", database.HistoryPage{Direction: database.HistoryLatest, Limit: 2}, true, false},
+		{"whole channel", database.HistoryPage{Direction: database.HistoryLatest, Limit: messages}, false, false},
+		{"before", database.HistoryPage{FromID: firstMessageID + 2, Direction: database.HistoryBefore, Limit: 2}, false, false},
+		{"after", database.HistoryPage{FromID: firstMessageID, Direction: database.HistoryAfter, Limit: 2}, false, true},
+		{"after to the end", database.HistoryPage{FromID: firstMessageID + 2, Direction: database.HistoryAfter, Limit: 2}, false, false},
+		{"around", database.HistoryPage{FromID: firstMessageID + 2, Direction: database.HistoryAround, Limit: 2}, true, true},
+	}
+
+	for _, test := range tests {
+		var history []json.RawMessage
+		if err := json.Unmarshal(database.GetChatHistory(historyChannelID, test.page, testMemberID), &history); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if len(history) != 4 {
+			t.Fatalf("%s: history has %d elements, want 4", test.name, len(history))
+		}
+		if got := string(history[2]) == "true"; got != test.moreOlder {
+			t.Errorf("%s: more older is %v, want %v", test.name, got, test.moreOlder)
+		}
+		if got := string(history[3]) == "true"; got != test.moreNewer {
+			t.Errorf("%s: more newer is %v, want %v", test.name, got, test.moreNewer)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package websocket
+
+import (
+	"chat-app/modules/clients"
+	"chat-app/modules/database"
+	log "chat-app/modules/logging"
+	"chat-app/modules/macros"
+	"chat-app/modules/pictures"
+	"encoding/json"
+	"regexp"
+)
+
+// shortcodes are written as :shortcode: in messages
+var emojiShortcodeRegex = regexp.MustCompile(`^[a-zA-Z0-9_]{2,32}$`)
+
+type EmojiListRequest struct {
+	ServerID uint64
+}
+
+type EmojiUpdateRequest struct {
+	ServerID  uint64
+	EmojiID   uint64
+	Shortcode string // new shortcode of the emoji
+	Delete    bool
+}
+
+// what members of the server are told when an emoji is added, renamed or deleted
+type emojiUpdate struct {
+	ServerID uint64
+	Emoji    database.ServerEmoji
+	Deleted  bool
+}
+
+func CheckEmojiShortcode(shortcode string) bool {
+	return emojiShortcodeRegex.MatchString(shortcode)
+}
+
+// when client requests custom emoji of a server, type 27
+func (c *WsClient) onEmojiListRequest(req EmojiListRequest, ctx packetContext) {
+	type EmojiListResponse struct {
+		ServerID uint64
+		Emoji    []database.ServerEmoji
+	}
+
+	jsonBytes, err := json.Marshal(EmojiListResponse{
+		ServerID: ctx.serverID,
+		Emoji:    database.GetServerEmoji(ctx.serverID),
+	})
+	if err != nil {
+		macros.ErrorSerializing(err.Error(), ctx.packetType, c.UserID)
+		return
+	}
+
+	c.reply(macros.PreparePacket(ctx.packetType, jsonBytes))
+}
+
+// when server owner renames or deletes a custom emoji, type 28,
+// emoji are added by uploading their picture
+func (c *WsClient) onEmojiUpdateRequest(req EmojiUpdateRequest, ctx packetContext) {
+	emoji, exists := database.GetEmoji(req.EmojiID, ctx.serverID)
+	if !exists {
+		c.reply(macros.RespondFailureReason(macros.CodeNotFound, "Emoji ID [%d] doesn't exist in server ID [%d]", req.EmojiID, ctx.serverID))
+		return
+	}
+
+	if req.Delete {
+		if !database.DeleteServerEmoji(req.EmojiID, ctx.serverID) {
+			c.reply(macros.RespondFailureReason(macros.CodeFailed, "Failed deleting emoji ID [%d]", req.EmojiID))
+			return
+		}
+		log.Trace("User ID [%d] deleted emoji [%s] of server ID [%d]", c.UserID, emoji.Shortcode, ctx.serverID)
+
+		if !database.IsEmojiFileUsed(emoji.FileName) {
+			pictures.RemoveEmoji(emoji.FileName)
+		}
+		c.replyBroadcast(broadcastEmojiUpdate(emojiUpdate{ServerID: ctx.serverID, Emoji: emoji, Deleted: true}))
+		return
+	}
+
+	if !CheckEmojiShortcode(req.Shortcode) {
+		c.reply(macros.RespondFailureReason(macros.CodeValidation, "Shortcode has to be 2 to 32 letters, numbers or underscores"))
+		return
+	}
+	if !database.RenameServerEmoji(req.EmojiID, ctx.serverID, req.Shortcode) {
+		c.reply(macros.RespondFailureReason(macros.CodeFailed, "Server ID [%d] already has an emoji named [%s]", ctx.serverID, req.Shortcode))
+		return
+	}
+	log.Trace("User ID [%d] renamed emoji [%s] of server ID [%d] to [%s]", c.UserID, emoji.Shortcode, ctx.serverID, req.Shortcode)
+
+	emoji.Shortcode = req.Shortcode
+	c.replyBroadcast(broadcastEmojiUpdate(emojiUpdate{ServerID: ctx.serverID, Emoji: emoji}))
+}
+
+// OnServerEmojiAdded tells members of the server about an emoji uploaded to it
+func OnServerEmojiAdded(emoji database.ServerEmoji) {
+	broadcastEmojiUpdate(emojiUpdate{ServerID: emoji.ServerID, Emoji: emoji})
+}
+
+// broadcastEmojiUpdate returns the broadcast packet
+func broadcastEmojiUpdate(update emojiUpdate) []byte {
+	jsonBytes, err := json.Marshal(update)
+	if err != nil {
+		macros.ErrorSerializing(err.Error(), EMOJI_UPDATE, update.ServerID)
+		return nil
+	}
+
+	// members that aren't viewing the server still need them for autocomplete and notifications
+	members := database.GetServerMembersList(update.ServerID)
+	onlineMembers := clients.FilterOnlineMembers(members)
+
+	packet := macros.PreparePacket(EMOJI_UPDATE, jsonBytes)
+	broadcastChan <- BroadcastData{
+		MessageBytes:   packet,
+		Type:           EMOJI_UPDATE,
+		AffectedUserID: onlineMembers,
+	}
+	return packet
+}
@@ -127,10 +127,11 @@ func OnUserJoinedServer(userID uint64, serverID uint64) {
 	serverData := database.GetServerData(serverID)
 
 	var dataOfServer = database.JoinedServer{
-		ServerID: serverID,
-		Name:     serverData.Name,
-		Picture:  serverData.Picture,
-		Banner:   serverData.Banner,
+		ServerID:      serverID,
+		Name:          serverData.Name,
+		Picture:       serverData.Picture,
+		Banner:        serverData.Banner,
+		RetentionDays: serverData.RetentionDays,
 	}
 
 	if userID == serverData.UserID {
@@ -0,0 +1,93 @@
+package websocket
+
+import (
+	log "chat-app/modules/logging"
+	"chat-app/modules/macros"
+	"encoding/json"
+)
+
+const (
+	protocolVersion    = 1 // version of the packet framing the server speaks
+	minProtocolVersion = 1 // clients older than this are disconnected
+
+	closeUnsupportedVersion = 4001 // websocket close code sent to clients with a too old protocol version
+)
+
+// optional features a client can ask for in HELLO
+const (
+	featureCompression   uint32 = 1 << iota // permessage-deflate compression of sent packets
+	featureResume                           // sequence numbers after packets, makes resuming the session possible
+	featureBinaryPayload                    // payloads are CBOR instead of JSON in both directions, except HELLO
+)
+
+var featureNames = map[string]uint32{
+	"compression": featureCompression,
+	"resume":      featureResume,
+	"binary":      featureBinaryPayload,
+}
+
+// clients that don't send HELLO get what the server always did before handshakes existed
+const legacyFeatures = featureCompression | featureResume
+
+func (c *WsClient) hasFeature(feature uint32) bool {
+	return c.features.Load()&feature != 0
+}
+
+type HelloRequest struct {
+	Version  uint32
+	Features []string
+}
+
+// when client tells what protocol version and features it supports, type 240,
+// client is kicked if its version is too old
+func (c *WsClient) onHelloRequest(req HelloRequest, ctx packetContext) {
+	if c.helloReceived {
+		c.reply(macros.RespondFailureReason(macros.CodeValidation, "Handshake was already done"))
+		return
+	}
+	c.helloReceived = true
+
+	if req.Version < minProtocolVersion {
+		log.Debug("Session ID [%d] of user ID [%d] uses protocol version [%d], minimum is [%d]", c.SessionID, c.UserID, req.Version, minProtocolVersion)
+		if err := c.Conn.Disconnect(closeUnsupportedVersion, "Protocol version is not supported anymore", 0); err != nil {
+			log.WarnError(err.Error(), "Error sending close message to session ID [%d]", c.SessionID)
+		}
+		c.kicked = true
+		return
+	}
+
+	// newer clients are downgraded to what the server knows,
+	// it's up to them to decide if they can continue with it
+	var version uint32 = req.Version
+	if version > protocolVersion {
+		version = protocolVersion
+	}
+
+	// features the server doesn't know are left out of the reply
+	var features uint32 = 0
+	var accepted = []string{}
+	for i := 0; i < len(req.Features); i++ {
+		feature, known := featureNames[req.Features[i]]
+		if !known || features&feature != 0 {
+			continue
+		}
+		features |= feature
+		accepted = append(accepted, req.Features[i])
+	}
+	c.features.Store(features)
+
+	log.Trace("Session ID [%d] of user ID [%d] negotiated protocol version [%d] with features %v", c.SessionID, c.UserID, version, accepted)
+
+	type HelloResponse struct {
+		Version  uint32
+		Features []string
+	}
+
+	jsonBytes, err := json.Marshal(HelloResponse{Version: version, Features: accepted})
+	if err != nil {
+		macros.ErrorSerializing(err.Error(), ctx.packetType, c.UserID)
+		return
+	}
+
+	c.reply(macros.PreparePacket(ctx.packetType, jsonBytes))
+}
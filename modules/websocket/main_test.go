@@ -0,0 +1,37 @@
+package websocket
+
+import (
+	"chat-app/modules/database"
+	"os"
+	"testing"
+)
+
+// tests run against a fresh sqlite database in a temporary folder
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "chat-app-test")
+	if err != nil {
+		panic(err)
+	}
+	if err = os.Chdir(dir); err != nil {
+		panic(err)
+	}
+
+	database.ConnectSqlite()
+	database.CreateTables()
+
+	code := m.Run()
+
+	database.CloseDatabaseConnection()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// newTestClient makes a session that isn't connected, packets sent to it wait in WriteChan
+func newTestClient(sessionID uint64, userID uint64) *WsClient {
+	c := &WsClient{
+		SessionID: sessionID,
+		UserID:    userID,
+	}
+	c.initOutbound()
+	return c
+}
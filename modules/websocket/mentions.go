@@ -0,0 +1,126 @@
+package websocket
+
+import (
+	"chat-app/modules/clients"
+	"chat-app/modules/database"
+	log "chat-app/modules/logging"
+	"chat-app/modules/macros"
+	"encoding/json"
+	"regexp"
+	"strconv"
+)
+
+// users are mentioned as <@userID>, @everyone mentions every member of the server,
+// @here only the ones that are online
+var userMentionRegex = regexp.MustCompile(`<@(\d+)>`)
+var groupMentionRegex = regexp.MustCompile(`(^|\s)@(everyone|here)\b`)
+
+type AckMentionRequest struct {
+	MessageID uint64
+}
+
+// mentionedUsers returns the members of the server mentioned in the text, without the author
+func mentionedUsers(text string, authorID uint64, serverID uint64) []uint64 {
+	userMatches := userMentionRegex.FindAllStringSubmatch(text, -1)
+	groupMatches := groupMentionRegex.FindAllStringSubmatch(text, -1)
+	if len(userMatches) == 0 && len(groupMatches) == 0 {
+		return nil
+	}
+
+	var everyone, here bool
+	for i := 0; i < len(groupMatches); i++ {
+		if groupMatches[i][2] == "everyone" {
+			everyone = true
+		} else {
+			here = true
+		}
+	}
+
+	var named = make(map[uint64]bool)
+	for i := 0; i < len(userMatches); i++ {
+		userID, err := strconv.ParseUint(userMatches[i][1], 10, 64)
+		if err == nil {
+			named[userID] = true
+		}
+	}
+
+	// mentions of users who aren't members are ignored
+	members := database.GetServerMemberIDs(serverID)
+	var mentioned []uint64
+	for i := 0; i < len(members); i++ {
+		if members[i] == authorID {
+			continue
+		}
+		if everyone || named[members[i]] || (here && clients.CheckIfUserIsOnline(members[i])) {
+			mentioned = append(mentioned, members[i])
+		}
+	}
+	return mentioned
+}
+
+// notifyMentions saves the mentions of a new message and pushes it to every session of the mentioned users,
+// no matter which channel they are looking at
+func notifyMentions(authorID uint64, text string, messageID uint64, channelID uint64, threadID uint64, serverID uint64) {
+	mentioned := mentionedUsers(text, authorID, serverID)
+	if len(mentioned) == 0 {
+		return
+	}
+
+	if !database.AddMentions(messageID, channelID, mentioned) {
+		log.Warn("Failed saving mentions of message ID [%d]", messageID)
+		return
+	}
+
+	jsonBytes, err := json.Marshal(database.MentionedMessage{
+		MessageID: messageID,
+		ChannelID: channelID,
+		ServerID:  serverID,
+		ThreadID:  threadID,
+		UserID:    authorID,
+		Message:   text,
+	})
+	if err != nil {
+		macros.ErrorSerializing(err.Error(), MENTION, authorID)
+		return
+	}
+
+	broadcastChan <- BroadcastData{
+		MessageBytes:   macros.PreparePacket(MENTION, jsonBytes),
+		Type:           MENTION,
+		AffectedUserID: mentioned,
+	}
+}
+
+// when client opens its inbox of mentions, type 82
+func (c *WsClient) onMentionInboxRequest(packetType byte) {
+	jsonBytes := database.GetMentionInbox(c.UserID)
+	if jsonBytes == nil {
+		c.reply(macros.RespondFailureReason(macros.CodeFailed, "Failed getting mentions"))
+		return
+	}
+
+	c.reply(macros.PreparePacket(packetType, jsonBytes))
+}
+
+// when client dismisses a mention from its inbox, type 83
+func (c *WsClient) onAckMentionRequest(req AckMentionRequest, ctx packetContext) {
+	if !database.AcknowledgeMention(req.MessageID, c.UserID) {
+		c.reply(macros.RespondFailureReason(macros.CodeNotFound, "No unacknowledged mention in message ID [%d]", req.MessageID))
+		return
+	}
+
+	jsonBytes, err := json.Marshal(req)
+	if err != nil {
+		macros.ErrorSerializing(err.Error(), ctx.packetType, c.UserID)
+		return
+	}
+
+	// other sessions of the user remove it from their inbox too
+	packet := macros.PreparePacket(ctx.packetType, jsonBytes)
+	c.replyBroadcast(packet)
+	broadcastChan <- BroadcastData{
+		MessageBytes:   packet,
+		Type:           ctx.packetType,
+		AffectedUserID: []uint64{c.UserID},
+	}
+}
@@ -0,0 +1,452 @@
+package websocket
+
+import (
+	"chat-app/modules/clients"
+	log "chat-app/modules/logging"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// frames sent between the instances, same layout as websocket packets:
+// 4 bytes endIndex, 1 byte type, json
+const (
+	meshHello     byte = 1 // first frame of a connection, tells who the sender is
+	meshBroadcast byte = 2 // a BroadcastData to deliver
+	meshPresence  byte = 3 // a user connected to or disconnected from the sender
+	meshChallenge byte = 4 // answer to hello, proves the receiver knows the cluster secret
+	meshAuth      byte = 5 // answer to challenge, proves the sender knows the cluster secret
+)
+
+const (
+	maxMeshFrameSize  = 16 << 20         // frames larger than this close the connection
+	meshQueueSize     = 1024             // frames waiting to be sent to a single instance
+	meshRetryInterval = 3 * time.Second  // how long to wait before connecting to an unreachable instance again
+	meshWriteTimeout  = 10 * time.Second // connection to an instance is dropped if writing takes longer
+
+	meshHandshakeTimeout = 10 * time.Second // connection is dropped if the instances don't authenticate each other in time
+	meshNonceSize        = 32
+
+	minClusterSecretLength = 16
+	maxAcceptBackoff       = time.Second // longest wait after failing to accept a connection
+)
+
+// MeshBroadcaster shares broadcasts with other instances of chat-app over plain tcp,
+// every instance connects to all the others and sends its own broadcasts to them,
+// sessions can only be resumed on the instance they were created on,
+// the cluster secret itself is never sent, both sides prove they know it by signing a nonce of the other
+type MeshBroadcaster struct {
+	nodeID  uint64
+	address string // where the other instances connect to
+	secret  []byte // has to be the same on every instance
+	peers   []*meshPeer
+	deliver func(BroadcastData)
+
+	presenceMutex sync.Mutex // keeps presence updates in order with the snapshot sent on connect
+
+	nodeConnsMutex sync.Mutex
+	nodeConns      map[uint64]net.Conn // current connection from each instance, a reconnecting one replaces its old one
+}
+
+type meshPeer struct {
+	address   string
+	frameChan chan []byte
+	resetChan chan bool // tells the writing goroutine to reconnect since frames were dropped
+}
+
+type meshHelloFrame struct {
+	NodeID uint64
+	Nonce  []byte
+}
+
+type meshChallengeFrame struct {
+	Nonce []byte
+	Proof []byte // of the nonce in hello
+}
+
+type meshAuthFrame struct {
+	Proof []byte // of the nonce in challenge
+}
+
+type meshPresenceFrame struct {
+	UserID uint64
+	Online bool
+}
+
+func NewMeshBroadcaster(nodeID uint64, address string, peerAddresses []string, secret string) *MeshBroadcaster {
+	b := &MeshBroadcaster{
+		nodeID:  nodeID,
+		address: address,
+		secret:  []byte(secret),
+
+		nodeConns: make(map[uint64]net.Conn),
+	}
+	for i := 0; i < len(peerAddresses); i++ {
+		b.peers = append(b.peers, &meshPeer{
+			address:   peerAddresses[i],
+			frameChan: make(chan []byte, meshQueueSize),
+			resetChan: make(chan bool, 1),
+		})
+	}
+	return b
+}
+
+func (b *MeshBroadcaster) Start(deliver func(BroadcastData)) error {
+	b.deliver = deliver
+
+	// anyone who can reach the cluster address could publish broadcasts with a guessable secret
+	if len(b.secret) < minClusterSecretLength {
+		return fmt.Errorf("ClusterSecret has to be at least %d characters long when ClusterPeers is set", minClusterSecretLength)
+	}
+
+	listener, err := net.Listen("tcp", b.address)
+	if err != nil {
+		return err
+	}
+	log.Info("Node ID [%d] listening for other instances on [%s]", b.nodeID, b.address)
+
+	go b.acceptPeers(listener)
+	for i := 0; i < len(b.peers); i++ {
+		go b.connectPeer(b.peers[i])
+	}
+	return nil
+}
+
+func (b *MeshBroadcaster) Publish(broadcastData BroadcastData) {
+	b.deliver(broadcastData)
+
+	jsonBytes, err := json.Marshal(broadcastData)
+	if err != nil {
+		log.Error("Error serializing broadcast type [%d] for other instances", broadcastData.Type)
+		return
+	}
+	b.sendToPeers(meshFrame(meshBroadcast, jsonBytes))
+}
+
+func (b *MeshBroadcaster) PublishPresence(userID uint64) {
+	b.presenceMutex.Lock()
+	defer b.presenceMutex.Unlock()
+
+	b.sendToPeers(presenceFrame(userID, clients.CheckIfUserIsOnlineLocally(userID)))
+}
+
+// sendToPeers never waits for an instance, if its queue is full the frame is dropped
+// and the connection is made again, so the instance gets a fresh presence snapshot
+func (b *MeshBroadcaster) sendToPeers(frame []byte) {
+	for i := 0; i < len(b.peers); i++ {
+		select {
+		case b.peers[i].frameChan <- frame:
+		default:
+			log.Warn("Queue of instance [%s] is full, dropping frame type [%d] and reconnecting", b.peers[i].address, frame[4])
+			select {
+			case b.peers[i].resetChan <- true:
+			default:
+			}
+		}
+	}
+}
+
+// connectPeer keeps a connection open to another instance and writes the frames meant for it
+func (b *MeshBroadcaster) connectPeer(peer *meshPeer) {
+	for {
+		conn, err := net.Dial("tcp", peer.address)
+		if err != nil {
+			log.Trace("Instance [%s] is unreachable, trying again in [%d] seconds", peer.address, int(meshRetryInterval.Seconds()))
+			b.discardFrames(peer)
+			time.Sleep(meshRetryInterval)
+			continue
+		}
+		log.Info("Connected to instance [%s]", peer.address)
+
+		if err := b.writeFrames(conn, peer); err != nil {
+			log.WarnError(err.Error(), "Lost connection to instance [%s]", peer.address)
+		}
+		conn.Close()
+	}
+}
+
+// frames published while the instance was unreachable are useless to it,
+// it learns the current presence from the snapshot after connecting
+func (b *MeshBroadcaster) discardFrames(peer *meshPeer) {
+	// reconnecting because of dropped frames isn't needed once the queue is discarded
+	select {
+	case <-peer.resetChan:
+	default:
+	}
+
+	for {
+		select {
+		case <-peer.frameChan:
+		default:
+			return
+		}
+	}
+}
+
+func (b *MeshBroadcaster) writeFrames(conn net.Conn, peer *meshPeer) error {
+	write := func(frame []byte) error {
+		conn.SetWriteDeadline(time.Now().Add(meshWriteTimeout))
+		_, err := conn.Write(frame)
+		return err
+	}
+
+	if err := b.authenticateToPeer(conn); err != nil {
+		return err
+	}
+
+	// presence updates can't be queued while the snapshot is sent, so they arrive after it
+	b.presenceMutex.Lock()
+	b.discardFrames(peer)
+	users := clients.GetLocalOnlineUsers()
+	for i := 0; i < len(users); i++ {
+		if err := write(presenceFrame(users[i], true)); err != nil {
+			b.presenceMutex.Unlock()
+			return err
+		}
+	}
+	b.presenceMutex.Unlock()
+
+	for {
+		select {
+		case frame := <-peer.frameChan:
+			if err := write(frame); err != nil {
+				return err
+			}
+		case <-peer.resetChan:
+			return errors.New("frames were dropped since queue was full")
+		}
+	}
+}
+
+// acceptPeers waits a little longer after each failed accept so a broken listener doesn't spin,
+// returns once the listener is closed
+func (b *MeshBroadcaster) acceptPeers(listener net.Listener) {
+	var backoff time.Duration
+	for {
+		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			if backoff == 0 {
+				backoff = 5 * time.Millisecond
+			} else {
+				backoff = min(backoff*2, maxAcceptBackoff)
+			}
+			log.WarnError(err.Error(), "Error accepting connection from another instance, trying again in %s", backoff)
+			time.Sleep(backoff)
+			continue
+		}
+		backoff = 0
+		go b.readFrames(conn)
+	}
+}
+
+// readFrames receives the broadcasts and presence of another instance
+func (b *MeshBroadcaster) readFrames(conn net.Conn) {
+	defer conn.Close()
+
+	nodeID, ok := b.authenticatePeer(conn)
+	if !ok {
+		return
+	}
+	if nodeID == b.nodeID {
+		log.Error("Instance [%s] has the same node ID [%d] as this one", conn.RemoteAddr(), b.nodeID)
+		return
+	}
+
+	log.Info("Node ID [%d] connected from [%s]", nodeID, conn.RemoteAddr())
+
+	// the node sends a fresh snapshot of its users on every connection
+	b.nodeConnsMutex.Lock()
+	if oldConn, exists := b.nodeConns[nodeID]; exists {
+		oldConn.Close()
+	}
+	b.nodeConns[nodeID] = conn
+	clients.RemoveRemoteNode(nodeID)
+	b.nodeConnsMutex.Unlock()
+
+	defer func() {
+		b.nodeConnsMutex.Lock()
+		if b.nodeConns[nodeID] == conn {
+			delete(b.nodeConns, nodeID)
+			clients.RemoveRemoteNode(nodeID)
+		}
+		b.nodeConnsMutex.Unlock()
+	}()
+
+	for {
+		frameType, jsonBytes, err := readMeshFrame(conn)
+		if err != nil {
+			log.WarnError(err.Error(), "Lost connection from node ID [%d]", nodeID)
+			return
+		}
+
+		switch frameType {
+		case meshBroadcast:
+			var broadcastData BroadcastData
+			if err := json.Unmarshal(jsonBytes, &broadcastData); err != nil {
+				log.WarnError(err.Error(), "Error deserializing broadcast from node ID [%d]", nodeID)
+				continue
+			}
+			b.deliver(broadcastData)
+		case meshPresence:
+			var presence meshPresenceFrame
+			if err := json.Unmarshal(jsonBytes, &presence); err != nil {
+				log.WarnError(err.Error(), "Error deserializing presence from node ID [%d]", nodeID)
+				continue
+			}
+			// a replaced connection can't undo the snapshot of the new one
+			b.nodeConnsMutex.Lock()
+			if b.nodeConns[nodeID] == conn {
+				clients.SetRemoteUserOnline(nodeID, presence.UserID, presence.Online)
+			}
+			b.nodeConnsMutex.Unlock()
+		default:
+			log.Warn("Node ID [%d] sent unknown frame type [%d]", nodeID, frameType)
+		}
+	}
+}
+
+// authenticateToPeer is the handshake of the connecting side, it proves it knows the cluster secret
+// and checks that the instance it connected to knows it too before sending anything to it
+func (b *MeshBroadcaster) authenticateToPeer(conn net.Conn) error {
+	conn.SetDeadline(time.Now().Add(meshHandshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	nonce, err := newMeshNonce()
+	if err != nil {
+		return err
+	}
+	if err := writeMeshJson(conn, meshHello, meshHelloFrame{NodeID: b.nodeID, Nonce: nonce}); err != nil {
+		return err
+	}
+
+	var challenge meshChallengeFrame
+	if err := readMeshJson(conn, meshChallenge, &challenge); err != nil {
+		return err
+	}
+	if !hmac.Equal(challenge.Proof, b.meshProof(meshChallenge, b.nodeID, nonce)) {
+		log.Hack("Instance [%s] doesn't know the cluster secret", conn.RemoteAddr())
+		return errors.New("instance failed to prove it knows the cluster secret")
+	}
+
+	return writeMeshJson(conn, meshAuth, meshAuthFrame{Proof: b.meshProof(meshAuth, b.nodeID, challenge.Nonce)})
+}
+
+// authenticatePeer is the handshake of the accepting side, returns the node ID of the instance
+// if it proved it knows the cluster secret
+func (b *MeshBroadcaster) authenticatePeer(conn net.Conn) (uint64, bool) {
+	conn.SetDeadline(time.Now().Add(meshHandshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	var hello meshHelloFrame
+	if err := readMeshJson(conn, meshHello, &hello); err != nil || len(hello.Nonce) != meshNonceSize {
+		log.Hack("Connection from [%s] didn't start with a valid hello", conn.RemoteAddr())
+		return 0, false
+	}
+
+	nonce, err := newMeshNonce()
+	if err != nil {
+		log.WarnError(err.Error(), "Error generating nonce for connection from [%s]", conn.RemoteAddr())
+		return 0, false
+	}
+	err = writeMeshJson(conn, meshChallenge, meshChallengeFrame{
+		Nonce: nonce,
+		Proof: b.meshProof(meshChallenge, hello.NodeID, hello.Nonce),
+	})
+	if err != nil {
+		log.WarnError(err.Error(), "Error sending challenge to [%s]", conn.RemoteAddr())
+		return 0, false
+	}
+
+	var auth meshAuthFrame
+	if err := readMeshJson(conn, meshAuth, &auth); err != nil {
+		log.Hack("Connection from [%s] didn't answer the challenge", conn.RemoteAddr())
+		return 0, false
+	}
+	if !hmac.Equal(auth.Proof, b.meshProof(meshAuth, hello.NodeID, nonce)) {
+		log.Hack("Connection from [%s] doesn't know the cluster secret", conn.RemoteAddr())
+		return 0, false
+	}
+
+	return hello.NodeID, true
+}
+
+// meshProof signs a nonce with the cluster secret, the frame type it's sent in is signed too
+// so a proof can't be reflected back as the answer to the other side's own challenge
+func (b *MeshBroadcaster) meshProof(frameType byte, nodeID uint64, nonce []byte) []byte {
+	mac := hmac.New(sha256.New, b.secret)
+	mac.Write([]byte{frameType})
+	mac.Write(binary.LittleEndian.AppendUint64(nil, nodeID))
+	mac.Write(nonce)
+	return mac.Sum(nil)
+}
+
+func newMeshNonce() ([]byte, error) {
+	var nonce = make([]byte, meshNonceSize)
+	_, err := rand.Read(nonce)
+	return nonce, err
+}
+
+func writeMeshJson(writer io.Writer, frameType byte, v any) error {
+	jsonBytes, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = writer.Write(meshFrame(frameType, jsonBytes))
+	return err
+}
+
+func readMeshJson(reader io.Reader, frameType byte, v any) error {
+	receivedType, jsonBytes, err := readMeshFrame(reader)
+	if err != nil {
+		return err
+	}
+	if receivedType != frameType {
+		return errors.New("unexpected frame type")
+	}
+	return json.Unmarshal(jsonBytes, v)
+}
+
+func meshFrame(frameType byte, jsonBytes []byte) []byte {
+	var frame []byte = make([]byte, 5+len(jsonBytes))
+	binary.LittleEndian.PutUint32(frame, uint32(len(frame)))
+	frame[4] = frameType
+	copy(frame[5:], jsonBytes)
+	return frame
+}
+
+func presenceFrame(userID uint64, online bool) []byte {
+	jsonBytes, err := json.Marshal(meshPresenceFrame{UserID: userID, Online: online})
+	if err != nil {
+		log.Error("Error serializing presence of user ID [%d]", userID)
+	}
+	return meshFrame(meshPresence, jsonBytes)
+}
+
+func readMeshFrame(reader io.Reader) (byte, []byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(reader, header[:]); err != nil {
+		return 0, nil, err
+	}
+
+	var endIndex uint32 = binary.LittleEndian.Uint32(header[:4])
+	if endIndex < 5 || endIndex > maxMeshFrameSize {
+		return 0, nil, errors.New("invalid frame size")
+	}
+
+	var jsonBytes []byte = make([]byte, endIndex-5)
+	if _, err := io.ReadFull(reader, jsonBytes); err != nil {
+		return 0, nil, err
+	}
+	return header[4], jsonBytes, nil
+}
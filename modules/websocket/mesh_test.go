@@ -0,0 +1,178 @@
+package websocket
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// tappedConn keeps a copy of everything written to the connection
+type tappedConn struct {
+	net.Conn
+	mutex *sync.Mutex
+	sent  *bytes.Buffer
+}
+
+func (c tappedConn) Write(b []byte) (int, error) {
+	c.mutex.Lock()
+	c.sent.Write(b)
+	c.mutex.Unlock()
+	return c.Conn.Write(b)
+}
+
+type handshakeResult struct {
+	dialerErr error  // what the connecting side decided
+	nodeID    uint64 // what the accepting side decided
+	accepted  bool
+	sent      []byte // everything both sides wrote
+}
+
+// handshake runs both sides of the mesh handshake over an in-memory connection
+func handshake(dialer *MeshBroadcaster, acceptor *MeshBroadcaster) handshakeResult {
+	var mutex sync.Mutex
+	var sent bytes.Buffer
+	dialerConn, acceptorConn := net.Pipe()
+
+	var result handshakeResult
+	done := make(chan bool)
+	go func() {
+		result.nodeID, result.accepted = acceptor.authenticatePeer(tappedConn{acceptorConn, &mutex, &sent})
+		// a rejected connection is closed so the other side stops waiting
+		acceptorConn.Close()
+		done <- true
+	}()
+
+	result.dialerErr = dialer.authenticateToPeer(tappedConn{dialerConn, &mutex, &sent})
+	dialerConn.Close()
+	<-done
+
+	result.sent = sent.Bytes()
+	return result
+}
+
+func TestMeshHandshake(t *testing.T) {
+	const secret = "cluster secret"
+	first := NewMeshBroadcaster(1, "", nil, secret)
+	second := NewMeshBroadcaster(2, "", nil, secret)
+	impostor := NewMeshBroadcaster(3, "", nil, "wrong secret")
+
+	result := handshake(first, second)
+	if result.dialerErr != nil || !result.accepted {
+		t.Fatalf("instances with the same secret didn't authenticate each other, dialer: %v, acceptor: %v", result.dialerErr, result.accepted)
+	}
+	if result.nodeID != 1 {
+		t.Errorf("acceptor got node ID %d, want 1", result.nodeID)
+	}
+	if bytes.Contains(result.sent, []byte(secret)) {
+		t.Error("cluster secret was sent during the handshake")
+	}
+
+	if result := handshake(impostor, second); result.accepted {
+		t.Error("instance with a wrong secret was accepted")
+	}
+	if result := handshake(first, impostor); result.dialerErr == nil {
+		t.Error("connected to an instance with a wrong secret")
+	}
+}
+
+// an instance that can't keep up is reconnected instead of silently missing frames
+func TestMeshReconnectsOnFullQueue(t *testing.T) {
+	const secret = "cluster secret"
+	first := NewMeshBroadcaster(1, "", []string{"second"}, secret)
+	second := NewMeshBroadcaster(2, "", nil, secret)
+	peer := first.peers[0]
+
+	frame := meshFrame(meshBroadcast, []byte("{}"))
+	for i := 0; i < meshQueueSize; i++ {
+		first.sendToPeers(frame)
+	}
+	if len(peer.resetChan) != 0 {
+		t.Fatal("reconnect was requested before the queue was full")
+	}
+	first.sendToPeers(frame)
+	if len(peer.resetChan) != 1 {
+		t.Fatal("reconnect wasn't requested after a frame was dropped")
+	}
+
+	dialerConn, acceptorConn := net.Pipe()
+	defer acceptorConn.Close()
+
+	writeErrChan := make(chan error, 1)
+	go func() {
+		writeErrChan <- first.writeFrames(dialerConn, peer)
+		dialerConn.Close()
+	}()
+
+	if _, ok := second.authenticatePeer(acceptorConn); !ok {
+		t.Fatal("handshake failed")
+	}
+
+	// queue and the reconnect request are discarded since the snapshot replaces them,
+	// frames published after it are written
+	stopPublishing := make(chan bool)
+	defer close(stopPublishing)
+	go func() {
+		for {
+			select {
+			case <-stopPublishing:
+				return
+			case <-time.After(5 * time.Millisecond):
+				first.sendToPeers(frame)
+			}
+		}
+	}()
+	for {
+		frameType, _, err := readMeshFrame(acceptorConn)
+		if err != nil {
+			t.Fatalf("error reading frames: %v", err)
+		}
+		if frameType == meshBroadcast {
+			break
+		}
+	}
+
+	peer.resetChan <- true
+	go func() {
+		// writing goroutine may still be writing a frame
+		for {
+			if _, _, err := readMeshFrame(acceptorConn); err != nil {
+				return
+			}
+		}
+	}()
+	if err := <-writeErrChan; err == nil {
+		t.Error("connection wasn't dropped after a reconnect was requested")
+	}
+}
+
+func TestMeshRefusesShortSecret(t *testing.T) {
+	for _, secret := range []string{"", "short secret"} {
+		b := NewMeshBroadcaster(1, "127.0.0.1:0", []string{"second"}, secret)
+		if err := b.Start(func(BroadcastData) {}); err == nil {
+			t.Errorf("started with secret %q", secret)
+		}
+	}
+}
+
+// closing the listener stops accepting instead of failing to accept in a loop
+func TestMeshStopsAcceptingOnClosedListener(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan bool)
+	go func() {
+		NewMeshBroadcaster(1, "", nil, "").acceptPeers(listener)
+		done <- true
+	}()
+	listener.Close()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("still accepting after the listener was closed")
+	}
+}
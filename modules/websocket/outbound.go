@@ -0,0 +1,134 @@
+package websocket
+
+import (
+	log "chat-app/modules/logging"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	maxQueuedPackets = 256     // packets waiting to be written to a session before it's disconnected
+	maxQueuedBytes   = 4 << 20 // bytes waiting to be written to a session before it's disconnected
+
+	closeSlowConsumer = 4002 // websocket close code sent to sessions that don't read their packets fast enough
+)
+
+// slowConsumerCount counts how many sessions were disconnected for overflowing their queue
+var slowConsumerCount atomic.Uint64
+
+// droppable events only matter in their latest state,
+// so a waiting one is replaced by a newer one with the same key instead of being queued again
+type coalesceKey struct {
+	packetType byte
+	userID     uint64
+	channelID  uint64
+}
+
+type outbound struct {
+	queuedBytes atomic.Int64 // size of packets in WriteChan and pending
+	overflowed  atomic.Bool  // session is being disconnected, nothing is queued anymore
+	evictChan   chan bool    // tells the writing goroutine to disconnect the session
+
+	pendingMutex  sync.Mutex
+	pending       [][]byte            // droppable events waiting to be written, in the order they arrived
+	pendingIndex  map[coalesceKey]int // where the event of a key is in pending
+	pendingSignal chan bool           // tells the writing goroutine there are pending events
+}
+
+func (c *WsClient) initOutbound() {
+	c.WriteChan = make(chan []byte, maxQueuedPackets)
+	c.evictChan = make(chan bool, 1)
+	c.pendingIndex = make(map[coalesceKey]int)
+	c.pendingSignal = make(chan bool, 1)
+}
+
+// send queues a packet for the session without blocking,
+// if the queue is full the session is disconnected instead of waiting for it
+func (c *WsClient) send(packet []byte) bool {
+	if c.overflowed.Load() {
+		return false
+	}
+
+	if c.queuedBytes.Add(int64(len(packet))) > maxQueuedBytes {
+		c.queuedBytes.Add(-int64(len(packet)))
+		c.overflow()
+		return false
+	}
+
+	select {
+	case c.WriteChan <- packet:
+		return true
+	default:
+		c.queuedBytes.Add(-int64(len(packet)))
+		c.overflow()
+		return false
+	}
+}
+
+// sendCoalesced queues a droppable event, replacing the waiting one with the same key,
+// it's dropped if the queue is full since a later event will tell the same
+func (c *WsClient) sendCoalesced(key coalesceKey, packet []byte) {
+	if c.overflowed.Load() {
+		return
+	}
+
+	c.pendingMutex.Lock()
+	index, exists := c.pendingIndex[key]
+	if exists {
+		c.queuedBytes.Add(int64(len(packet) - len(c.pending[index])))
+		c.pending[index] = packet
+	} else if c.queuedBytes.Load()+int64(len(packet)) <= maxQueuedBytes {
+		c.queuedBytes.Add(int64(len(packet)))
+		c.pendingIndex[key] = len(c.pending)
+		c.pending = append(c.pending, packet)
+	} else {
+		log.Trace("Queue of session ID [%d] is full, dropping event type [%d]", c.SessionID, key.packetType)
+	}
+	c.pendingMutex.Unlock()
+
+	select {
+	case c.pendingSignal <- true:
+	default:
+	}
+}
+
+// takePending returns the waiting droppable events and empties the list
+func (c *WsClient) takePending() [][]byte {
+	c.pendingMutex.Lock()
+	defer c.pendingMutex.Unlock()
+
+	pending := c.pending
+	c.pending = nil
+	clear(c.pendingIndex)
+
+	for i := 0; i < len(pending); i++ {
+		c.queuedBytes.Add(-int64(len(pending[i])))
+	}
+	return pending
+}
+
+// dequeued has to be called for every packet taken out of WriteChan
+func (c *WsClient) dequeued(packet []byte) {
+	c.queuedBytes.Add(-int64(len(packet)))
+}
+
+func (c *WsClient) overflow() {
+	if c.overflowed.Swap(true) {
+		return
+	}
+	count := slowConsumerCount.Add(1)
+	log.Warn("Session ID [%d] of user ID [%d] isn't reading packets fast enough, disconnecting... ([%d] slow sessions so far)", c.SessionID, c.UserID, count)
+
+	select {
+	case c.evictChan <- true:
+	default:
+	}
+}
+
+// evict is called by the writing goroutine to tell client why it's disconnected,
+// the reading goroutine stops right away since the session won't be resumed
+func (c *WsClient) evict() {
+	if err := c.Conn.Disconnect(closeSlowConsumer, "Too many packets waiting to be sent", 0); err != nil {
+		log.WarnError(err.Error(), "Error sending close message to session ID [%d]", c.SessionID)
+	}
+}
@@ -0,0 +1,170 @@
+package websocket
+
+import (
+	"chat-app/modules/clients"
+	"fmt"
+	"testing"
+)
+
+const (
+	outboundChannelID uint64 = 1_000_001
+	outboundServerID  uint64 = 1_000_002
+)
+
+// addViewingSession connects a session of the user viewing the outbound test channel,
+// the returned function disconnects it
+func addViewingSession(userID uint64) (*WsClient, func()) {
+	sessionID := clients.AddClient(userID)
+	clients.SetCurrentServerID(sessionID, outboundServerID)
+	clients.SetCurrentChannelID(sessionID, outboundChannelID, outboundServerID)
+
+	c := newTestClient(sessionID, userID)
+	wsClients.Store(sessionID, c)
+
+	return c, func() {
+		wsClients.Delete(sessionID)
+		clients.RemoveClient(sessionID)
+	}
+}
+
+// drain is what the writing goroutine of a session does with WriteChan
+func drain(c *WsClient) [][]byte {
+	var packets [][]byte
+	for {
+		select {
+		case packet := <-c.WriteChan:
+			c.dequeued(packet)
+			packets = append(packets, packet)
+		default:
+			return packets
+		}
+	}
+}
+
+// a session that never reads its packets is disconnected,
+// while everyone else in the channel keeps receiving the broadcasts
+func TestStuckSessionDoesntBlockBroadcast(t *testing.T) {
+	stuck, removeStuck := addViewingSession(1)
+	defer removeStuck()
+
+	var readers []*WsClient
+	for userID := uint64(2); userID <= 4; userID++ {
+		reader, removeReader := addViewingSession(userID)
+		defer removeReader()
+		readers = append(readers, reader)
+	}
+
+	slowBefore := slowConsumerCount.Load()
+
+	// more than the stuck session can hold
+	const broadcasts = maxQueuedPackets + 50
+	var received = make([]int, len(readers))
+	for i := 0; i < broadcasts; i++ {
+		deliverBroadcast(BroadcastData{
+			MessageBytes:    []byte(fmt.Sprintf("message %d", i)),
+			Type:            ADD_CHAT_MESSAGE,
+			AffectedChannel: outboundChannelID,
+		})
+
+		for r := 0; r < len(readers); r++ {
+			received[r] += len(drain(readers[r]))
+		}
+	}
+
+	for r := 0; r < len(readers); r++ {
+		if received[r] != broadcasts {
+			t.Errorf("session ID [%d] received %d packets, want %d", readers[r].SessionID, received[r], broadcasts)
+		}
+		if readers[r].overflowed.Load() {
+			t.Errorf("session ID [%d] that reads its packets was disconnected", readers[r].SessionID)
+		}
+	}
+
+	if !stuck.overflowed.Load() {
+		t.Fatal("stuck session wasn't disconnected")
+	}
+	select {
+	case <-stuck.evictChan:
+	default:
+		t.Error("writing goroutine of stuck session wasn't told to evict it")
+	}
+	if len(stuck.WriteChan) != maxQueuedPackets {
+		t.Errorf("stuck session has %d queued packets, want %d", len(stuck.WriteChan), maxQueuedPackets)
+	}
+	if got := slowConsumerCount.Load() - slowBefore; got != 1 {
+		t.Errorf("slow consumer count grew by %d, want 1", got)
+	}
+
+	// nothing more is queued for a session that's being disconnected
+	if stuck.send([]byte("after eviction")) {
+		t.Error("packet was queued for an evicted session")
+	}
+}
+
+// droppable events of a stuck session replace each other instead of filling its queue
+func TestStuckSessionCoalescesTyping(t *testing.T) {
+	stuck, removeStuck := addViewingSession(1)
+	defer removeStuck()
+	reader, removeReader := addViewingSession(2)
+	defer removeReader()
+
+	const typingUpdates = maxQueuedPackets * 4
+	for i := 0; i < typingUpdates; i++ {
+		for _, typingUserID := range []uint64{3, 4} {
+			deliverBroadcast(BroadcastData{
+				MessageBytes:    []byte(fmt.Sprintf("user %d typing %d", typingUserID, i)),
+				Type:            STARTED_TYPING,
+				AffectedChannel: outboundChannelID,
+				SourceUserID:    typingUserID,
+			})
+		}
+		if events := reader.takePending(); len(events) != 2 {
+			t.Fatalf("session that reads its packets got %d typing events, want 2", len(events))
+		}
+	}
+
+	if stuck.overflowed.Load() {
+		t.Fatal("stuck session was disconnected for droppable events")
+	}
+	if len(stuck.WriteChan) != 0 {
+		t.Errorf("droppable events were queued in WriteChan, got %d packets", len(stuck.WriteChan))
+	}
+
+	pending := stuck.takePending()
+	want := []string{
+		fmt.Sprintf("user 3 typing %d", typingUpdates-1),
+		fmt.Sprintf("user 4 typing %d", typingUpdates-1),
+	}
+	if len(pending) != len(want) {
+		t.Fatalf("stuck session has %d pending events, want %d", len(pending), len(want))
+	}
+	for i := 0; i < len(want); i++ {
+		if string(pending[i]) != want[i] {
+			t.Errorf("pending event %d is %q, want %q", i, pending[i], want[i])
+		}
+	}
+	if queued := stuck.queuedBytes.Load(); queued != 0 {
+		t.Errorf("%d bytes are still counted as queued after taking pending events", queued)
+	}
+}
+
+// a session is disconnected once its queue holds too many bytes, even with few packets
+func TestSendOverflowsOnQueuedBytes(t *testing.T) {
+	c := newTestClient(1, 1)
+	packet := make([]byte, maxQueuedBytes/4)
+
+	for i := 0; i < 4; i++ {
+		if !c.send(packet) {
+			t.Fatalf("packet %d wasn't queued", i)
+		}
+	}
+	if c.send(packet) {
+		t.Fatal("packet over the byte limit was queued")
+	}
+	if !c.overflowed.Load() {
+		t.Error("session over the byte limit wasn't disconnected")
+	}
+	if len(c.WriteChan) != 4 {
+		t.Errorf("session has %d queued packets, want 4", len(c.WriteChan))
+	}
+}
@@ -0,0 +1,98 @@
+package websocket
+
+import (
+	"chat-app/modules/database"
+	log "chat-app/modules/logging"
+	"chat-app/modules/macros"
+	"encoding/json"
+	"time"
+)
+
+type PinRequest struct {
+	ChannelID uint64
+	MessageID uint64
+}
+
+type PinnedListRequest struct {
+	ChannelID uint64
+}
+
+// when server owner pins a message, type 12
+func (c *WsClient) onPinMessageRequest(req PinRequest, ctx packetContext) {
+	channelID, _ := database.GetMessageLocation(req.MessageID)
+	if channelID != req.ChannelID {
+		c.reply(macros.RespondFailureReason(macros.CodeNotFound, "Message ID [%d] isn't in channel ID [%d]", req.MessageID, req.ChannelID))
+		return
+	}
+
+	pin := database.Pin{
+		MessageID: req.MessageID,
+		ChannelID: req.ChannelID,
+		PinnedBy:  c.UserID,
+		PinnedAt:  time.Now().UnixMilli(),
+	}
+	switch database.AddPin(pin) {
+	case database.PinAlreadyPinned:
+		c.reply(macros.RespondFailureReason(macros.CodeValidation, "Message ID [%d] is already pinned", req.MessageID))
+		return
+	case database.PinLimitReached:
+		c.reply(macros.RespondFailureReason(macros.CodeValidation, "Channel can't have more than %d pinned messages", database.MaxPinsPerChannel))
+		return
+	case database.PinFailed:
+		c.reply(macros.RespondFailureReason(macros.CodeFailed, "Failed pinning message ID [%d]", req.MessageID))
+		return
+	}
+	log.Trace("User ID [%d] pinned message ID [%d] in channel ID [%d]", c.UserID, req.MessageID, req.ChannelID)
+
+	jsonBytes, err := json.Marshal(pin)
+	if err != nil {
+		macros.ErrorSerializing(err.Error(), ctx.packetType, c.UserID)
+		return
+	}
+
+	packet := macros.PreparePacket(ctx.packetType, jsonBytes)
+	c.replyBroadcast(packet)
+	broadcastChan <- BroadcastData{
+		MessageBytes:    packet,
+		Type:            ctx.packetType,
+		AffectedChannel: req.ChannelID,
+	}
+}
+
+// when server owner unpins a message, type 13
+func (c *WsClient) onUnpinMessageRequest(req PinRequest, ctx packetContext) {
+	deleted := database.Delete(database.Pin{
+		MessageID: req.MessageID,
+		ChannelID: req.ChannelID,
+	})
+	if !deleted {
+		c.reply(macros.RespondFailureReason(macros.CodeNotFound, "Message ID [%d] isn't pinned in channel ID [%d]", req.MessageID, req.ChannelID))
+		return
+	}
+	log.Trace("User ID [%d] unpinned message ID [%d] in channel ID [%d]", c.UserID, req.MessageID, req.ChannelID)
+
+	jsonBytes, err := json.Marshal(req)
+	if err != nil {
+		macros.ErrorSerializing(err.Error(), ctx.packetType, c.UserID)
+		return
+	}
+
+	packet := macros.PreparePacket(ctx.packetType, jsonBytes)
+	c.replyBroadcast(packet)
+	broadcastChan <- BroadcastData{
+		MessageBytes:    packet,
+		Type:            ctx.packetType,
+		AffectedChannel: req.ChannelID,
+	}
+}
+
+// when client opens the pinned messages of a channel, type 14
+func (c *WsClient) onPinnedListRequest(req PinnedListRequest, ctx packetContext) {
+	jsonBytes := database.GetPinnedMessages(req.ChannelID)
+	if jsonBytes == nil {
+		c.reply(macros.RespondFailureReason(macros.CodeFailed, "Failed getting pinned messages of channel ID [%d]", req.ChannelID))
+		return
+	}
+
+	c.reply(macros.PreparePacket(ctx.packetType, jsonBytes))
+}
@@ -0,0 +1,187 @@
+package websocket
+
+import (
+	"chat-app/modules/database"
+	log "chat-app/modules/logging"
+	"chat-app/modules/macros"
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+const (
+	minPollOptions      = 2
+	maxPollOptions      = 10
+	maxPollOptionLength = 100 // bytes, same as the text column
+	maxPollDuration     = 90 * 24 * time.Hour
+	pollCloseInterval   = 1 * time.Second
+)
+
+type CreatePollRequest struct {
+	MessageID uint64 // message the poll is attached to, its text is the question
+	Options   []string
+	Multiple  bool
+	Anonymous bool
+	ClosesAt  int64 // unix milliseconds, 0 if it stays open
+}
+
+type VotePollRequest struct {
+	ChannelID uint64
+	MessageID uint64
+	Options   []int // indexes of the options, empty to take the vote back
+}
+
+// pollLocation returns the channel or thread the poll of the message has to be broadcast to,
+// 0 if the message isn't in the channel
+func pollLocation(messageID uint64, channelID uint64) uint64 {
+	messageChannelID, threadID := database.GetMessageLocation(messageID)
+	if messageChannelID != channelID || messageChannelID == 0 {
+		return 0
+	}
+
+	// polls in a thread only go to sessions that have the thread open
+	if threadID != 0 {
+		return threadID
+	}
+	return channelID
+}
+
+// when client attaches a poll to its own message, type 91
+func (c *WsClient) onCreatePollRequest(req CreatePollRequest, ctx packetContext) {
+	if len(req.Options) < minPollOptions || len(req.Options) > maxPollOptions {
+		c.reply(macros.RespondFailureReason(macros.CodeValidation, "Poll has to have between %d and %d options", minPollOptions, maxPollOptions))
+		return
+	}
+	for i := 0; i < len(req.Options); i++ {
+		req.Options[i] = strings.TrimSpace(req.Options[i])
+		if req.Options[i] == "" || len(req.Options[i]) > maxPollOptionLength {
+			c.reply(macros.RespondFailureReason(macros.CodeValidation, "Poll options have to be between 1 and %d bytes", maxPollOptionLength))
+			return
+		}
+	}
+
+	now := time.Now()
+	if req.ClosesAt != 0 && (req.ClosesAt <= now.UnixMilli() || req.ClosesAt > now.Add(maxPollDuration).UnixMilli()) {
+		c.reply(macros.RespondFailureReason(macros.CodeValidation, "Close time has to be in the future and within %d days", int(maxPollDuration.Hours()/24)))
+		return
+	}
+
+	affectedChannel := pollLocation(req.MessageID, ctx.channelID)
+	if affectedChannel == 0 {
+		c.reply(macros.RespondFailureReason(macros.CodeNotFound, "Message ID [%d] doesn't exist", req.MessageID))
+		return
+	}
+
+	success := database.AddPoll(database.Poll{
+		MessageID: req.MessageID,
+		Options:   req.Options,
+		Multiple:  req.Multiple,
+		Anonymous: req.Anonymous,
+		ClosesAt:  req.ClosesAt,
+	})
+	if !success {
+		c.reply(macros.RespondFailureReason(macros.CodeFailed, "Failed adding poll to message ID [%d], maybe it already has one", req.MessageID))
+		return
+	}
+	log.Trace("User ID [%d] added a poll with [%d] options to message ID [%d]", c.UserID, len(req.Options), req.MessageID)
+
+	c.replyBroadcast(broadcastPoll(req.MessageID, ctx.channelID, affectedChannel, ctx.packetType))
+}
+
+// when client votes in a poll or changes its vote, type 92
+func (c *WsClient) onVotePollRequest(req VotePollRequest, ctx packetContext) {
+	affectedChannel := pollLocation(req.MessageID, req.ChannelID)
+	if affectedChannel == 0 {
+		c.reply(macros.RespondFailureReason(macros.CodeNotFound, "Message ID [%d] isn't in channel ID [%d]", req.MessageID, req.ChannelID))
+		return
+	}
+
+	poll, exists := database.GetPoll(req.MessageID, c.UserID)
+	if !exists {
+		c.reply(macros.RespondFailureReason(macros.CodeNotFound, "Message ID [%d] doesn't have a poll", req.MessageID))
+		return
+	}
+
+	if !poll.Multiple && len(req.Options) > 1 {
+		c.reply(macros.RespondFailureReason(macros.CodeValidation, "Poll allows voting for only one option"))
+		return
+	}
+	var chosen = make(map[int]bool)
+	for i := 0; i < len(req.Options); i++ {
+		if req.Options[i] < 0 || req.Options[i] >= len(poll.Options) || chosen[req.Options[i]] {
+			c.reply(macros.RespondFailureReason(macros.CodeValidation, "Invalid poll option [%d]", req.Options[i]))
+			return
+		}
+		chosen[req.Options[i]] = true
+	}
+
+	if !database.VotePoll(req.MessageID, c.UserID, req.Options, time.Now().UnixMilli()) {
+		c.reply(macros.RespondFailureReason(macros.CodeValidation, "Poll of message ID [%d] is closed", req.MessageID))
+		return
+	}
+
+	// the voter is told what they voted for, since anonymous polls don't show it to anyone
+	poll, _ = database.GetPoll(req.MessageID, c.UserID)
+	jsonBytes, err := json.Marshal(poll)
+	if err != nil {
+		macros.ErrorSerializing(err.Error(), ctx.packetType, c.UserID)
+		return
+	}
+	c.reply(macros.PreparePacket(ctx.packetType, jsonBytes))
+
+	broadcastPoll(req.MessageID, req.ChannelID, affectedChannel, POLL_UPDATE)
+}
+
+// broadcastPoll sends the current tally of the poll to the sessions viewing its channel or thread,
+// returns the broadcast packet, nil if there's no poll
+func broadcastPoll(messageID uint64, channelID uint64, affectedChannel uint64, packetType byte) []byte {
+	poll, exists := database.GetPoll(messageID, 0)
+	if !exists {
+		return nil
+	}
+	poll.Voted = nil
+
+	type PollResponse struct {
+		ChannelID uint64
+		database.PollState
+	}
+
+	jsonBytes, err := json.Marshal(PollResponse{
+		ChannelID: channelID,
+		PollState: poll,
+	})
+	if err != nil {
+		macros.ErrorSerializing(err.Error(), packetType, 0)
+		return nil
+	}
+
+	packet := macros.PreparePacket(packetType, jsonBytes)
+	broadcastChan <- BroadcastData{
+		MessageBytes:    packet,
+		Type:            packetType,
+		AffectedChannel: affectedChannel,
+	}
+	return packet
+}
+
+// closePolls sends the final results of polls when their close time comes, until the server shuts down
+func closePolls() {
+	defer workersWg.Done()
+	ticker := time.NewTicker(pollCloseInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-shutdownChan:
+			return
+		case <-ticker.C:
+			closed := database.CloseExpiredPolls(time.Now().UnixMilli())
+			for i := 0; i < len(closed); i++ {
+				channelID, _ := database.GetMessageLocation(closed[i])
+				if channelID != 0 {
+					broadcastPoll(closed[i], channelID, pollLocation(closed[i], channelID), POLL_UPDATE)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,221 @@
+package websocket
+
+import (
+	log "chat-app/modules/logging"
+	"chat-app/modules/macros"
+	"sync"
+	"time"
+)
+
+const (
+	closeRateLimited = 4003 // websocket close code sent to users who keep sending packets while rate limited
+
+	violationWindow   = 30 * time.Second // rate limited packets are counted in windows this long
+	limiterIdleExpiry = 10 * time.Minute // limiters of users who sent nothing for this long are forgotten
+)
+
+// RateLimit is a token bucket, Burst packets can be sent at once,
+// after that PerSecond packets are allowed every second
+type RateLimit struct {
+	PerSecond float64
+	Burst     float64
+}
+
+// RateLimits are the limits of each packet class, read from config.json,
+// limits left out of the config use the defaults
+type RateLimits struct {
+	Session RateLimit // handshake and data needed after connecting
+	Message RateLimit // sending, editing and deleting chat messages
+	Typing  RateLimit // typing indicators
+	Read    RateLimit // history, lists and subscriptions
+	Profile RateLimit // status and user data updates
+	Manage  RateLimit // changing servers, channels and friends
+
+	MaxViolations int // rate limited packets allowed in violationWindow before user is disconnected
+	KickSeconds   int // how long a disconnected user can't connect again
+}
+
+var defaultRateLimits = RateLimits{
+	Session:       RateLimit{PerSecond: 1, Burst: 10},
+	Message:       RateLimit{PerSecond: 2, Burst: 10},
+	Typing:        RateLimit{PerSecond: 1, Burst: 5},
+	Read:          RateLimit{PerSecond: 5, Burst: 30},
+	Profile:       RateLimit{PerSecond: 0.2, Burst: 5},
+	Manage:        RateLimit{PerSecond: 0.5, Burst: 10},
+	MaxViolations: 30,
+	KickSeconds:   30,
+}
+
+var rateLimits = defaultRateLimits
+
+func setRateLimits(limits RateLimits) {
+	pick := func(configured RateLimit, fallback RateLimit) RateLimit {
+		if configured.PerSecond <= 0 || configured.Burst < 1 {
+			return fallback
+		}
+		return configured
+	}
+
+	rateLimits = RateLimits{
+		Session:       pick(limits.Session, defaultRateLimits.Session),
+		Message:       pick(limits.Message, defaultRateLimits.Message),
+		Typing:        pick(limits.Typing, defaultRateLimits.Typing),
+		Read:          pick(limits.Read, defaultRateLimits.Read),
+		Profile:       pick(limits.Profile, defaultRateLimits.Profile),
+		Manage:        pick(limits.Manage, defaultRateLimits.Manage),
+		MaxViolations: limits.MaxViolations,
+		KickSeconds:   limits.KickSeconds,
+	}
+	if rateLimits.MaxViolations <= 0 {
+		rateLimits.MaxViolations = defaultRateLimits.MaxViolations
+	}
+	if rateLimits.KickSeconds <= 0 {
+		rateLimits.KickSeconds = defaultRateLimits.KickSeconds
+	}
+}
+
+func (l *RateLimits) ofClass(class rateClass) RateLimit {
+	switch class {
+	case rateMessage:
+		return l.Message
+	case rateTyping:
+		return l.Typing
+	case rateRead:
+		return l.Read
+	case rateProfile:
+		return l.Profile
+	case rateManage:
+		return l.Manage
+	default:
+		return l.Session
+	}
+}
+
+type tokenBucket struct {
+	tokens     float64
+	lastRefill time.Time
+}
+
+// take removes a token if there is one, otherwise returns how long until there will be
+func (b *tokenBucket) take(limit RateLimit, now time.Time) (bool, time.Duration) {
+	if b.lastRefill.IsZero() {
+		b.tokens = limit.Burst
+	} else {
+		b.tokens += now.Sub(b.lastRefill).Seconds() * limit.PerSecond
+		if b.tokens > limit.Burst {
+			b.tokens = limit.Burst
+		}
+	}
+	b.lastRefill = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / limit.PerSecond * float64(time.Second))
+}
+
+// userLimiter is shared by every session of the user,
+// so opening more sessions doesn't give more packets
+type userLimiter struct {
+	mutex       sync.Mutex
+	buckets     [rateClassCount]tokenBucket
+	violations  int
+	windowStart time.Time
+	kickedUntil time.Time
+	lastUsed    time.Time
+}
+
+// accessed using user ID
+var rateLimiters sync.Map
+
+func limiterOf(userID uint64) *userLimiter {
+	value, _ := rateLimiters.LoadOrStore(userID, &userLimiter{})
+	return value.(*userLimiter)
+}
+
+// take returns how long to wait if the packet isn't allowed,
+// and true as last value if the user has to be disconnected
+func (l *userLimiter) take(class rateClass, now time.Time) (bool, time.Duration, bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.lastUsed = now
+
+	allowed, retryAfter := l.buckets[class].take(rateLimits.ofClass(class), now)
+	if allowed {
+		return true, 0, false
+	}
+
+	if now.Sub(l.windowStart) > violationWindow {
+		l.windowStart = now
+		l.violations = 0
+	}
+	l.violations++
+
+	if l.violations > rateLimits.MaxViolations {
+		l.kickedUntil = now.Add(time.Duration(rateLimits.KickSeconds) * time.Second)
+		return false, retryAfter, true
+	}
+	return false, retryAfter, false
+}
+
+func (l *userLimiter) isKicked(now time.Time) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return now.Before(l.kickedUntil)
+}
+
+// checkRate takes a token from the bucket of the packet class,
+// client is told when to try again if there are none left
+func (c *WsClient) checkRate(packetType byte, class rateClass) bool {
+	allowed, retryAfter, abusive := limiterOf(c.UserID).take(class, time.Now())
+	if allowed {
+		return true
+	}
+
+	if abusive {
+		log.Hack("User ID [%d] kept sending packets while rate limited, disconnecting...", c.UserID)
+		if err := c.Conn.Disconnect(closeRateLimited, "Too many packets in a short time", 0); err != nil {
+			log.WarnError(err.Error(), "Error sending close message to session ID [%d]", c.SessionID)
+		}
+		c.kicked = true
+		return false
+	}
+
+	log.Debug("User ID [%d] is rate limited for packet type [%d], retry after [%d ms]", c.UserID, packetType, retryAfter.Milliseconds())
+	c.reply(macros.RespondRateLimited(retryAfter.Milliseconds()+1, "Too many packets of type [%d]", packetType))
+	return false
+}
+
+// allowReconnect returns false if user was disconnected for sending too many packets
+// and has to wait before connecting again
+func allowReconnect(userID uint64) bool {
+	value, exists := rateLimiters.Load(userID)
+	if exists && value.(*userLimiter).isKicked(time.Now()) {
+		log.Hack("User ID [%d] who was disconnected for spamming came back, not accepting until kick expires", userID)
+		return false
+	}
+	return true
+}
+
+// forgetIdleLimiters removes limiters of users who haven't sent anything for a while,
+// kept around until then so reconnecting doesn't refill the buckets
+func forgetIdleLimiters() {
+	ticker := time.NewTicker(limiterIdleExpiry)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		now := time.Now()
+		rateLimiters.Range(func(key, value any) bool {
+			limiter := value.(*userLimiter)
+			limiter.mutex.Lock()
+			idle := now.Sub(limiter.lastUsed) > limiterIdleExpiry && now.After(limiter.kickedUntil)
+			limiter.mutex.Unlock()
+			if idle {
+				rateLimiters.Delete(key)
+			}
+			return true
+		})
+	}
+}
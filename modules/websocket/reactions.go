@@ -0,0 +1,106 @@
+package websocket
+
+import (
+	"chat-app/modules/database"
+	"chat-app/modules/macros"
+	"encoding/json"
+	"time"
+)
+
+const maxEmojiLength = 64 // bytes, same as the emoji column
+
+type ReactionRequest struct {
+	ChannelID uint64
+	MessageID uint64
+	Emoji     string
+}
+
+// when client reacts to a message, type 10
+func (c *WsClient) onAddReactionRequest(req ReactionRequest, ctx packetContext) {
+	affectedChannel, ok := c.checkReaction(req)
+	if !ok {
+		return
+	}
+
+	err := database.Insert(database.Reaction{
+		MessageID: req.MessageID,
+		UserID:    c.UserID,
+		Emoji:     req.Emoji,
+		ReactedAt: time.Now().UnixMilli(),
+	})
+	if err != nil {
+		c.reply(macros.RespondFailureReason(macros.CodeFailed, "Failed adding reaction to message ID [%d], maybe it's already there", req.MessageID))
+		return
+	}
+
+	c.broadcastReaction(req, ctx.packetType, affectedChannel)
+}
+
+// when client takes back its reaction, type 11
+func (c *WsClient) onRemoveReactionRequest(req ReactionRequest, ctx packetContext) {
+	affectedChannel, ok := c.checkReaction(req)
+	if !ok {
+		return
+	}
+
+	deleted := database.Delete(database.Reaction{
+		MessageID: req.MessageID,
+		UserID:    c.UserID,
+		Emoji:     req.Emoji,
+	})
+	if !deleted {
+		c.reply(macros.RespondFailureReason(macros.CodeNotFound, "Message ID [%d] doesn't have that reaction from you", req.MessageID))
+		return
+	}
+
+	c.broadcastReaction(req, ctx.packetType, affectedChannel)
+}
+
+// checkReaction makes sure the message is in the channel the membership was checked for,
+// returns the channel or thread the change has to be broadcast to
+func (c *WsClient) checkReaction(req ReactionRequest) (uint64, bool) {
+	if req.Emoji == "" || len(req.Emoji) > maxEmojiLength {
+		c.reply(macros.RespondFailureReason(macros.CodeValidation, "Emoji has to be between 1 and %d bytes", maxEmojiLength))
+		return 0, false
+	}
+
+	channelID, threadID := database.GetMessageLocation(req.MessageID)
+	if channelID != req.ChannelID {
+		c.reply(macros.RespondFailureReason(macros.CodeNotFound, "Message ID [%d] isn't in channel ID [%d]", req.MessageID, req.ChannelID))
+		return 0, false
+	}
+
+	// reactions to replies in a thread only go to sessions that have the thread open
+	if threadID != 0 {
+		return threadID, true
+	}
+	return channelID, true
+}
+
+func (c *WsClient) broadcastReaction(req ReactionRequest, packetType byte, affectedChannel uint64) {
+	type ReactionResponse struct {
+		ChannelID uint64
+		MessageID uint64
+		UserID    uint64
+		Emoji     string
+	}
+
+	jsonBytes, err := json.Marshal(ReactionResponse{
+		ChannelID: req.ChannelID,
+		MessageID: req.MessageID,
+		UserID:    c.UserID,
+		Emoji:     req.Emoji,
+	})
+	if err != nil {
+		macros.ErrorSerializing(err.Error(), packetType, c.UserID)
+		return
+	}
+
+	packet := macros.PreparePacket(packetType, jsonBytes)
+	c.replyBroadcast(packet)
+	broadcastChan <- BroadcastData{
+		MessageBytes:    packet,
+		Type:            packetType,
+		AffectedChannel: affectedChannel,
+	}
+}
@@ -0,0 +1,44 @@
+package websocket
+
+import (
+	"chat-app/modules/database"
+	"chat-app/modules/macros"
+	"encoding/json"
+)
+
+type AckChannelRequest struct {
+	ChannelID uint64
+	MessageID uint64 // newest message the user has seen
+}
+
+// when client has read a channel or dm up to a message, type 84,
+// message IDs grow with time so everything after the marker is unread
+func (c *WsClient) onAckChannelRequest(req AckChannelRequest, ctx packetContext) {
+	// dms don't belong to a server, so membership is checked here instead of by the auth rule
+	if !database.CanAccessChannel(c.UserID, req.ChannelID) {
+		c.reply(macros.RespondFailureReason(macros.CodeNotMember, "Can't access channel ID [%d]", req.ChannelID))
+		return
+	}
+
+	lastRead, ok := database.MarkChannelRead(c.UserID, req.ChannelID, req.MessageID)
+	if !ok {
+		c.reply(macros.RespondFailureReason(macros.CodeFailed, "Failed marking channel ID [%d] as read", req.ChannelID))
+		return
+	}
+	req.MessageID = lastRead
+
+	jsonBytes, err := json.Marshal(req)
+	if err != nil {
+		macros.ErrorSerializing(err.Error(), ctx.packetType, c.UserID)
+		return
+	}
+
+	// other sessions of the user clear their unread badges too
+	packet := macros.PreparePacket(ctx.packetType, jsonBytes)
+	c.replyBroadcast(packet)
+	broadcastChan <- BroadcastData{
+		MessageBytes:   packet,
+		Type:           ctx.packetType,
+		AffectedUserID: []uint64{c.UserID},
+	}
+}
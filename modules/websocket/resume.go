@@ -0,0 +1,186 @@
+package websocket
+
+import (
+	log "chat-app/modules/logging"
+	"chat-app/modules/macros"
+	"encoding/binary"
+	"encoding/json"
+	"time"
+)
+
+const (
+	replayBufferSize  = 256              // how many of the last sent packets are kept per session for resuming
+	resumeGracePeriod = 60 * time.Second // how long a disconnected session is kept waiting to be resumed
+)
+
+type resumeRequest struct {
+	conn     sessionConn
+	lastSeq  uint64
+	features uint32 // features negotiated by the new connection
+	result   chan bool
+}
+
+// sequencePacket appends the next sequence number of the session after the end of the packet,
+// clients that don't care about it can ignore it since it's after the endIndex,
+// the packet is also stored in the replay buffer in case the session is resumed later
+func (c *WsClient) sequencePacket(packet []byte) []byte {
+	c.seq++
+
+	var sequenced []byte = make([]byte, len(packet)+8)
+	copy(sequenced, packet)
+	binary.LittleEndian.PutUint64(sequenced[len(packet):], c.seq)
+
+	c.replayBuffer[c.seq%replayBufferSize] = sequenced
+	return sequenced
+}
+
+// missedPackets returns the packets sent after lastSeq,
+// returns false if some of them are not in the replay buffer anymore
+func (c *WsClient) missedPackets(lastSeq uint64) ([][]byte, bool) {
+	if lastSeq > c.seq || c.seq-lastSeq > replayBufferSize {
+		return nil, false
+	}
+
+	var missed [][]byte
+	for seq := lastSeq + 1; seq <= c.seq; seq++ {
+		missed = append(missed, c.replayBuffer[seq%replayBufferSize])
+	}
+	return missed, true
+}
+
+// waitForResume keeps a disconnected session alive for resumeGracePeriod,
+// packets sent to the session in the meantime are stored so they can be replayed,
+// returns true if a new connection resumed the session
+func (c *WsClient) waitForResume() bool {
+	log.Trace("Session ID [%d] of user ID [%d] disconnected, waiting [%d] seconds for it to be resumed", c.SessionID, c.UserID, int(resumeGracePeriod.Seconds()))
+
+	if c.Conn != nil {
+		err := c.Conn.Close()
+		if err != nil {
+			log.WarnError(err.Error(), "Error while closing websocket for session ID [%d]", c.SessionID)
+		}
+		c.Conn = nil
+	}
+
+	timer := time.NewTimer(resumeGracePeriod)
+	defer timer.Stop()
+
+	for {
+		select {
+		case messageBytes := <-c.WriteChan:
+			c.dequeued(messageBytes)
+			c.sequencePacket(messageBytes)
+		case <-c.pendingSignal:
+			pending := c.takePending()
+			for i := 0; i < len(pending); i++ {
+				c.sequencePacket(pending[i])
+			}
+		case req := <-c.resumeChan:
+			missed, ok := c.missedPackets(req.lastSeq)
+			if !ok {
+				log.Debug("Session ID [%d] can't be resumed from sequence [%d], last sequence is [%d]", c.SessionID, req.lastSeq, c.seq)
+				req.result <- false
+				continue
+			}
+			req.result <- true
+
+			c.Conn = req.conn
+			c.features.Store(req.features)
+			log.Debug("Session ID [%d] of user ID [%d] was resumed, replaying [%d] missed packets", c.SessionID, c.UserID, len(missed))
+
+			if err := c.writeToConn(c.resumedPacket()); err != nil {
+				log.WarnError(err.Error(), "Error confirming resume of session ID [%d]", c.SessionID)
+				return true
+			}
+			for i := 0; i < len(missed); i++ {
+				if err := c.writeToConn(missed[i]); err != nil {
+					log.WarnError(err.Error(), "Error replaying missed packets to session ID [%d]", c.SessionID)
+					return true
+				}
+			}
+			return true
+		case <-timer.C:
+			log.Trace("Session ID [%d] of user ID [%d] wasn't resumed in time", c.SessionID, c.UserID)
+			return false
+		case <-shutdownChan:
+			return false
+		}
+	}
+}
+
+func (c *WsClient) resumedPacket() []byte {
+	type Resumed struct {
+		SessionID uint64
+		Seq       uint64
+	}
+
+	jsonBytes, err := json.Marshal(Resumed{SessionID: c.SessionID, Seq: c.seq})
+	if err != nil {
+		macros.ErrorSerializing(err.Error(), RESUME, c.UserID)
+	}
+	return macros.PreparePacket(RESUME, jsonBytes)
+}
+
+type ResumeSessionRequest struct {
+	SessionID uint64
+	Seq       uint64
+}
+
+// when client wants to continue a session that disconnected earlier, type 245,
+// resumeTarget is set if the connection should be handed over to the session
+func (c *WsClient) onResumeRequest(req ResumeSessionRequest, ctx packetContext) {
+	if !c.hasFeature(featureResume) {
+		c.reply(macros.RespondFailureReason(macros.CodeValidation, "Resume feature wasn't negotiated"))
+		return
+	}
+
+	value, found := wsClients.Load(req.SessionID)
+	if !found || req.SessionID == c.SessionID {
+		c.reply(macros.RespondFailureReason(macros.CodeNotFound, "Session ID [%d] can't be resumed", req.SessionID))
+		return
+	}
+
+	target, ok := value.(*WsClient)
+	if !ok {
+		log.Warn("Invalid WsClient")
+		return
+	}
+
+	if target.UserID != c.UserID {
+		log.Hack("User ID [%d] tried to resume session ID [%d] of user ID [%d]", c.UserID, req.SessionID, target.UserID)
+		c.reply(macros.RespondFailureReason(macros.CodeForbidden, "Session ID [%d] can't be resumed", req.SessionID))
+		return
+	}
+
+	c.resumeTarget = target
+	c.resumeSeq = req.Seq
+}
+
+// handOver gives the websocket connection to the session that is being resumed,
+// this can only happen once both goroutines of this session have stopped
+func (c *WsClient) handOver() bool {
+	target := c.resumeTarget
+	c.resumeTarget = nil
+
+	req := resumeRequest{
+		conn:     c.Conn,
+		lastSeq:  c.resumeSeq,
+		features: c.features.Load(),
+		result:   make(chan bool),
+	}
+
+	// the target session only listens while it's disconnected
+	select {
+	case target.resumeChan <- req:
+	case <-time.After(time.Second):
+		log.Debug("Session ID [%d] isn't waiting to be resumed", target.SessionID)
+		return false
+	}
+
+	if !<-req.result {
+		return false
+	}
+
+	c.handedOver = true
+	return true
+}
@@ -0,0 +1,126 @@
+package websocket
+
+import (
+	"chat-app/modules/attachments"
+	"chat-app/modules/database"
+	log "chat-app/modules/logging"
+	"chat-app/modules/macros"
+	"chat-app/modules/snowflake"
+	"encoding/json"
+	"time"
+)
+
+const maxRetentionDays = 3650
+
+// how often expired messages are deleted, they can be seen for at most this long after they expire
+const pruneInterval = 1 * time.Minute
+
+// how many messages are deleted in one transaction, so pruning a big channel doesn't lock the database for long
+const pruneBatchSize = 500
+
+// what sessions viewing a channel or thread are told when its old messages were deleted,
+// every message older than BeforeID is gone
+type messagesPruned struct {
+	ChannelID uint64
+	ThreadID  uint64
+	BeforeID  uint64
+}
+
+func checkRetentionDays(days int) bool {
+	return days >= 0 && days <= maxRetentionDays
+}
+
+// pruneExpiredMessages deletes messages older than the retention period of their channel or server,
+// until the server shuts down
+func pruneExpiredMessages() {
+	defer workersWg.Done()
+	ticker := time.NewTicker(pruneInterval)
+	defer ticker.Stop()
+
+	for {
+		policies := database.GetRetentionPolicies()
+		for i := 0; i < len(policies); i++ {
+			// channel that's being pruned is finished, the rest wait for the next start
+			select {
+			case <-shutdownChan:
+				return
+			default:
+			}
+			expiresAt := time.Now().AddDate(0, 0, -policies[i].Days).UnixMilli()
+			pruneChannel(policies[i].ChannelID, snowflake.FromTimestamp(uint64(expiresAt)))
+		}
+
+		select {
+		case <-shutdownChan:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func pruneChannel(channelID uint64, beforeID uint64) {
+	var total int
+	var threads = make(map[uint64]bool)
+	for {
+		pruned := database.PruneChannelMessages(channelID, beforeID, pruneBatchSize)
+		total += pruned.Count
+
+		for i := 0; i < len(pruned.ThreadIDs); i++ {
+			threads[pruned.ThreadIDs[i]] = true
+		}
+		for i := 0; i < len(pruned.Orphaned); i++ {
+			attachments.RemoveFile(pruned.Orphaned[i].Hash, pruned.Orphaned[i].Name)
+		}
+
+		if pruned.Count < pruneBatchSize {
+			break
+		}
+	}
+
+	if total == 0 {
+		return
+	}
+	log.Info("Deleted [%d] expired messages of channel ID [%d]", total, channelID)
+
+	// only sessions that have the channel or thread open are told, the rest won't load them anymore
+	broadcastPruned(messagesPruned{ChannelID: channelID, BeforeID: beforeID}, channelID)
+	for threadID := range threads {
+		broadcastPruned(messagesPruned{ChannelID: channelID, ThreadID: threadID, BeforeID: beforeID}, threadID)
+	}
+}
+
+// PurgeDeletedMessages removes content of messages deleted before the given time,
+// called by maintenance
+func PurgeDeletedMessages(deletedBefore int64) {
+	var total int
+	for {
+		purged := database.PurgeDeletedMessages(deletedBefore, pruneBatchSize)
+		total += purged.Count
+
+		for i := 0; i < len(purged.Orphaned); i++ {
+			attachments.RemoveFile(purged.Orphaned[i].Hash, purged.Orphaned[i].Name)
+		}
+
+		if purged.Count < pruneBatchSize {
+			break
+		}
+	}
+
+	if total != 0 {
+		log.Info("Purged content of [%d] deleted messages", total)
+	}
+}
+
+func broadcastPruned(pruned messagesPruned, affectedChannel uint64) {
+	jsonBytes, err := json.Marshal(pruned)
+	if err != nil {
+		macros.ErrorSerializing(err.Error(), MESSAGES_PRUNED, 0)
+		return
+	}
+
+	broadcastChan <- BroadcastData{
+		MessageBytes:    macros.PreparePacket(MESSAGES_PRUNED, jsonBytes),
+		Type:            MESSAGES_PRUNED,
+		AffectedChannel: affectedChannel,
+	}
+}
@@ -0,0 +1,46 @@
+package websocket
+
+import (
+	"chat-app/modules/database"
+	"chat-app/modules/macros"
+)
+
+// ModeratorOnlyRevisions makes edit history of messages visible only to the server owner,
+// set from config.json
+var ModeratorOnlyRevisions bool
+
+type MessageRevisionsRequest struct {
+	ChannelID uint64
+	MessageID uint64
+}
+
+// when client wants to see what a message said before it was edited, type 16
+func (c *WsClient) onMessageRevisionsRequest(req MessageRevisionsRequest, ctx packetContext) {
+	if ModeratorOnlyRevisions && database.GetServerOwner(ctx.serverID) != c.UserID {
+		c.reply(macros.RespondFailureReason(macros.CodeNotOwner, "Only the owner of server ID [%d] can see edit history", ctx.serverID))
+		return
+	}
+
+	channelID, _ := database.GetMessageLocation(req.MessageID)
+
+	// content of deleted messages is kept for appeals, only the server owner can see it
+	var deletedContent *database.Revision
+	if channelID == 0 && database.GetServerOwner(ctx.serverID) == c.UserID {
+		var revision database.Revision
+		channelID, revision.Message, revision.EditedAt = database.GetDeletedMessage(req.MessageID)
+		deletedContent = &revision
+	}
+
+	if channelID != req.ChannelID {
+		c.reply(macros.RespondFailureReason(macros.CodeNotFound, "Message ID [%d] isn't in channel ID [%d]", req.MessageID, req.ChannelID))
+		return
+	}
+
+	jsonBytes := database.GetMessageRevisions(req.MessageID, deletedContent)
+	if jsonBytes == nil {
+		c.reply(macros.RespondFailureReason(macros.CodeFailed, "Failed getting revisions of message ID [%d]", req.MessageID))
+		return
+	}
+
+	c.reply(macros.PreparePacket(ctx.packetType, jsonBytes))
+}
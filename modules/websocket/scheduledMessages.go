@@ -0,0 +1,236 @@
+package websocket
+
+import (
+	"chat-app/modules/attachments"
+	"chat-app/modules/database"
+	log "chat-app/modules/logging"
+	"chat-app/modules/macros"
+	"chat-app/modules/snowflake"
+	"encoding/base64"
+	"encoding/json"
+	"time"
+)
+
+// how far ahead a message can be scheduled, and how often the scheduler looks for messages to send
+const maxScheduleAhead = 365 * 24 * time.Hour
+const schedulerInterval = 1 * time.Second
+
+type ScheduleMessageRequest struct {
+	ChannelID uint64
+	Message   string
+	AttTok    string
+	ReplyID   uint64
+	ThreadID  uint64
+	SendAt    int64 // unix milliseconds
+}
+
+type EditScheduledRequest struct {
+	ScheduledID uint64
+	Message     string
+	SendAt      int64
+}
+
+type CancelScheduledRequest struct {
+	ScheduledID uint64
+}
+
+// what sessions of the user are told when a scheduled message leaves the schedule
+type scheduledRemoved struct {
+	ScheduledID uint64
+	MessageID   uint64 // the message it was sent as, 0 if it was cancelled or couldn't be sent
+}
+
+func checkSendAt(sendAt int64) bool {
+	now := time.Now()
+	return sendAt > now.UnixMilli() && sendAt <= now.Add(maxScheduleAhead).UnixMilli()
+}
+
+// when client schedules a chat message to be sent later, type 17,
+// attachments are claimed now since the attachment token expires in seconds
+func (c *WsClient) onScheduleMessageRequest(req ScheduleMessageRequest, ctx packetContext) {
+	if !checkSendAt(req.SendAt) {
+		c.reply(macros.RespondFailureReason(macros.CodeValidation, "Send time has to be in the future and within %d days", int(maxScheduleAhead.Hours()/24)))
+		return
+	}
+
+	if req.ThreadID != 0 {
+		thread, exists := database.GetThread(req.ThreadID)
+		if !exists || thread.ChannelID != req.ChannelID {
+			c.reply(macros.RespondFailureReason(macros.CodeNotFound, "Thread ID [%d] doesn't exist in channel ID [%d]", req.ThreadID, req.ChannelID))
+			return
+		}
+	}
+
+	if database.CountScheduledMessagesOfUser(c.UserID) >= database.MaxScheduledMessagesPerUser {
+		c.reply(macros.RespondFailureReason(macros.CodeValidation, "Can't have more than %d scheduled messages", database.MaxScheduledMessagesPerUser))
+		return
+	}
+
+	attachmentToken, err := base64.StdEncoding.DecodeString(req.AttTok)
+	if err != nil || (len(attachmentToken) != 0 && len(attachmentToken) != 64) {
+		log.Hack("User ID [%d] sent an attachmentToken base64 string that can't be decoded", c.UserID)
+		c.reply(macros.RespondFailureReason(macros.CodeValidation, "Denied scheduling chat message to channel ID [%d]", req.ChannelID))
+		return
+	}
+
+	var uploadedAttachments []attachments.UploadedAttachment
+	if len(attachmentToken) > 0 {
+		uploadedAttachments = attachments.GetWaitingAttachment([64]byte(attachmentToken))
+	}
+
+	scheduled := database.ScheduledMessage{
+		ScheduledID: snowflake.Generate(),
+		ChannelID:   req.ChannelID,
+		UserID:      c.UserID,
+		Message:     req.Message,
+		Attachments: attachmentResponses(uploadedAttachments),
+		ReplyID:     req.ReplyID,
+		ThreadID:    req.ThreadID,
+		SendAt:      req.SendAt,
+	}
+	if !database.AddScheduledMessage(scheduled) {
+		c.reply(macros.RespondFailureReason(macros.CodeFailed, "Failed scheduling chat message to channel ID [%d]", req.ChannelID))
+		return
+	}
+	log.Trace("User ID [%d] scheduled message ID [%d] to channel ID [%d]", c.UserID, scheduled.ScheduledID, req.ChannelID)
+
+	jsonBytes, err := json.Marshal(scheduled)
+	if err != nil {
+		macros.ErrorSerializing(err.Error(), ctx.packetType, c.UserID)
+		return
+	}
+
+	// other sessions of the user add it to their list of scheduled messages too
+	packet := macros.PreparePacket(ctx.packetType, jsonBytes)
+	c.replyBroadcast(packet)
+	broadcastChan <- BroadcastData{
+		MessageBytes:   packet,
+		Type:           ctx.packetType,
+		AffectedUserID: []uint64{c.UserID},
+	}
+}
+
+// when client requests its messages waiting to be sent, type 18
+func (c *WsClient) onScheduledMessagesRequest(packetType byte) {
+	jsonBytes := database.GetScheduledMessages(c.UserID)
+	if jsonBytes == nil {
+		c.reply(macros.RespondFailureReason(macros.CodeFailed, "Failed getting scheduled messages"))
+		return
+	}
+
+	c.reply(macros.PreparePacket(packetType, jsonBytes))
+}
+
+// when client changes the text or send time of a scheduled message, type 19
+func (c *WsClient) onEditScheduledRequest(req EditScheduledRequest, ctx packetContext) {
+	if !checkSendAt(req.SendAt) {
+		c.reply(macros.RespondFailureReason(macros.CodeValidation, "Send time has to be in the future and within %d days", int(maxScheduleAhead.Hours()/24)))
+		return
+	}
+
+	if !database.EditScheduledMessage(req.ScheduledID, c.UserID, req.Message, req.SendAt) {
+		c.reply(macros.RespondFailureReason(macros.CodeNotFound, "No scheduled message ID [%d] waiting to be sent", req.ScheduledID))
+		return
+	}
+
+	jsonBytes, err := json.Marshal(req)
+	if err != nil {
+		macros.ErrorSerializing(err.Error(), ctx.packetType, c.UserID)
+		return
+	}
+
+	packet := macros.PreparePacket(ctx.packetType, jsonBytes)
+	c.replyBroadcast(packet)
+	broadcastChan <- BroadcastData{
+		MessageBytes:   packet,
+		Type:           ctx.packetType,
+		AffectedUserID: []uint64{c.UserID},
+	}
+}
+
+// when client cancels a scheduled message, type 20
+func (c *WsClient) onCancelScheduledRequest(req CancelScheduledRequest, ctx packetContext) {
+	if !database.CancelScheduledMessage(req.ScheduledID, c.UserID) {
+		c.reply(macros.RespondFailureReason(macros.CodeNotFound, "No scheduled message ID [%d] waiting to be sent", req.ScheduledID))
+		return
+	}
+
+	c.replyBroadcast(broadcastScheduledRemoved(c.UserID, scheduledRemoved{ScheduledID: req.ScheduledID}))
+}
+
+// broadcastScheduledRemoved tells the sessions of the user that a scheduled message is gone,
+// returns the broadcast packet
+func broadcastScheduledRemoved(userID uint64, removed scheduledRemoved) []byte {
+	jsonBytes, err := json.Marshal(removed)
+	if err != nil {
+		macros.ErrorSerializing(err.Error(), CANCEL_SCHEDULED, userID)
+		return nil
+	}
+
+	packet := macros.PreparePacket(CANCEL_SCHEDULED, jsonBytes)
+	broadcastChan <- BroadcastData{
+		MessageBytes:   packet,
+		Type:           CANCEL_SCHEDULED,
+		AffectedUserID: []uint64{userID},
+	}
+	return packet
+}
+
+// sendScheduledMessages posts scheduled messages when their time comes, until the server shuts down
+func sendScheduledMessages() {
+	defer workersWg.Done()
+	ticker := time.NewTicker(schedulerInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-shutdownChan:
+			return
+		case <-ticker.C:
+			now := time.Now().UnixMilli()
+			scheduledIDs := database.GetDueScheduledMessageIDs(now)
+			for i := 0; i < len(scheduledIDs); i++ {
+				sendScheduledMessage(scheduledIDs[i], now)
+			}
+		}
+	}
+}
+
+// sendScheduledMessage posts the message the same way as if the user sent it now,
+// membership is checked again since the user may have left the server since scheduling it
+func sendScheduledMessage(scheduledID uint64, now int64) {
+	scheduled, claimed := database.ClaimScheduledMessage(scheduledID, now)
+	if !claimed {
+		return
+	}
+
+	removed := scheduledRemoved{ScheduledID: scheduledID}
+	defer func() {
+		broadcastScheduledRemoved(scheduled.UserID, removed)
+	}()
+
+	serverID := database.GetServerIdOfChannel(scheduled.ChannelID)
+	if serverID == 0 || !database.ConfirmServerMembership(scheduled.UserID, serverID) {
+		log.Trace("User ID [%d] is no longer a member of the server of channel ID [%d], dropping scheduled message ID [%d]", scheduled.UserID, scheduled.ChannelID, scheduledID)
+		return
+	}
+
+	if scheduled.ThreadID != 0 {
+		thread, exists := database.GetThread(scheduled.ThreadID)
+		if !exists || thread.ChannelID != scheduled.ChannelID {
+			log.Trace("Thread ID [%d] no longer exists, dropping scheduled message ID [%d]", scheduled.ThreadID, scheduledID)
+			return
+		}
+	}
+
+	removed.MessageID = snowflake.Generate()
+	postChatMessage(database.Message{
+		MessageID: removed.MessageID,
+		ChannelID: scheduled.ChannelID,
+		UserID:    scheduled.UserID,
+		Message:   scheduled.Message,
+		ReplyID:   scheduled.ReplyID,
+		ThreadID:  scheduled.ThreadID,
+	}, scheduled.Attachments, serverID)
+	log.Trace("Sent scheduled message ID [%d] of user ID [%d] as message ID [%d]", scheduledID, scheduled.UserID, removed.MessageID)
+}
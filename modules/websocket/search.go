@@ -0,0 +1,62 @@
+package websocket
+
+import (
+	"chat-app/modules/database"
+	"chat-app/modules/macros"
+	"chat-app/modules/snowflake"
+	"strings"
+)
+
+const maxSearchTextLength = 200
+
+type SearchMessagesRequest struct {
+	Text           string
+	AuthorID       uint64
+	ChannelID      uint64
+	ServerID       uint64
+	HasAttachments bool
+	After          uint64 // unix milliseconds
+	Before         uint64
+	BeforeID       uint64 // Next of the previous page, 0 for the newest results
+}
+
+// when client searches messages, type 15,
+// membership is checked by the search query so results only come from channels the user is in
+func (c *WsClient) onSearchMessagesRequest(req SearchMessagesRequest, ctx packetContext) {
+	if len(req.Text) > maxSearchTextLength {
+		c.reply(macros.RespondFailureReason(macros.CodeValidation, "Search text can't be longer than %d bytes", maxSearchTextLength))
+		return
+	}
+	if strings.TrimSpace(req.Text) == "" && req.AuthorID == 0 && req.ChannelID == 0 && req.ServerID == 0 && !req.HasAttachments && req.After == 0 && req.Before == 0 {
+		c.reply(macros.RespondFailureReason(macros.CodeValidation, "Search needs text or at least one filter"))
+		return
+	}
+	if req.Before != 0 && req.After > req.Before {
+		c.reply(macros.RespondFailureReason(macros.CodeValidation, "Start of date range is after its end"))
+		return
+	}
+
+	filter := database.SearchFilter{
+		Text:           req.Text,
+		AuthorID:       req.AuthorID,
+		ChannelID:      req.ChannelID,
+		ServerID:       req.ServerID,
+		HasAttachments: req.HasAttachments,
+		BeforeID:       req.BeforeID,
+	}
+	// message IDs start with the time they were sent at
+	if req.After != 0 {
+		filter.MinMessageID = snowflake.FromTimestamp(req.After)
+	}
+	if req.Before != 0 {
+		filter.MaxMessageID = snowflake.FromTimestamp(req.Before+1) - 1
+	}
+
+	jsonBytes := database.SearchMessages(filter, c.UserID)
+	if jsonBytes == nil {
+		c.reply(macros.RespondFailureReason(macros.CodeFailed, "Failed searching messages"))
+		return
+	}
+
+	c.reply(macros.PreparePacket(ctx.packetType, jsonBytes))
+}
@@ -0,0 +1,101 @@
+package websocket
+
+import (
+	log "chat-app/modules/logging"
+	"chat-app/modules/macros"
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	reconnectAfter   = 5 * time.Second // clients are told to wait this long before reconnecting after a restart
+	closeGracePeriod = 3 * time.Second // how long clients have to answer the close frame
+)
+
+var shutdownMutex sync.RWMutex
+var shuttingDown atomic.Bool
+var shutdownChan = make(chan bool) // closed when shutting down, every session listens to it
+var sessionsWg sync.WaitGroup      // every AcceptWsClient that's running
+var workersWg sync.WaitGroup       // scheduler, poll closer and pruning, they use the database until they stop
+
+// startSession returns false if no more sessions are accepted
+func startSession() bool {
+	shutdownMutex.RLock()
+	defer shutdownMutex.RUnlock()
+
+	if shuttingDown.Load() {
+		return false
+	}
+	sessionsWg.Add(1)
+	return true
+}
+
+// Shutdown tells every session that the server is restarting and closes them,
+// it waits until the packets they sent earlier are handled and the background goroutines stopped,
+// or the timeout passes, so the database can be closed after it
+func Shutdown(timeout time.Duration) {
+	shutdownMutex.Lock()
+	shuttingDown.Store(true)
+	shutdownMutex.Unlock()
+
+	log.Info("Closing websocket sessions...")
+	close(shutdownChan)
+
+	if waitTimeout(&sessionsWg, timeout) {
+		log.Info("Closed every websocket session")
+	} else {
+		log.Warn("Websocket sessions didn't close in [%d] seconds, shutting down anyway", int(timeout.Seconds()))
+	}
+
+	if waitTimeout(&workersWg, timeout) {
+		log.Info("Stopped scheduled messages, polls and pruning")
+	} else {
+		log.Warn("Scheduled messages, polls and pruning didn't stop in [%d] seconds, shutting down anyway", int(timeout.Seconds()))
+	}
+}
+
+// waitTimeout returns false if the wait group isn't done before the timeout
+func waitTimeout(wg *sync.WaitGroup, timeout time.Duration) bool {
+	finished := make(chan bool)
+	go func() {
+		wg.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// sendShutdown is called by the writing goroutine, reading goroutine keeps
+// handling what was already received until client answers the close frame
+func (c *WsClient) sendShutdown() {
+	type Restarting struct {
+		Reason         string
+		ReconnectAfter int
+	}
+
+	jsonBytes, err := json.Marshal(Restarting{
+		Reason:         "Server is restarting",
+		ReconnectAfter: int(reconnectAfter.Seconds()),
+	})
+	if err != nil {
+		macros.ErrorSerializing(err.Error(), SERVER_RESTARTING, c.UserID)
+		return
+	}
+
+	if err := c.writePacket(macros.PreparePacket(SERVER_RESTARTING, jsonBytes)); err != nil {
+		log.WarnError(err.Error(), "Error telling session ID [%d] that server is restarting", c.SessionID)
+	}
+
+	if err := c.Conn.Disconnect(websocket.CloseServiceRestart, "Server is restarting", closeGracePeriod); err != nil {
+		log.WarnError(err.Error(), "Error sending close message to session ID [%d]", c.SessionID)
+	}
+}
@@ -0,0 +1,198 @@
+package websocket
+
+import (
+	log "chat-app/modules/logging"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const sseQueueSize = 32 // packets client can POST before the session reads them
+
+// accessed using the connection ID given to client in the first event
+var sseConns sync.Map
+
+// sseConn is the fallback for clients behind proxies that break websocket upgrades,
+// packets are streamed to client as server-sent events and client POSTs its packets to /sse
+type sseConn struct {
+	id     string
+	userID uint64
+
+	writeMutex sync.Mutex
+	writer     http.ResponseWriter
+	controller *http.ResponseController
+
+	inbound    chan []byte // packets client POSTed
+	closed     chan bool
+	closeOnce  sync.Once
+	expired    chan bool // closed after Disconnect, reading stops
+	expireOnce sync.Once
+}
+
+var errSseClosed = errors.New("sse connection is closed")
+
+func (s *sseConn) ReadPacket() ([]byte, error) {
+	select {
+	case packet := <-s.inbound:
+		return packet, nil
+	case <-s.closed:
+		return nil, errSseClosed
+	case <-s.expired:
+		return nil, errSseClosed
+	}
+}
+
+// writeEvent sends a single event, connection is closed if it fails
+func (s *sseConn) writeEvent(event string) error {
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+
+	select {
+	case <-s.closed:
+		return errSseClosed
+	default:
+	}
+
+	s.controller.SetWriteDeadline(time.Now().Add(timeoutWrite))
+	_, err := io.WriteString(s.writer, event)
+	if err == nil {
+		err = s.controller.Flush()
+	}
+	if err != nil {
+		s.Close()
+	}
+	return err
+}
+
+// packets are base64 encoded since events can only carry text,
+// it's the same bytes a websocket client would get
+func (s *sseConn) WritePacket(packet []byte, compress bool) error {
+	return s.writeEvent(fmt.Sprintf("data: %s\n\n", base64.StdEncoding.EncodeToString(packet)))
+}
+
+func (s *sseConn) Ping() error {
+	return s.writeEvent(": ping\n\n")
+}
+
+func (s *sseConn) Disconnect(code int, reason string, after time.Duration) error {
+	time.AfterFunc(after, func() {
+		s.expireOnce.Do(func() { close(s.expired) })
+	})
+
+	type Close struct {
+		Code   int
+		Reason string
+	}
+
+	jsonBytes, err := json.Marshal(Close{Code: code, Reason: reason})
+	if err != nil {
+		return err
+	}
+	return s.writeEvent(fmt.Sprintf("event: close\ndata: %s\n\n", jsonBytes))
+}
+
+func (s *sseConn) Close() error {
+	s.closeOnce.Do(func() { close(s.closed) })
+	return nil
+}
+
+// AcceptSseClient client is connecting with server-sent events because websocket didn't work
+func AcceptSseClient(userID uint64, w http.ResponseWriter, r *http.Request) {
+	log.Trace("Accepting user ID [%d] with server-sent events...", userID)
+	if !startSession() {
+		log.Trace("Server is shutting down, not accepting user ID [%d]", userID)
+		http.Error(w, "Server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	defer sessionsWg.Done()
+
+	if !allowReconnect(userID) {
+		return
+	}
+
+	idBytes := make([]byte, 16)
+	if _, err := rand.Read(idBytes); err != nil {
+		log.WarnError(err.Error(), "Error generating sse connection ID for user ID [%d]", userID)
+		return
+	}
+
+	conn := &sseConn{
+		id:         hex.EncodeToString(idBytes),
+		userID:     userID,
+		writer:     w,
+		controller: http.NewResponseController(w),
+		inbound:    make(chan []byte, sseQueueSize),
+		closed:     make(chan bool),
+		expired:    make(chan bool),
+	}
+	sseConns.Store(conn.id, conn)
+	defer sseConns.Delete(conn.id)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") // so proxies won't hold back the events
+
+	// client needs the connection ID to POST its packets
+	if err := conn.writeEvent(fmt.Sprintf("event: conn\ndata: %s\n\n", conn.id)); err != nil {
+		log.WarnError(err.Error(), "Error starting sse stream of user ID [%d]", userID)
+		return
+	}
+
+	go func() {
+		select {
+		case <-r.Context().Done():
+			conn.Close()
+		case <-conn.closed:
+		}
+	}()
+
+	runSession(userID, conn)
+
+	// if the connection was handed over to a resumed session, the response
+	// has to stay open until that session is done with it
+	<-conn.closed
+}
+
+// OnSsePacket is a packet client sent on its sse connection, it's handled like websocket messages
+func OnSsePacket(userID uint64, w http.ResponseWriter, r *http.Request) {
+	connID := r.URL.Query().Get("conn")
+	value, found := sseConns.Load(connID)
+	if !found {
+		http.Error(w, "Connection doesn't exist", http.StatusNotFound)
+		return
+	}
+
+	conn, ok := value.(*sseConn)
+	if !ok {
+		log.Warn("Invalid sseConn")
+		return
+	}
+
+	if conn.userID != userID {
+		log.Hack("User ID [%d] tried to send packets on sse connection of user ID [%d]", userID, conn.userID)
+		http.Error(w, "Connection doesn't exist", http.StatusNotFound)
+		return
+	}
+
+	packet, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxMessageSize))
+	if err != nil {
+		http.Error(w, "Packet is too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	select {
+	case conn.inbound <- packet:
+		w.WriteHeader(http.StatusNoContent)
+	case <-conn.closed:
+		http.Error(w, "Connection is closed", http.StatusGone)
+	default:
+		http.Error(w, "Too many packets waiting", http.StatusTooManyRequests)
+	}
+}
@@ -0,0 +1,158 @@
+package websocket
+
+import (
+	"chat-app/modules/clients"
+	"chat-app/modules/database"
+	log "chat-app/modules/logging"
+	"chat-app/modules/macros"
+	"encoding/json"
+)
+
+// threads use the channel subscriptions of the session, the thread ID is used as the channel ID,
+// so replies reach sessions that have the thread open no matter which channel they are viewing
+
+type StartThreadRequest struct {
+	ChannelID uint64
+	MessageID uint64
+}
+
+// only one of BeforeID, AfterID and AroundID is used, the newest replies are sent if none are set
+type ThreadHistoryRequest struct {
+	ChannelID uint64
+	ThreadID  uint64
+	BeforeID  uint64 // Next of the previous page
+	AfterID   uint64
+	AroundID  uint64 // used to jump to a reply
+	Limit     int
+}
+
+type UnsubscribeThreadRequest struct {
+	ThreadID uint64
+}
+
+// what sessions viewing the channel are told when a thread is started or gets a new reply
+type threadUpdate struct {
+	ChannelID  uint64
+	ThreadID   uint64
+	ReplyCount uint32
+	LastReply  int64
+}
+
+// when client starts a thread from a message, type 6,
+// starting one that already exists just opens it
+func (c *WsClient) onStartThreadRequest(req StartThreadRequest, ctx packetContext) {
+	channelID, threadID := database.GetMessageLocation(req.MessageID)
+	if channelID != req.ChannelID {
+		c.reply(macros.RespondFailureReason(macros.CodeNotFound, "Message ID [%d] isn't in channel ID [%d]", req.MessageID, req.ChannelID))
+		return
+	}
+	if threadID != 0 {
+		c.reply(macros.RespondFailureReason(macros.CodeValidation, "Can't start a thread from a reply in a thread"))
+		return
+	}
+
+	thread, exists := database.GetThread(req.MessageID)
+	if !exists {
+		thread = database.Thread{
+			ThreadID:  req.MessageID,
+			ChannelID: req.ChannelID,
+			UserID:    c.UserID,
+		}
+		if err := database.Insert(thread); err != nil {
+			c.reply(macros.RespondFailureReason(macros.CodeFailed, "Failed starting thread from message ID [%d]", req.MessageID))
+			return
+		}
+		log.Trace("User ID [%d] started thread from message ID [%d]", c.UserID, req.MessageID)
+	}
+
+	if !clients.SubscribeChannel(c.SessionID, thread.ThreadID, ctx.serverID) {
+		c.reply(macros.RespondFailureReason(macros.CodeValidation, "Can't subscribe to more than %d channels and threads", clients.MaxChannelSubscriptions))
+		return
+	}
+
+	jsonBytes, err := json.Marshal(threadUpdate{
+		ChannelID:  thread.ChannelID,
+		ThreadID:   thread.ThreadID,
+		ReplyCount: thread.ReplyCount,
+		LastReply:  thread.LastReply,
+	})
+	if err != nil {
+		macros.ErrorSerializing(err.Error(), ctx.packetType, c.UserID)
+		return
+	}
+
+	c.reply(macros.PreparePacket(ctx.packetType, jsonBytes))
+
+	if !exists {
+		broadcastThreadUpdate(thread)
+	}
+}
+
+// when client opens a thread or scrolls up in it, type 7,
+// the session receives new replies of the thread until it unsubscribes
+func (c *WsClient) onThreadHistoryRequest(req ThreadHistoryRequest, ctx packetContext) {
+	thread, exists := database.GetThread(req.ThreadID)
+	if !exists || thread.ChannelID != req.ChannelID {
+		c.reply(macros.RespondFailureReason(macros.CodeNotFound, "Thread ID [%d] doesn't exist in channel ID [%d]", req.ThreadID, req.ChannelID))
+		return
+	}
+
+	if !clients.SubscribeChannel(c.SessionID, thread.ThreadID, ctx.serverID) {
+		c.reply(macros.RespondFailureReason(macros.CodeValidation, "Can't subscribe to more than %d channels and threads", clients.MaxChannelSubscriptions))
+		return
+	}
+
+	page := database.HistoryPage{Direction: database.HistoryLatest, Limit: historyPageSize(req.Limit)}
+	switch {
+	case req.AroundID != 0:
+		page.Direction, page.FromID = database.HistoryAround, req.AroundID
+	case req.BeforeID != 0:
+		page.Direction, page.FromID = database.HistoryBefore, req.BeforeID
+	case req.AfterID != 0:
+		page.Direction, page.FromID = database.HistoryAfter, req.AfterID
+	}
+
+	jsonBytes := database.GetThreadHistory(thread.ThreadID, page, c.UserID)
+	if jsonBytes == nil {
+		c.reply(macros.RespondFailureReason(macros.CodeFailed, "Failed getting replies of thread ID [%d]", req.ThreadID))
+		return
+	}
+
+	c.reply(macros.PreparePacket(ctx.packetType, jsonBytes))
+}
+
+// when client closes a thread, type 8
+func (c *WsClient) onUnsubscribeThreadRequest(req UnsubscribeThreadRequest, ctx packetContext) {
+	if !clients.UnsubscribeChannel(c.SessionID, req.ThreadID) {
+		c.reply(macros.RespondFailureReason(macros.CodeNotFound, "Not subscribed to thread ID [%d]", req.ThreadID))
+		return
+	}
+
+	jsonBytes, err := json.Marshal(req)
+	if err != nil {
+		macros.ErrorSerializing(err.Error(), ctx.packetType, c.UserID)
+		return
+	}
+
+	c.reply(macros.PreparePacket(ctx.packetType, jsonBytes))
+}
+
+// broadcastThreadUpdate tells sessions viewing the channel the new reply count of the thread
+func broadcastThreadUpdate(thread database.Thread) {
+	jsonBytes, err := json.Marshal(threadUpdate{
+		ChannelID:  thread.ChannelID,
+		ThreadID:   thread.ThreadID,
+		ReplyCount: thread.ReplyCount,
+		LastReply:  thread.LastReply,
+	})
+	if err != nil {
+		log.FatalError(err.Error(), "Error serializing update of thread ID [%d]", thread.ThreadID)
+		return
+	}
+
+	broadcastChan <- BroadcastData{
+		MessageBytes:    macros.PreparePacket(THREAD_UPDATE, jsonBytes),
+		Type:            THREAD_UPDATE,
+		AffectedChannel: thread.ChannelID,
+	}
+}
@@ -93,6 +93,7 @@ func setUserOnline(userID uint64, online bool) {
 		MessageBytes:    macros.PreparePacket(UPDATE_ONLINE, jsonBytes),
 		Type:            UPDATE_ONLINE,
 		AffectedServers: serverIDs,
+		SourceUserID:    userID,
 	}
 
 	broadcastChan <- broadcastData
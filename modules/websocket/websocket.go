@@ -2,13 +2,13 @@ package websocket
 
 import (
 	"chat-app/modules/clients"
-	"chat-app/modules/database"
 	log "chat-app/modules/logging"
 	"chat-app/modules/macros"
 	"encoding/binary"
 	"net/http"
 	"net/url"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -22,6 +22,21 @@ const (
 	DELETE_CHAT_MESSAGE byte = 3
 	STARTED_TYPING      byte = 4
 	EDIT_CHAT_MESSAGE   byte = 5
+	START_THREAD        byte = 6
+	THREAD_HISTORY      byte = 7
+	UNSUBSCRIBE_THREAD  byte = 8
+	THREAD_UPDATE       byte = 9
+	ADD_REACTION        byte = 10
+	REMOVE_REACTION     byte = 11
+	PIN_MESSAGE         byte = 12
+	UNPIN_MESSAGE       byte = 13
+	PINNED_LIST         byte = 14
+	SEARCH_MESSAGES     byte = 15
+	MESSAGE_REVISIONS   byte = 16
+	SCHEDULE_MESSAGE    byte = 17
+	SCHEDULED_MESSAGES  byte = 18
+	EDIT_SCHEDULED      byte = 19
+	CANCEL_SCHEDULED    byte = 20
 
 	ADD_SERVER           byte = 21
 	UPDATE_SERVER_PIC    byte = 22
@@ -29,11 +44,16 @@ const (
 	SERVER_INVITE_LINK   byte = 24
 	UPDATE_SERVER_DATA   byte = 25
 	UPDATE_SERVER_BANNER byte = 26
+	EMOJI_LIST           byte = 27
+	EMOJI_UPDATE         byte = 28
 
 	ADD_CHANNEL         byte = 31
 	CHANNEL_LIST        byte = 32
 	DELETE_CHANNEL      byte = 33
 	UPDATE_CHANNEL_DATA byte = 34
+	SUBSCRIBE_CHANNEL   byte = 35
+	UNSUBSCRIBE_CHANNEL byte = 36
+	MESSAGES_PRUNED     byte = 37
 
 	ADD_SERVER_MEMBER         byte = 41
 	SERVER_MEMBER_LIST        byte = 42
@@ -52,10 +72,25 @@ const (
 	REQUEST_DM_LIST     byte = 72
 	ADD_DM_CHAT_MESSAGE byte = 73
 
+	MENTION       byte = 81
+	MENTION_INBOX byte = 82
+	ACK_MENTION   byte = 83
+	ACK_CHANNEL   byte = 84
+
+	CREATE_POLL byte = 91
+	VOTE_POLL   byte = 92
+	POLL_UPDATE byte = 93
+
+	COMMAND_LIST   byte = 101
+	COMMAND_RESULT byte = 102
+
+	HELLO                   byte = 240
 	INITIAL_USER_DATA       byte = 241
 	IMAGE_HOST_ADDRESS      byte = 242
 	UPDATE_USER_DATA        byte = 243
 	UPDATE_USER_PROFILE_PIC byte = 244
+	RESUME                  byte = 245
+	SERVER_RESTARTING       byte = 246
 )
 
 const (
@@ -81,60 +116,78 @@ type BroadcastData struct {
 	AffectedServers []uint64
 	AffectedChannel uint64
 	AffectedUserID  []uint64
+	SourceUserID    uint64 // user the event is about, used to coalesce droppable events
 }
 
 type WsClient struct {
 	SessionID uint64
 	UserID    uint64
-	WsConn    *websocket.Conn
+	Conn      sessionConn
 	WriteChan chan []byte
 	CloseChan chan bool
-}
 
-type SpamProtection struct {
-	UserID           uint64
-	LastMsgTimestamp int64
-	TooFastCount     int
-	Timer            *time.Timer
-	StopTimer        chan bool
-}
+	seq          uint64                   // sequence number of the last packet sent to the session
+	replayBuffer [replayBufferSize][]byte // last sent packets, kept so they can be replayed on resume
+	resumeChan   chan resumeRequest       // a new connection resuming this session is received here
+	resumeTarget *WsClient                // session the connection will be handed over to after a resume request
+	resumeSeq    uint64                   // last sequence number the client received before disconnecting
+	handedOver   bool                     // connection now belongs to a resumed session
+	kicked       bool                     // session was disconnected for misbehaving and can't be resumed
+
+	features      atomic.Uint32 // optional protocol features negotiated in HELLO
+	helloReceived bool
+
+	reqID uint32 // request ID of the packet being handled, 0 if client didn't give one
 
-var maxTooFastCount int = 40
-var resetAfter int64 = 20000
-var deleteFromSpamProtectionAfter time.Duration = 29
+	outbound
+}
 
 var broadcastChan = make(chan BroadcastData, 100)
 
 var wsClients sync.Map
 
-var spamClients sync.Map
+func Init(b Broadcaster, limits RateLimits) {
+	setRateLimits(limits)
+	go forgetIdleLimiters()
 
-func Init() {
+	broadcaster = b
+	if err := broadcaster.Start(deliverBroadcast); err != nil {
+		log.FatalError(err.Error(), "Error starting broadcaster")
+	}
 	go broadCastChannel()
+	workersWg.Add(3)
+	go sendScheduledMessages()
+	go closePolls()
+	go pruneExpiredMessages()
 }
 
 // AcceptWsClient client is connecting to the websocket
 func AcceptWsClient(userID uint64, w http.ResponseWriter, r *http.Request) {
 	log.Trace("Accepting user ID [%d] to websocket...", userID)
-	val, exists := spamClients.Load(userID)
-	if exists {
-		log.Trace("SpamClients thing exists for user ID [%d]", userID)
-		spam := val.(SpamProtection)
-		if spam.TooFastCount >= maxTooFastCount {
-			log.Hack("User ID [%d] who spammed earlier came back, not accepting until spam timer expires", userID)
-			return
-		}
-		log.Trace("Wasn't spamming earlier")
-		spam.StopTimer <- true
+	if !startSession() {
+		log.Trace("Server is shutting down, not accepting user ID [%d]", userID)
+		http.Error(w, "Server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	defer sessionsWg.Done()
+
+	if !allowReconnect(userID) {
+		return
 	}
 
 	log.Trace("Upgrading user ID [%d] to websocket connection", userID)
-	wsConn, err := upgrader.Upgrade(w, r, nil)
+	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.WarnError(err.Error(), "Error upgrading connection of user ID [%d] to websocket protocol", userID)
 		return
 	}
 
+	runSession(userID, newWsConn(conn))
+}
+
+// runSession keeps a session going over the given connection until it ends,
+// whatever transport the connection uses
+func runSession(userID uint64, conn sessionConn) {
 	// session ID is used as key value for Clients hashmap to make it possible
 	// for a single user to connect to chat from multiple devices/browsers
 
@@ -145,45 +198,70 @@ func AcceptWsClient(userID uint64, w http.ResponseWriter, r *http.Request) {
 	// it's so they cant block each other
 	// they communicate using channels
 	wsClient := &WsClient{
-		SessionID: sessionID,
-		UserID:    userID,
-		WsConn:    wsConn,
-		WriteChan: make(chan []byte, 10),
-		CloseChan: make(chan bool),
+		SessionID:  sessionID,
+		UserID:     userID,
+		Conn:       conn,
+		resumeChan: make(chan resumeRequest),
 	}
+	wsClient.initOutbound()
+	wsClient.features.Store(legacyFeatures)
 
 	// add to wsClients
 	wsClients.Store(sessionID, wsClient)
 	defer wsClient.removeWsClient()
 
-	// create 2 goroutines for reading and writing messages
-	var wg sync.WaitGroup
-	wg.Add(2)
-
-	go wsClient.readMessages(&wg)
-	go wsClient.writeMessages(&wg)
-
 	log.Trace("Session ID [%d] as user ID [%d] has been added to WsClients", sessionID, userID)
 
-	// sends the initial data
+	// sends the initial data, it waits in WriteChan until the writing goroutine starts
 	wsClient.onInitialDataRequest(INITIAL_USER_DATA)
 
+	// create 2 goroutines for reading and writing messages
+	wg := wsClient.startGoroutines()
+
 	//setUserStatusText(userID, "Online")
+	broadcaster.PublishPresence(userID)
 	setUserOnline(userID, true)
 
-	// this will block here while both the reading and writing goroutine are running
-	// if one stops, the other should stop too
-	wg.Wait()
+	for {
+		// this will block here while both the reading and writing goroutine are running
+		// if one stops, the other should stop too
+		wg.Wait()
+
+		if wsClient.resumeTarget != nil {
+			if wsClient.handOver() {
+				return
+			}
+			// continue as a new session if the old one couldn't be resumed
+			wsClient.reply(macros.RespondFailureReason(macros.CodeFailed, "Failed resuming session"))
+		} else if wsClient.kicked || wsClient.overflowed.Load() || shuttingDown.Load() || !wsClient.waitForResume() {
+			return
+		}
+		wg = wsClient.startGoroutines()
+	}
+}
+
+func (c *WsClient) startGoroutines() *sync.WaitGroup {
+	c.CloseChan = make(chan bool, 1)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	go c.readMessages(&wg)
+	go c.writeMessages(&wg)
+
+	return &wg
 }
 
 func (c *WsClient) removeWsClient() {
 	log.Trace("Removing session ID [%d] from WsClients", c.SessionID)
 
-	c.WriteChan <- macros.RespondFailureReason("You sent too many packets in a short time")
-
-	err := c.WsConn.Close()
-	if err != nil {
-		log.WarnError(err.Error(), "Error while closing websocket for session ID [%d]", c.SessionID)
+	// connection is closed already if session was waiting to be resumed,
+	// or is used by another session if it was handed over
+	if c.Conn != nil && !c.handedOver {
+		err := c.Conn.Close()
+		if err != nil {
+			log.WarnError(err.Error(), "Error while closing websocket for session ID [%d]", c.SessionID)
+		}
 	}
 
 	clients.RemoveClient(c.SessionID)
@@ -191,32 +269,11 @@ func (c *WsClient) removeWsClient() {
 
 	sessions := clients.GetUserSessions(c.UserID)
 	if len(sessions) == 0 {
-		setUserOnline(c.UserID, false)
+		broadcaster.PublishPresence(c.UserID)
 
-		val, exists := spamClients.Load(c.UserID)
-		if !exists {
-			log.Error("Why user ID [%d] didn't exist in spamClients while trying to delete it? It was connected to websocket", c.UserID)
-			return
-		} else {
-			spam := val.(SpamProtection)
-			spam.Timer.Reset(deleteFromSpamProtectionAfter * time.Second)
-			log.Trace("Will remove user ID [%d] from spamClients in [%d] seconds, unless user rejoins earlier", deleteFromSpamProtectionAfter, spam.UserID)
-		}
-	}
-}
-
-func (s *SpamProtection) spamManager() {
-	defer spamClients.Delete(s.UserID)
-	defer s.Timer.Stop()
-
-	for {
-		select {
-		case <-s.Timer.C:
-			log.Trace("[%d] seconds passed, deleting user ID [%d] from spamClients", resetAfter/1000, s.UserID)
-			return
-		case <-s.StopTimer:
-			log.Trace("User ID [%d] came back early, no need to remove from spamClients anymore", s.UserID)
-			s.Timer.Stop()
+		// user may still be connected to another instance
+		if !clients.CheckIfUserIsOnline(c.UserID) {
+			setUserOnline(c.UserID, false)
 		}
 	}
 }
@@ -227,60 +284,20 @@ func (c *WsClient) readMessages(wg *sync.WaitGroup) {
 		wg.Done()
 	}()
 
-	c.WsConn.SetReadLimit(maxMessageSize) // received bytes after this limit will be discareded
-	c.WsConn.SetReadDeadline(time.Now().Add(timeout))
-	c.WsConn.SetPongHandler(func(string) error { c.WsConn.SetReadDeadline(time.Now().Add(timeout)); return nil })
 	for {
-		_, receivedBytes, err := c.WsConn.ReadMessage()
+		receivedBytes, err := c.Conn.ReadPacket()
 		if err != nil {
 			log.WarnError(err.Error(), "Failed reading message from session ID [%d] of user ID [%d]", c.SessionID, c.UserID)
 			break
 		}
 
-		val, exists := spamClients.LoadOrStore(c.UserID, SpamProtection{
-			UserID:           c.UserID,
-			LastMsgTimestamp: time.Now().UnixMilli(),
-			TooFastCount:     0,
-			Timer:            time.NewTimer(deleteFromSpamProtectionAfter * time.Second),
-			StopTimer:        make(chan bool),
-		})
-
-		spam := val.(SpamProtection)
-
-		if !exists {
-			spam.Timer.Stop()
-			go spam.spamManager()
-		}
-
-		currentTime := time.Now().UnixMilli()
-		difference := currentTime - spam.LastMsgTimestamp
-		log.Trace("Difference: %d", difference)
-		if difference < 1000 {
-			spam.TooFastCount++
-			//log.Warn("Too fast [%d] times", spam.TooFastCount)
-
-			if spam.TooFastCount > maxTooFastCount {
-				log.Hack("User ID [%d] sent too many messages in short time, disconnecting...", c.UserID)
-				break
-			}
-		} else if difference > resetAfter {
-			log.Trace("User ID [%d] hasn't sent messages for a while, resetting TooFastCount", c.UserID)
-			spam.TooFastCount = 0
-		}
-
-		spam.LastMsgTimestamp = time.Now().UnixMilli()
-
-		spamClients.Store(c.UserID, spam)
-
-		//time.Sleep(500 * time.Millisecond)
-
 		// check if array is at least 5 in length to avoid exceptions
 		// because if client sends smaller byte array for some reason,
 		// this func would throw an index out of range exception
 		// not supposed to happen in normal cases
 		if len(receivedBytes) < 5 {
 			log.Hack("Session ID [%d] as user ID [%d] sent a byte array shorter than 5 length", c.SessionID, c.UserID)
-			c.WriteChan <- macros.RespondFailureReason("Sent byte array length is less than 5")
+			c.reply(macros.RespondFailureReason(macros.CodeValidation, "Sent byte array length is less than 5"))
 			break
 		}
 
@@ -293,79 +310,74 @@ func (c *WsClient) readMessages(wg *sync.WaitGroup) {
 		if endIndex > uint32(len(receivedBytes)) {
 			log.Hack("User ID [%d] sent a byte array where the extracted endIndex was larger than the received byte array", c.UserID)
 			log.Hack("Byte array of user ID [%d]: [%s]", c.UserID, receivedBytes)
-			c.WriteChan <- macros.RespondFailureReason("Sent byte array is longer than the given endIndex value")
+			c.reply(macros.RespondFailureReason(macros.CodeValidation, "Sent byte array is longer than the given endIndex value"))
 			break
 		}
 
+		// client can put a request ID after the endIndex,
+		// it's sent back after the endIndex of the reply so client knows what it belongs to
+		c.reqID = 0
+		if uint32(len(receivedBytes)) >= endIndex+4 {
+			c.reqID = binary.LittleEndian.Uint32(receivedBytes[endIndex : endIndex+4])
+		}
+
 		// 5th byte is a 1 byte number which states the type of the packet
 		var packetType byte = receivedBytes[4]
 
 		// get the json byte array from the 6th byte to the end
 		var packetJson []byte = receivedBytes[5:endIndex]
+		if c.hasFeature(featureBinaryPayload) && packetType != HELLO {
+			packetJson, err = decodePayload(packetJson)
+			if err != nil {
+				log.Debug("Session ID [%d] of user ID [%d] sent packet type [%d] with invalid cbor payload: %s", c.SessionID, c.UserID, packetType, err.Error())
+				c.reply(macros.RespondFailureReason(macros.CodeValidation, "Payload of packet type [%d] isn't valid cbor", packetType))
+				continue
+			}
+		}
 
 		log.Trace("Received packet: endIndex [%d], type [%d], json [%s]", endIndex, packetType, string(packetJson))
-		switch packetType {
-		case ADD_CHAT_MESSAGE: // user sent a chat message on x channel
-			c.onAddChatMessageRequest(packetJson, packetType)
-		case CHAT_HISTORY: // user entered a channel, requesting chat history
-			c.onChatHistoryRequest(packetJson, packetType)
-		case DELETE_CHAT_MESSAGE: // user deleting a chat message
-			c.onChatMessageDeleteRequest(packetJson, packetType)
-		case STARTED_TYPING:
-			c.onChatMessageTyping(packetJson, packetType)
-		case EDIT_CHAT_MESSAGE:
-			c.onChatMessageEditRequest(packetJson, packetType)
-		case ADD_SERVER: // user adding a server
-			c.onAddServerRequest(packetJson, packetType)
-		case DELETE_SERVER: // user deleting a server
-			c.onServerDeleteRequest(packetJson, packetType)
-		case SERVER_INVITE_LINK: // user requested an invite link for a server
-			c.onServerInviteRequest(packetJson, packetType)
-		case UPDATE_SERVER_DATA: // user is requesting to update server data of their server
-			c.onServerDataUpdateRequest(packetJson, packetType)
-		case ADD_CHANNEL: // user added a channel to their server
-			c.onAddChannelRequest(packetJson, packetType)
-		case CHANNEL_LIST: // user entered a server, requesting channel list
-			c.onChannelListRequest(packetJson, packetType)
-		case DELETE_CHANNEL: // user wants to delete a channel
-			c.onChannelDeleteRequest(packetJson, packetType)
-		case UPDATE_CHANNEL_DATA: // user wants to change name of a channel
-			c.onChannelDataUpdateRequest(packetJson, packetType)
-		case SERVER_MEMBER_LIST: // user entered a server, requesting member list
-			c.onServerMemberListRequest(packetJson, packetType)
-		case DELETE_SERVER_MEMBER: // a user left a server
-			c.onLeaveServerRequest(packetJson, packetType)
-		case UPDATE_STATUS: // user wants to update their status value
-			c.onUpdateUserStatusValue(packetJson, packetType)
-		case ADD_FRIEND: // user wants to add another user as friend
-			c.onAddFriendRequest(packetJson, packetType)
-		case BLOCK_USER: // user wants to block a user
-			c.onBlockUserRequest(packetJson, packetType)
-		case UNFRIEND: // user wants to unfriend a user
-			c.onUnfriendRequest(packetJson, packetType)
-		case OPEN_DM: // user wants to open a dm
-			c.onOpenDmRequest(packetJson, packetType)
-		case REQUEST_DM_LIST: // user requests list of direct messages they have
-			c.WriteChan <- macros.PreparePacket(packetType, database.GetDmListOfUser(c.UserID))
-		//case ADD_DM_CHAT_MESSAGE:
-		//	c.onAddChatMessageRequest(packetJson, packetType, true)
-		case INITIAL_USER_DATA: // user requests initial data
-			c.onInitialDataRequest(packetType)
-		case IMAGE_HOST_ADDRESS:
-			c.onImageHostAddressRequest(packetType)
-		case UPDATE_USER_DATA: // user wants to update their account data
-			c.onUpdateUserDataRequest(packetJson, packetType)
-		default: // if unknown
-			log.Hack("User ID [%d] sent invalid packet type: [%d]", c.UserID, packetType)
-			c.WriteChan <- macros.RespondFailureReason("Packet type is invalid")
+		c.dispatch(packetType, packetJson)
+
+		// connection is closed, or handed over to the session being resumed
+		if c.kicked || c.resumeTarget != nil {
+			return
 		}
 	}
 }
 
+// reply sends a packet to the session as the response to the packet being handled,
+// the request ID of it is appended after the endIndex if client gave one
+func (c *WsClient) reply(packet []byte) {
+	if c.reqID == 0 {
+		c.send(packet)
+		return
+	}
+
+	var tagged []byte = make([]byte, len(packet)+4)
+	copy(tagged, packet)
+	binary.LittleEndian.PutUint32(tagged[len(packet):], c.reqID)
+	c.send(tagged)
+}
+
+// replyBroadcast tells the session that its request is done when the result is broadcast,
+// it gets the broadcast packet tagged with its request ID, without one it only gets the broadcast,
+// nil packet is a broadcast that failed and was already logged
+func (c *WsClient) replyBroadcast(packet []byte) {
+	if c.reqID != 0 && packet != nil {
+		c.reply(packet)
+	}
+}
+
 func (c *WsClient) writeMessages(wg *sync.WaitGroup) {
 	ticker := time.NewTicker(pingPeriod) // client will be pinged in intervals using this
 	defer ticker.Stop()
 	defer wg.Done()
+	defer func() {
+		// a slow session won't be resumed, it's disconnected once the writing stopped
+		if c.overflowed.Load() {
+			c.evict()
+		}
+	}()
 
 	errorWriting := func(errMsg string) {
 		log.WarnError(errMsg, "Error writing message to session ID [%d] as user ID [%d]", c.SessionID, c.UserID)
@@ -374,16 +386,27 @@ func (c *WsClient) writeMessages(wg *sync.WaitGroup) {
 	for {
 		select {
 		case messageBytes := <-c.WriteChan:
-			c.WsConn.SetWriteDeadline(time.Now().Add(timeoutWrite))
-			if err := c.WsConn.WriteMessage(websocket.BinaryMessage, messageBytes); err != nil {
+			c.dequeued(messageBytes)
+			if err := c.writePacket(messageBytes); err != nil {
 				errorWriting(err.Error())
 				return
 			}
-			log.Trace("Wrote to user ID [%d] session token [%d]", c.UserID, c.SessionID)
+		case <-c.pendingSignal:
+			pending := c.takePending()
+			for i := 0; i < len(pending); i++ {
+				if err := c.writePacket(pending[i]); err != nil {
+					errorWriting(err.Error())
+					return
+				}
+			}
+		case <-c.evictChan:
+			return
+		case <-shutdownChan:
+			c.sendShutdown()
+			return
 		case <-ticker.C:
 			// log.Trace("Pinging:", c.userID)
-			c.WsConn.SetWriteDeadline(time.Now().Add(timeoutWrite))
-			if err := c.WsConn.WriteMessage(websocket.PingMessage, nil); err != nil {
+			if err := c.Conn.Ping(); err != nil {
 				errorWriting(err.Error())
 				return
 			}
@@ -396,100 +419,91 @@ func (c *WsClient) writeMessages(wg *sync.WaitGroup) {
 	}
 }
 
+func (c *WsClient) writePacket(messageBytes []byte) error {
+	// sequence numbers are always kept track of, but only sent if client asked for them
+	sequenced := c.sequencePacket(messageBytes)
+	if c.hasFeature(featureResume) {
+		messageBytes = sequenced
+	}
+	if err := c.writeToConn(messageBytes); err != nil {
+		return err
+	}
+	log.Trace("Wrote to user ID [%d] session token [%d]", c.UserID, c.SessionID)
+	return nil
+}
+
+// writeToConn sends the packet in the payload encoding and with the compression client asked for
+func (c *WsClient) writeToConn(packet []byte) error {
+	if c.hasFeature(featureBinaryPayload) {
+		encoded, err := encodePayload(packet)
+		if err != nil {
+			log.WarnError(err.Error(), "Error converting payload of packet type [%d] to cbor for session ID [%d]", packet[4], c.SessionID)
+			return err
+		}
+		packet = encoded
+	}
+	return c.Conn.WritePacket(packet, c.hasFeature(featureCompression))
+}
+
+// broadCastChannel hands the broadcasts to the broadcaster,
+// which delivers them to the sessions of this and every other instance
 func broadCastChannel() {
 	log.Trace("Started broadcasting...")
+	for {
+		select {
+		case broadcastData := <-broadcastChan:
+			broadcaster.Publish(broadcastData)
+		}
+	}
+}
+
+// deliverBroadcast sends a broadcast to the affected sessions connected to this instance
+func deliverBroadcast(broadcastData BroadcastData) {
 	broadcastLog := func(typ byte, userID uint64, session uint64) {
 		log.Trace("Broadcasting message type [%d] to user ID [%d] session token [%d]", typ, userID, session)
 	}
 
-	for {
-		select {
-		case broadcastData := <-broadcastChan:
-			switch broadcastData.Type {
-			case ADD_CHAT_MESSAGE, DELETE_CHAT_MESSAGE, STARTED_TYPING, EDIT_CHAT_MESSAGE: // things that only affect a single channel
-				wsClients.Range(func(key, value interface{}) bool {
-					wsClient, ok := value.(*WsClient)
-					if !ok {
-						log.Warn("Invalid WsClient")
-						return true
-					}
-					channelID := clients.GetCurrentChannelID(wsClient.SessionID)
-					if channelID == 0 {
-						return true
-					}
-					if channelID == broadcastData.AffectedChannel { // if client is in affected channel
-						broadcastLog(broadcastData.Type, wsClient.UserID, wsClient.SessionID)
-						wsClient.WriteChan <- broadcastData.MessageBytes
-					}
-					return true
-				})
-			case ADD_CHANNEL, DELETE_CHANNEL, ADD_SERVER_MEMBER, DELETE_SERVER_MEMBER, UPDATE_CHANNEL_DATA: // things that only affect a single server
-				wsClients.Range(func(key, value interface{}) bool {
-					wsClient, ok := value.(*WsClient)
-					if !ok {
-						log.Warn("Invalid WsClient")
-						return true
-					}
-					serverID, found := clients.GetCurrentServerID(wsClient.SessionID)
-					if !found {
-						return true
-					}
-					if serverID == broadcastData.AffectedServers[0] { // if client is currently in that server
-						broadcastLog(broadcastData.Type, wsClient.UserID, wsClient.SessionID)
-						wsClient.WriteChan <- broadcastData.MessageBytes
-					}
-					return true
-				})
-
-			case UPDATE_MEMBER_PROFILE_PIC, UPDATE_ONLINE, UPDATE_STATUS, UPDATE_MEMBER_DATA: // if client is currently on an affected server
-				wsClients.Range(func(key, value interface{}) bool {
-					wsClient, ok := value.(*WsClient)
-					if !ok {
-						log.Warn("Invalid WsClient")
-						return true
-					}
-					for s := 0; s < len(broadcastData.AffectedServers); s++ {
-						serverID, found := clients.GetCurrentServerID(wsClient.SessionID)
-						if !found {
-							log.Warn("Failed to get current server ID for session ID [%d] as user ID [%d]", wsClient.SessionID, wsClient.UserID)
-							return true
-						}
-						if serverID == broadcastData.AffectedServers[s] { // if client is member of any affected server
-							broadcastLog(broadcastData.Type, wsClient.UserID, wsClient.SessionID)
-							wsClient.WriteChan <- broadcastData.MessageBytes
-						}
-					}
-					return true
-				})
-			case UPDATE_USER_DATA, UPDATE_USER_PROFILE_PIC, ADD_SERVER: // things that only affect a single user, sending to all connected sessions/devices
-				wsClients.Range(func(key, value interface{}) bool {
-					wsClient, ok := value.(*WsClient)
-					if !ok {
-						log.Warn("Invalid WsClient")
-						return true
-					}
-					if wsClient.UserID == broadcastData.AffectedUserID[0] {
-						broadcastLog(broadcastData.Type, wsClient.UserID, wsClient.SessionID)
-						wsClient.WriteChan <- broadcastData.MessageBytes
-					}
-					return true
-				})
-			case ADD_FRIEND, BLOCK_USER, UNFRIEND, UPDATE_SERVER_PIC, DELETE_SERVER, UPDATE_SERVER_DATA, UPDATE_SERVER_BANNER: // things that affect multiple users directly
-				wsClients.Range(func(key, value interface{}) bool {
-					wsClient, ok := value.(*WsClient)
-					if !ok {
-						log.Warn("Invalid WsClient")
-						return true
-					}
-					for u := 0; u < len(broadcastData.AffectedUserID); u++ {
-						if wsClient.UserID == broadcastData.AffectedUserID[u] {
-							broadcastLog(broadcastData.Type, wsClient.UserID, wsClient.SessionID)
-							wsClient.WriteChan <- broadcastData.MessageBytes
-						}
-					}
-					return true
-				})
-			}
+	var sessionIDs []uint64
+	switch broadcastData.Type {
+	case ADD_CHAT_MESSAGE, DELETE_CHAT_MESSAGE, STARTED_TYPING, EDIT_CHAT_MESSAGE, THREAD_UPDATE, ADD_REACTION, REMOVE_REACTION, PIN_MESSAGE, UNPIN_MESSAGE, MESSAGES_PRUNED, CREATE_POLL, POLL_UPDATE: // things that only affect a single channel or thread
+		sessionIDs = clients.GetChannelSessions(broadcastData.AffectedChannel)
+	case ADD_CHANNEL, DELETE_CHANNEL, ADD_SERVER_MEMBER, DELETE_SERVER_MEMBER, UPDATE_CHANNEL_DATA: // things that only affect a single server
+		sessionIDs = clients.GetServerSessions(broadcastData.AffectedServers[:1])
+	case UPDATE_MEMBER_PROFILE_PIC, UPDATE_ONLINE, UPDATE_STATUS, UPDATE_MEMBER_DATA: // if client is currently on an affected server
+		sessionIDs = clients.GetServerSessions(broadcastData.AffectedServers)
+	case UPDATE_USER_DATA, UPDATE_USER_PROFILE_PIC, ADD_SERVER, ACK_MENTION, ACK_CHANNEL, SCHEDULE_MESSAGE, EDIT_SCHEDULED, CANCEL_SCHEDULED: // things that only affect a single user, sending to all connected sessions/devices
+		sessionIDs = clients.GetUserSessions(broadcastData.AffectedUserID[0])
+	case ADD_FRIEND, BLOCK_USER, UNFRIEND, UPDATE_SERVER_PIC, DELETE_SERVER, UPDATE_SERVER_DATA, UPDATE_SERVER_BANNER, EMOJI_UPDATE, MENTION: // things that affect multiple users directly
+		sessionIDs = clients.GetSessionsOfUsers(broadcastData.AffectedUserID)
+	}
+
+	// the leaving user may have sessions subscribed to channels of the server on this instance too
+	if broadcastData.Type == DELETE_SERVER_MEMBER && broadcastData.SourceUserID != 0 {
+		clients.UnsubscribeUserFromServer(broadcastData.SourceUserID, broadcastData.AffectedServers[0])
+	}
+
+	for i := 0; i < len(sessionIDs); i++ {
+		value, found := wsClients.Load(sessionIDs[i])
+		if !found {
+			continue
+		}
+		wsClient, ok := value.(*WsClient)
+		if !ok {
+			log.Warn("Invalid WsClient")
+			continue
+		}
+		broadcastLog(broadcastData.Type, wsClient.UserID, wsClient.SessionID)
+
+		// sending never waits for the session, so a stuck one can't hold up the others
+		switch broadcastData.Type {
+		case STARTED_TYPING, UPDATE_ONLINE: // only the latest state matters
+			wsClient.sendCoalesced(coalesceKey{
+				packetType: broadcastData.Type,
+				userID:     broadcastData.SourceUserID,
+				channelID:  broadcastData.AffectedChannel,
+			}, broadcastData.MessageBytes)
+		default:
+			wsClient.send(broadcastData.MessageBytes)
 		}
 	}
 }
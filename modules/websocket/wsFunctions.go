@@ -11,33 +11,19 @@ import (
 	"encoding/json"
 	"fmt"
 	"strconv"
+	"strings"
 	"time"
 )
 
-// when client is requesting to add a new channel, type 31
-func (c *WsClient) onAddChannelRequest(packetJson []byte, packetType byte) {
-	type AddChannelRequest struct {
-		Name     string
-		ServerID uint64
-	}
-
-	var channelRequest = AddChannelRequest{}
-
-	if err := json.Unmarshal(packetJson, &channelRequest); err != nil {
-		c.WriteChan <- macros.ErrorDeserializing(err.Error(), packetType, c.UserID)
-		return
-	}
+type AddChannelRequest struct {
+	Name     string
+	ServerID uint64
+}
 
+// when client is requesting to add a new channel, type 31
+func (c *WsClient) onAddChannelRequest(channelRequest AddChannelRequest, ctx packetContext) {
 	var errorMessage = fmt.Sprintf("Error adding channel called [%s]", channelRequest.Name)
 
-	// check if client is authorized to add channel to given server
-	var ownerID uint64 = database.GetServerOwner(channelRequest.ServerID)
-	if ownerID != c.UserID {
-		log.Hack("User [%d] is trying to add a channel to server ID [%d] that they dont own", c.UserID, channelRequest.ServerID)
-		c.WriteChan <- macros.RespondFailureReason("%s", errorMessage)
-		return
-	}
-
 	var channelID uint64 = snowflake.Generate()
 
 	// insert into database
@@ -49,7 +35,7 @@ func (c *WsClient) onAddChannelRequest(packetJson []byte, packetType byte) {
 
 	err := database.Insert(channel)
 	if err != nil {
-		c.WriteChan <- macros.RespondFailureReason("%s", errorMessage)
+		c.reply(macros.RespondFailureReason(macros.CodeFailed, "%s", errorMessage))
 		return
 	}
 
@@ -66,170 +52,215 @@ func (c *WsClient) onAddChannelRequest(packetJson []byte, packetType byte) {
 
 	messagesBytes, err := json.Marshal(channelResponse)
 	if err != nil {
-		macros.ErrorSerializing(err.Error(), packetType, c.UserID)
+		macros.ErrorSerializing(err.Error(), ctx.packetType, c.UserID)
 		return
 	}
 
+	packet := macros.PreparePacket(ctx.packetType, messagesBytes)
+	c.replyBroadcast(packet)
 	broadcastChan <- BroadcastData{
-		MessageBytes:    macros.PreparePacket(packetType, messagesBytes),
-		Type:            packetType,
+		MessageBytes:    packet,
+		Type:            ctx.packetType,
 		AffectedServers: []uint64{channelRequest.ServerID},
 	}
 }
 
-func (c *WsClient) onChannelDeleteRequest(packetJson []byte, packetType byte) {
-	type ChannelToDelete struct {
-		ChannelID uint64
-	}
-
-	var req ChannelToDelete
-
-	if err := json.Unmarshal(packetJson, &req); err != nil {
-		c.WriteChan <- macros.ErrorDeserializing(err.Error(), packetType, c.UserID)
-		return
-	}
-
-	serverID := database.GetServerIdOfChannel(req.ChannelID)
-
-	ownerID := database.GetServerOwner(serverID)
-
-	if ownerID != c.UserID {
-		c.WriteChan <- macros.RespondFailureReason("Denied deleting channel ID [%d]", req.ChannelID)
-		return
-	}
+type ChannelToDelete struct {
+	ChannelID uint64
+}
 
+func (c *WsClient) onChannelDeleteRequest(req ChannelToDelete, ctx packetContext) {
 	channelDeletion := database.ChannelDelete{
 		ChannelID: req.ChannelID,
-		ServerID:  serverID,
+		ServerID:  ctx.serverID,
 	}
 
 	success := database.Delete(channelDeletion)
 	if !success {
-		c.WriteChan <- macros.RespondFailureReason("Error deleting channel ID [%d]", req.ChannelID)
+		c.reply(macros.RespondFailureReason(macros.CodeFailed, "Error deleting channel ID [%d]", req.ChannelID))
 		return
 	}
 
 	messagesBytes, err := json.Marshal(channelDeletion)
 	if err != nil {
-		macros.ErrorSerializing(err.Error(), packetType, c.UserID)
+		macros.ErrorSerializing(err.Error(), ctx.packetType, c.UserID)
 		return
 	}
 
+	packet := macros.PreparePacket(ctx.packetType, messagesBytes)
+	c.replyBroadcast(packet)
 	broadcastChan <- BroadcastData{
-		MessageBytes:    macros.PreparePacket(packetType, messagesBytes),
-		Type:            packetType,
-		AffectedServers: []uint64{serverID},
+		MessageBytes:    packet,
+		Type:            ctx.packetType,
+		AffectedServers: []uint64{ctx.serverID},
 	}
 }
 
-func (c *WsClient) onChannelDataUpdateRequest(packetJson []byte, packetType byte) {
-	type UpdateChannelDataRequest struct {
-		ChannelID uint64
-		Name      string
-		NewCN     bool
-	}
+type UpdateChannelDataRequest struct {
+	ChannelID     uint64
+	Name          string
+	NewCN         bool
+	RetentionDays int // 0 to use the policy of the server
+	NewRD         bool
+	Topic         string
+	NewTP         bool
+}
 
-	var req UpdateChannelDataRequest
+const maxTopicLength = 256 // bytes
 
-	err := json.Unmarshal(packetJson, &req)
-	if err != nil {
-		c.WriteChan <- macros.ErrorDeserializing(err.Error(), packetType, c.UserID)
+func (c *WsClient) onChannelDataUpdateRequest(req UpdateChannelDataRequest, ctx packetContext) {
+	if !req.NewCN && !req.NewRD && !req.NewTP {
+		c.reply(macros.RespondFailureReason(macros.CodeValidation, "Nothing to change"))
 		return
 	}
 
-	serverID := database.GetServerIdOfChannel(req.ChannelID)
-	ownerID := database.GetServerOwner(serverID)
-
-	if ownerID != c.UserID {
-		log.Hack("User ID [%d] tries to update data of channel ID [%d] without permission", c.UserID, req.ChannelID)
-		c.WriteChan <- macros.RespondFailureReason("Denied updating data of channel ID [%d]", req.ChannelID)
+	// every field is checked before any is changed, so a rejected request changes nothing
+	if req.NewRD && !checkRetentionDays(req.RetentionDays) {
+		c.reply(macros.RespondFailureReason(macros.CodeValidation, "Retention period has to be between 0 and %d days", maxRetentionDays))
 		return
 	}
+	if req.NewTP {
+		req.Topic = strings.TrimSpace(req.Topic)
+		if len(req.Topic) > maxTopicLength {
+			c.reply(macros.RespondFailureReason(macros.CodeValidation, "Topic can't be longer than %d bytes", maxTopicLength))
+			return
+		}
+	}
 
 	// update channel name
 	if req.NewCN {
 		success := database.ChangeChannelName(req.ChannelID, req.Name)
 		if !success {
 			log.Hack("Couldn't change name of channel ID [%d] to [%s] requested by user ID [%d]", req.ChannelID, req.Name, c.UserID)
-			c.WriteChan <- macros.RespondFailureReason("Failed changing name of channel ID [%d]", req.ChannelID)
+			c.reply(macros.RespondFailureReason(macros.CodeFailed, "Failed changing name of channel ID [%d]", req.ChannelID))
 			return
 		}
+	}
 
-		jsonBytes, err := json.Marshal(req)
-		if err != nil {
-			macros.ErrorSerializing(err.Error(), packetType, c.UserID)
+	// update how long messages of the channel are kept
+	if req.NewRD {
+		success := database.SetChannelRetention(req.ChannelID, req.RetentionDays)
+		if !success {
+			c.reply(macros.RespondFailureReason(macros.CodeFailed, "Failed changing retention period of channel ID [%d]", req.ChannelID))
 			return
 		}
+	}
 
-		broadcastChan <- BroadcastData{
-			MessageBytes:    macros.PreparePacket(packetType, jsonBytes),
-			Type:            packetType,
-			AffectedServers: []uint64{serverID},
+	// update what the channel is about
+	if req.NewTP {
+		success := database.SetChannelTopic(req.ChannelID, req.Topic)
+		if !success {
+			c.reply(macros.RespondFailureReason(macros.CodeFailed, "Failed changing topic of channel ID [%d]", req.ChannelID))
+			return
 		}
 	}
-}
 
-// when client requests list of server they are in, type 32
-func (c *WsClient) onChannelListRequest(packetJson []byte, packetType byte) {
-	type ChannelListRequest struct {
-		ServerID uint64
+	jsonBytes, err := json.Marshal(req)
+	if err != nil {
+		macros.ErrorSerializing(err.Error(), ctx.packetType, c.UserID)
+		return
 	}
 
-	var channelListRequest ChannelListRequest
+	packet := macros.PreparePacket(ctx.packetType, jsonBytes)
+	c.replyBroadcast(packet)
+	broadcastChan <- BroadcastData{
+		MessageBytes:    packet,
+		Type:            ctx.packetType,
+		AffectedServers: []uint64{ctx.serverID},
+	}
+}
 
-	if err := json.Unmarshal(packetJson, &channelListRequest); err != nil {
-		macros.ErrorDeserializing(err.Error(), packetType, c.UserID)
+type SubscribeChannelRequest struct {
+	ChannelID uint64
+}
+
+// when client wants to receive events of a channel without viewing it, type 35
+func (c *WsClient) onSubscribeChannelRequest(req SubscribeChannelRequest, ctx packetContext) {
+	success := clients.SubscribeChannel(c.SessionID, req.ChannelID, ctx.serverID)
+	if !success {
+		c.reply(macros.RespondFailureReason(macros.CodeValidation, "Can't subscribe to more than %d channels", clients.MaxChannelSubscriptions))
 		return
 	}
 
-	var serverID uint64 = channelListRequest.ServerID
-
-	var isMember bool = database.ConfirmServerMembership(c.UserID, serverID)
-	if isMember {
-		success := clients.SetCurrentServerID(c.SessionID, serverID)
-		if !success {
-			log.Impossible("Failed setting current server ID to [%d] for user ID [%d] in onChannelListRequest", serverID, c.UserID)
-			return
-		}
-		var jsonBytes []byte = database.GetChannelList(serverID)
-		c.WriteChan <- macros.PreparePacket(packetType, jsonBytes)
-	} else {
-		c.WriteChan <- macros.RespondFailureReason("Rejected sending channel list of server ID [%d]", serverID)
+	jsonBytes, err := json.Marshal(req)
+	if err != nil {
+		macros.ErrorSerializing(err.Error(), ctx.packetType, c.UserID)
+		return
 	}
+
+	c.reply(macros.PreparePacket(ctx.packetType, jsonBytes))
 }
 
-func (c *WsClient) onAddChatMessageRequest(packetJson []byte, packetType byte) {
-	type ClientChatMsg struct {
-		ChannelID uint64
-		Message   string
-		AttTok    string
-		ReplyID   uint64
+type UnsubscribeChannelRequest struct {
+	ChannelID uint64
+}
+
+// when client no longer wants to receive events of a subscribed channel, type 36
+func (c *WsClient) onUnsubscribeChannelRequest(req UnsubscribeChannelRequest, ctx packetContext) {
+	success := clients.UnsubscribeChannel(c.SessionID, req.ChannelID)
+	if !success {
+		c.reply(macros.RespondFailureReason(macros.CodeNotFound, "Not subscribed to channel ID [%d]", req.ChannelID))
+		return
 	}
 
-	var req ClientChatMsg
+	jsonBytes, err := json.Marshal(req)
+	if err != nil {
+		macros.ErrorSerializing(err.Error(), ctx.packetType, c.UserID)
+		return
+	}
+
+	c.reply(macros.PreparePacket(ctx.packetType, jsonBytes))
+}
 
-	if err := json.Unmarshal(packetJson, &req); err != nil {
-		c.WriteChan <- macros.ErrorDeserializing(err.Error(), packetType, c.UserID)
+type ChannelListRequest struct {
+	ServerID uint64
+}
+
+// when client requests list of server they are in, type 32
+func (c *WsClient) onChannelListRequest(channelListRequest ChannelListRequest, ctx packetContext) {
+	var serverID uint64 = channelListRequest.ServerID
+
+	success := clients.SetCurrentServerID(c.SessionID, serverID)
+	if !success {
+		log.Impossible("Failed setting current server ID to [%d] for user ID [%d] in onChannelListRequest", serverID, c.UserID)
 		return
 	}
+	var jsonBytes []byte = database.GetChannelList(serverID)
+	c.reply(macros.PreparePacket(ctx.packetType, jsonBytes))
+}
 
+type ClientChatMsg struct {
+	ChannelID uint64
+	Message   string
+	AttTok    string
+	ReplyID   uint64
+	ThreadID  uint64 // set when replying in a thread
+}
+
+func (c *WsClient) onAddChatMessageRequest(req ClientChatMsg, ctx packetContext) {
 	var rejectMessage = fmt.Sprintf("Denied sending chat message to channel ID [%d]", req.ChannelID)
 
-	// check if user is member of the server which the channel belongs to
-	serverID := database.GetServerIdOfChannel(req.ChannelID)
-	if serverID == 0 {
-		c.WriteChan <- macros.RespondFailureReason("%s", rejectMessage)
-		return
+	if req.ThreadID != 0 {
+		thread, exists := database.GetThread(req.ThreadID)
+		if !exists || thread.ChannelID != req.ChannelID {
+			c.reply(macros.RespondFailureReason(macros.CodeNotFound, "Thread ID [%d] doesn't exist in channel ID [%d]", req.ThreadID, req.ChannelID))
+			return
+		}
 	}
-	if !database.ConfirmServerMembership(c.UserID, serverID) {
-		c.WriteChan <- macros.RespondFailureReason("%s", rejectMessage)
-		return
+
+	// messages starting with a slash are commands, some of them still send a message
+	if strings.HasPrefix(req.Message, "/") {
+		message, send := c.runCommand(req, ctx)
+		if !send {
+			return
+		}
+		req.Message = message
 	}
 
 	attachmentToken, err := base64.StdEncoding.DecodeString(req.AttTok)
 	if err != nil {
 		log.Hack("User ID [%d] sent an attachmentToken base64 string that can't be decoded", c.UserID)
-		c.WriteChan <- macros.RespondFailureReason("%s", rejectMessage)
+		c.reply(macros.RespondFailureReason(macros.CodeValidation, "%s", rejectMessage))
 		return
 	}
 
@@ -238,177 +269,227 @@ func (c *WsClient) onAddChatMessageRequest(packetJson []byte, packetType byte) {
 		uploadedAttachments = attachments.GetWaitingAttachment([64]byte(attachmentToken))
 	}
 
-	var messageID = snowflake.Generate()
+	packet := postChatMessage(database.Message{
+		MessageID: snowflake.Generate(),
+		ChannelID: req.ChannelID,
+		UserID:    c.UserID,
+		Message:   req.Message,
+		ReplyID:   req.ReplyID,
+		ThreadID:  req.ThreadID,
+	}, attachmentResponses(uploadedAttachments), ctx.serverID)
+	c.replyBroadcast(packet)
+}
 
-	hasAttachments := false
-	if req.AttTok != "" {
-		hasAttachments = true
+// attachmentResponses turns attachments claimed with an attachment token into what is saved and sent to clients
+func attachmentResponses(uploadedAttachments []attachments.UploadedAttachment) []database.AttachmentResponse {
+	var attachmentList []database.AttachmentResponse
+	for i := 0; i < len(uploadedAttachments); i++ {
+		attachmentResp := database.AttachmentResponse{
+			Hash: uploadedAttachments[i].Hash[:],
+			Name: uploadedAttachments[i].Name,
+		}
+		attachmentList = append(attachmentList, attachmentResp)
 	}
+	return attachmentList
+}
+
+// postChatMessage saves the message with its attachments and sends it to the sessions viewing its channel or thread,
+// used for messages sent by clients and for scheduled messages when their time comes,
+// returns the broadcast packet, nil if it couldn't be sent
+func postChatMessage(msg database.Message, attachmentList []database.AttachmentResponse, serverID uint64) []byte {
+	msg.HasAttachments = len(attachmentList) > 0
 
-	err = database.Insert(database.Message{
-		MessageID:      messageID,
-		ChannelID:      req.ChannelID,
-		UserID:         c.UserID,
-		Message:        req.Message,
-		HasAttachments: hasAttachments,
-		ReplyID:        req.ReplyID,
-	})
+	err := database.Insert(msg)
 	if err != nil {
-		log.FatalError(err.Error(), "Fatal error inserting message ID [%d] into database of user ID [%d]", messageID, c.UserID)
-		return
+		log.FatalError(err.Error(), "Fatal error inserting message ID [%d] into database of user ID [%d]", msg.MessageID, msg.UserID)
+		return nil
 	}
 
-	log.Trace("Message ID [%d] will have [%d] attachmentList", messageID, len(uploadedAttachments))
-	for i := 0; i < len(uploadedAttachments); i++ {
+	log.Trace("Message ID [%d] will have [%d] attachmentList", msg.MessageID, len(attachmentList))
+	for i := 0; i < len(attachmentList); i++ {
 		attachment := database.Attachment{
-			Hash:      uploadedAttachments[i].Hash[:],
-			MessageID: messageID,
-			Name:      uploadedAttachments[i].Name,
+			Hash:      attachmentList[i].Hash,
+			MessageID: msg.MessageID,
+			Name:      attachmentList[i].Name,
 		}
 		err := database.Insert(attachment)
 		if err != nil {
-			log.FatalError(err.Error(), "Fatal error inserting attachment of message ID [%d] into database of user ID [%d]", messageID, c.UserID)
-			return
+			log.FatalError(err.Error(), "Fatal error inserting attachment of message ID [%d] into database of user ID [%d]", msg.MessageID, msg.UserID)
+			return nil
 		}
 	}
 
-	var attachmentList []database.AttachmentResponse
-	for i := 0; i < len(uploadedAttachments); i++ {
-		attachmentResp := database.AttachmentResponse{
-			Hash: uploadedAttachments[i].Hash[:],
-			Name: uploadedAttachments[i].Name,
-		}
-		attachmentList = append(attachmentList, attachmentResp)
-	}
-
 	type ChatMessageResponse struct {
-		MsgID  uint64
-		UserID uint64
-		Msg    string
-		Att    []database.AttachmentResponse
-		RepID  uint64
+		ChannelID uint64
+		MsgID     uint64
+		UserID    uint64
+		Msg       string
+		Att       []database.AttachmentResponse
+		RepID     uint64
+		ThreadID  uint64
 	}
 
 	var serverChatMsg = ChatMessageResponse{
-		MsgID:  messageID,
-		UserID: c.UserID,
-		Msg:    req.Message,
-		Att:    attachmentList,
-		RepID:  req.ReplyID,
+		ChannelID: msg.ChannelID,
+		MsgID:     msg.MessageID,
+		UserID:    msg.UserID,
+		Msg:       msg.Message,
+		Att:       attachmentList,
+		RepID:     msg.ReplyID,
+		ThreadID:  msg.ThreadID,
 	}
 
 	jsonBytes, err := json.Marshal(serverChatMsg)
 	if err != nil {
-		macros.ErrorSerializing(err.Error(), packetType, c.UserID)
-		return
+		macros.ErrorSerializing(err.Error(), ADD_CHAT_MESSAGE, msg.UserID)
+		return nil
+	}
+
+	packet := macros.PreparePacket(ADD_CHAT_MESSAGE, jsonBytes)
+
+	// replies in a thread only go to sessions that have the thread open
+	if msg.ThreadID != 0 {
+		broadcastChan <- BroadcastData{
+			MessageBytes:    packet,
+			Type:            ADD_CHAT_MESSAGE,
+			AffectedChannel: msg.ThreadID,
+		}
+
+		thread, exists := database.AddThreadReply(msg.ThreadID, time.Now().UnixMilli())
+		if exists {
+			broadcastThreadUpdate(thread)
+		}
+		notifyMentions(msg.UserID, msg.Message, msg.MessageID, msg.ChannelID, msg.ThreadID, serverID)
+		return packet
 	}
 
 	broadcastChan <- BroadcastData{
-		MessageBytes:    macros.PreparePacket(packetType, jsonBytes),
-		Type:            packetType,
-		AffectedChannel: req.ChannelID,
+		MessageBytes:    macros.PreparePacket(ADD_CHAT_MESSAGE, jsonBytes),
+		Type:            ADD_CHAT_MESSAGE,
+		AffectedChannel: msg.ChannelID,
 	}
+
+	notifyMentions(msg.UserID, msg.Message, msg.MessageID, msg.ChannelID, 0, serverID)
+	return packet
 }
 
-// when client is requesting chat history for a channel, type 2
-func (c *WsClient) onChatHistoryRequest(packetJson []byte, packetType byte) {
-	type ChatHistoryRequest struct {
-		ChannelID     uint64
-		FromMessageID uint64
-		Dm            bool
-		Older         bool
-	}
+const defaultHistoryPageSize = 50
 
-	var req ChatHistoryRequest
+// MaxHistoryPageSize is the most messages a client can request in one page of history,
+// set from config.json
+var MaxHistoryPageSize = 100
 
-	if err := json.Unmarshal(packetJson, &req); err != nil {
-		c.WriteChan <- macros.ErrorDeserializing(err.Error(), packetType, c.UserID)
-		return
+// historyPageSize gives the default size if client didn't ask for one, and caps it at the server limit
+func historyPageSize(requested int) int {
+	if requested <= 0 {
+		return defaultHistoryPageSize
+	}
+	if requested > MaxHistoryPageSize {
+		return MaxHistoryPageSize
 	}
+	return requested
+}
 
-	success := clients.SetCurrentChannelID(c.SessionID, req.ChannelID)
+type ChatHistoryRequest struct {
+	ChannelID     uint64
+	FromMessageID uint64 // 0 for the newest messages
+	Dm            bool
+	Older         bool // messages older than FromMessageID if true, newer if false
+	Around        bool // FromMessageID with messages from both sides, used to jump to a message
+	Limit         int
+}
+
+// when client is requesting chat history for a channel, type 2
+func (c *WsClient) onChatHistoryRequest(req ChatHistoryRequest, ctx packetContext) {
+	success := clients.SetCurrentChannelID(c.SessionID, req.ChannelID, ctx.serverID)
 	if !success {
 		log.Impossible("Failed setting current channel ID to [%d] for user ID [%d] in onChatHistoryRequest", req.ChannelID, c.UserID)
 		return
 	}
-	const rejectionMessage = "Denied chat history request"
 
-	// check if user is member of server the channel is part of
-	serverID := database.GetServerIdOfChannel(req.ChannelID)
-	if serverID == 0 {
-		c.WriteChan <- macros.RespondFailureReason(rejectionMessage)
-		return
-	}
-	if !database.ConfirmServerMembership(c.UserID, serverID) {
-		c.WriteChan <- macros.RespondFailureReason(rejectionMessage)
-		return
+	page := database.HistoryPage{FromID: req.FromMessageID, Limit: historyPageSize(req.Limit)}
+	switch {
+	case req.FromMessageID == 0:
+		page.Direction = database.HistoryLatest
+	case req.Around:
+		page.Direction = database.HistoryAround
+	case req.Older:
+		page.Direction = database.HistoryBefore
+	default:
+		page.Direction = database.HistoryAfter
 	}
 
-	var jsonBytes []byte = database.GetChatHistory(req.ChannelID, req.FromMessageID, req.Older, c.UserID)
+	var jsonBytes []byte = database.GetChatHistory(req.ChannelID, page, c.UserID)
 	if jsonBytes == nil {
-		c.WriteChan <- macros.RespondFailureReason(rejectionMessage)
+		c.reply(macros.RespondFailureReason(macros.CodeFailed, "Denied chat history request"))
 		return
 	}
 
-	c.WriteChan <- macros.PreparePacket(packetType, jsonBytes)
+	c.reply(macros.PreparePacket(ctx.packetType, jsonBytes))
 }
 
-// when client wants to delete a message they own, type 3
-func (c *WsClient) onChatMessageDeleteRequest(packetJson []byte, packetType byte) {
-	type MessageToDelete struct {
-		MessageID uint64
-	}
-
-	var req = MessageToDelete{}
+type MessageToDelete struct {
+	MessageID uint64
+}
 
-	if err := json.Unmarshal(packetJson, &req); err != nil {
-		c.WriteChan <- macros.ErrorDeserializing(err.Error(), packetType, c.UserID)
+// when client wants to delete a message they own, or server owner deletes a message in their server, type 3,
+// a tombstone of the message stays in history
+func (c *WsClient) onChatMessageDeleteRequest(req MessageToDelete, ctx packetContext) {
+	// channel ID where the message was deleted was found when checking permission,
+	// so can broadcast it to affected Clients
+	channelID := ctx.channelID
+	_, threadID := database.GetMessageLocation(req.MessageID)
+	if !database.DeleteChatMessage(req.MessageID, c.UserID, time.Now().UnixMilli()) {
+		c.reply(macros.RespondFailureReason(macros.CodeNotFound, "Message ID [%d] was already deleted", req.MessageID))
 		return
 	}
 
-	// get the channel ID where the message was deleted,
-	// so can broadcast it to affected Clients
-	channelID := database.GetChannelOfMessageID(req.MessageID, c.UserID)
-	if channelID == 0 {
-		log.Hack("There is no message ID [%d] owned by user ID [%d]", req.MessageID, c.UserID)
-		c.WriteChan <- macros.RespondFailureReason("Denied to delete chat message")
-		return
-	} else {
-		deleted := database.Delete(database.DeleteMessage{MessageID: req.MessageID, UserID: c.UserID})
-		if !deleted {
-			log.Impossible("There is no message ID [%d] in database, this is not possible since it was just checked earlier when getting channel ID", req.MessageID)
-		}
+	type DeletedMessage struct {
+		ChannelID uint64
+		MessageID uint64
+		DeletedBy uint64
 	}
 
-	responseBytes, err := json.Marshal(req)
+	responseBytes, err := json.Marshal(DeletedMessage{ChannelID: channelID, MessageID: req.MessageID, DeletedBy: c.UserID})
 	if err != nil {
-		macros.ErrorSerializing(err.Error(), packetType, c.UserID)
+		macros.ErrorSerializing(err.Error(), ctx.packetType, c.UserID)
 	}
 
+	if threadID != 0 {
+		packet := macros.PreparePacket(ctx.packetType, responseBytes)
+		c.replyBroadcast(packet)
+		broadcastChan <- BroadcastData{
+			MessageBytes:    packet,
+			Type:            ctx.packetType,
+			AffectedChannel: threadID,
+		}
+
+		thread, exists := database.RemoveThreadReply(threadID)
+		if exists {
+			broadcastThreadUpdate(thread)
+		}
+		return
+	}
+
+	packet := macros.PreparePacket(ctx.packetType, responseBytes)
+	c.replyBroadcast(packet)
 	broadcastChan <- BroadcastData{
-		MessageBytes:    macros.PreparePacket(packetType, responseBytes),
-		Type:            packetType,
+		MessageBytes:    packet,
+		Type:            ctx.packetType,
 		AffectedChannel: channelID,
 	}
 }
 
-func (c *WsClient) onAddFriendRequest(packetJson []byte, packetType byte) {
-	type AddFriendRequest struct {
-		UserID uint64
-	}
-
-	var req = AddFriendRequest{}
-
-	if err := json.Unmarshal(packetJson, &req); err != nil {
-		c.WriteChan <- macros.ErrorDeserializing(err.Error(), packetType, c.UserID)
-		return
-	}
+type AddFriendRequest struct {
+	UserID uint64
+}
 
+func (c *WsClient) onAddFriendRequest(req AddFriendRequest, ctx packetContext) {
 	log.Trace("User ID [%d] wants to add [%d] as friend", c.UserID, req.UserID)
 
 	// this is just extra check locally, database already doesn't allow 1 user being friends with itself
 	if c.UserID == req.UserID {
-		c.WriteChan <- macros.RespondFailureReason("You can't be friends with yourself")
+		c.reply(macros.RespondFailureReason(macros.CodeValidation, "You can't be friends with yourself"))
 		return
 	}
 
@@ -436,7 +517,7 @@ func (c *WsClient) onAddFriendRequest(packetJson []byte, packetType byte) {
 	err := database.Insert(friendship)
 	if err != nil {
 		log.Warn("Error adding user ID [%d] as friend for [%d]", req.UserID, c.UserID)
-		c.WriteChan <- macros.RespondFailureReason("Error adding user ID [%d] as friend", req.UserID)
+		c.reply(macros.RespondFailureReason(macros.CodeFailed, "Error adding user ID [%d] as friend", req.UserID))
 		return
 	}
 
@@ -447,31 +528,26 @@ func (c *WsClient) onAddFriendRequest(packetJson []byte, packetType byte) {
 
 	msgBytes, err := json.Marshal(res)
 	if err != nil {
-		macros.ErrorSerializing(err.Error(), packetType, c.UserID)
+		macros.ErrorSerializing(err.Error(), ctx.packetType, c.UserID)
 		return
 	}
 
+	packet := macros.PreparePacket(ctx.packetType, msgBytes)
+	c.replyBroadcast(packet)
 	broadcastData := BroadcastData{
-		MessageBytes:   macros.PreparePacket(packetType, msgBytes),
-		Type:           packetType,
+		MessageBytes:   packet,
+		Type:           ctx.packetType,
 		AffectedUserID: []uint64{c.UserID, req.UserID},
 	}
 
 	broadcastChan <- broadcastData
 }
 
-func (c *WsClient) onBlockUserRequest(packetJson []byte, packetType byte) {
-	type BlockUserRequest struct {
-		UserID uint64
-	}
-
-	var req = BlockUserRequest{}
-
-	if err := json.Unmarshal(packetJson, &req); err != nil {
-		c.WriteChan <- macros.ErrorDeserializing(err.Error(), packetType, c.UserID)
-		return
-	}
+type BlockUserRequest struct {
+	UserID uint64
+}
 
+func (c *WsClient) onBlockUserRequest(req BlockUserRequest, ctx packetContext) {
 	log.Trace("[User %d] wants to block user [%d]", c.UserID, req.UserID)
 
 	block := database.BlockUser{
@@ -482,35 +558,30 @@ func (c *WsClient) onBlockUserRequest(packetJson []byte, packetType byte) {
 	err := database.Insert(block)
 	if err != nil {
 		log.Warn("Error blocking user ID [%d] for [%d]", req.UserID, c.UserID)
-		c.WriteChan <- macros.RespondFailureReason("Error blocking user ID [%d]", req.UserID)
+		c.reply(macros.RespondFailureReason(macros.CodeFailed, "Error blocking user ID [%d]", req.UserID))
 		return
 	}
 
 	msgBytes, err := json.Marshal(req)
 	if err != nil {
-		macros.ErrorSerializing(err.Error(), packetType, c.UserID)
+		macros.ErrorSerializing(err.Error(), ctx.packetType, c.UserID)
 		return
 	}
 
+	packet := macros.PreparePacket(ctx.packetType, msgBytes)
+	c.replyBroadcast(packet)
 	broadcastChan <- BroadcastData{
-		MessageBytes:   macros.PreparePacket(packetType, msgBytes),
-		Type:           packetType,
+		MessageBytes:   packet,
+		Type:           ctx.packetType,
 		AffectedUserID: []uint64{c.UserID},
 	}
 }
 
-func (c *WsClient) onUnfriendRequest(packetJson []byte, packetType byte) {
-	type UnfriendRequest struct {
-		UserID uint64
-	}
-
-	var req = UnfriendRequest{}
-
-	if err := json.Unmarshal(packetJson, &req); err != nil {
-		c.WriteChan <- macros.ErrorDeserializing(err.Error(), packetType, c.UserID)
-		return
-	}
+type UnfriendRequest struct {
+	UserID uint64
+}
 
+func (c *WsClient) onUnfriendRequest(req UnfriendRequest, ctx packetContext) {
 	log.Trace("[User %d] wants to unfriend user [%d]", c.UserID, req.UserID)
 
 	unfriend := database.FriendshipSimple{}
@@ -527,7 +598,7 @@ func (c *WsClient) onUnfriendRequest(packetJson []byte, packetType byte) {
 	success := database.Delete(unfriend)
 	if !success {
 		log.Warn("[User %d] failed to unfriend user [%d]", c.UserID, req.UserID)
-		c.WriteChan <- macros.RespondFailureReason("Error unfriending user ID [%d]", req.UserID)
+		c.reply(macros.RespondFailureReason(macros.CodeFailed, "Error unfriending user ID [%d]", req.UserID))
 		return
 	}
 
@@ -538,13 +609,15 @@ func (c *WsClient) onUnfriendRequest(packetJson []byte, packetType byte) {
 
 	msgBytes, err := json.Marshal(res)
 	if err != nil {
-		macros.ErrorSerializing(err.Error(), packetType, c.UserID)
+		macros.ErrorSerializing(err.Error(), ctx.packetType, c.UserID)
 		return
 	}
 
+	packet := macros.PreparePacket(ctx.packetType, msgBytes)
+	c.replyBroadcast(packet)
 	broadcastData := BroadcastData{
-		MessageBytes:   macros.PreparePacket(packetType, msgBytes),
-		Type:           packetType,
+		MessageBytes:   packet,
+		Type:           ctx.packetType,
 		AffectedUserID: []uint64{c.UserID, req.UserID},
 	}
 
@@ -555,18 +628,11 @@ func (c *WsClient) onUnfriendRequest(packetJson []byte, packetType byte) {
 
 // }
 
-func (c *WsClient) onServerMemberListRequest(packetJson []byte, packetType byte) {
-	type MemberListRequest struct {
-		ServerID uint64
-	}
-
-	var req MemberListRequest
-
-	if err := json.Unmarshal(packetJson, &req); err != nil {
-		c.WriteChan <- macros.ErrorDeserializing(err.Error(), packetType, c.UserID)
-		return
-	}
+type MemberListRequest struct {
+	ServerID uint64
+}
 
+func (c *WsClient) onServerMemberListRequest(req MemberListRequest, ctx packetContext) {
 	members := database.GetServerMembersList(req.ServerID)
 
 	// check if members are online or not
@@ -576,25 +642,18 @@ func (c *WsClient) onServerMemberListRequest(packetJson []byte, packetType byte)
 
 	membersJson, err := json.Marshal(members)
 	if err != nil {
-		macros.ErrorSerializing(err.Error(), packetType, c.UserID)
+		macros.ErrorSerializing(err.Error(), ctx.packetType, c.UserID)
 		return
 	}
 
-	c.WriteChan <- macros.PreparePacket(packetType, membersJson)
+	c.reply(macros.PreparePacket(ctx.packetType, membersJson))
 }
 
-func (c *WsClient) onLeaveServerRequest(packetJson []byte, packetType byte) {
-	type LeaveServerRequest struct {
-		ServerID uint64
-	}
-
-	var req LeaveServerRequest
-
-	if err := json.Unmarshal(packetJson, &req); err != nil {
-		c.WriteChan <- macros.ErrorDeserializing(err.Error(), packetType, c.UserID)
-		return
-	}
+type LeaveServerRequest struct {
+	ServerID uint64
+}
 
+func (c *WsClient) onLeaveServerRequest(req LeaveServerRequest, ctx packetContext) {
 	var resp = database.ServerMemberShort{
 		ServerID: req.ServerID,
 		UserID:   c.UserID,
@@ -602,13 +661,13 @@ func (c *WsClient) onLeaveServerRequest(packetJson []byte, packetType byte) {
 
 	deleted := database.Delete(resp)
 	if !deleted {
-		c.WriteChan <- macros.RespondFailureReason("Failed leaving server ID [%d]", req.ServerID)
+		c.reply(macros.RespondFailureReason(macros.CodeFailed, "Failed leaving server ID [%d]", req.ServerID))
 		return
 	}
 
 	responseBytes, err := json.Marshal(resp)
 	if err != nil {
-		macros.ErrorSerializing(err.Error(), packetType, c.UserID)
+		macros.ErrorSerializing(err.Error(), ctx.packetType, c.UserID)
 		return
 	}
 
@@ -617,35 +676,30 @@ func (c *WsClient) onLeaveServerRequest(packetJson []byte, packetType byte) {
 	if !success {
 		return
 	}
-	success = clients.SetCurrentChannelID(c.SessionID, 0)
+	success = clients.SetCurrentChannelID(c.SessionID, 0, 0)
 	if !success {
 		return
 	}
+	clients.UnsubscribeUserFromServer(c.UserID, req.ServerID)
 
-	packet := macros.PreparePacket(packetType, responseBytes)
+	packet := macros.PreparePacket(ctx.packetType, responseBytes)
 
 	// have to send manually to deleter as they won't be part of broadcast list
-	c.WriteChan <- packet
+	c.reply(packet)
 
 	broadcastChan <- BroadcastData{
 		MessageBytes:    packet,
 		AffectedServers: []uint64{req.ServerID},
-		Type:            packetType,
+		Type:            ctx.packetType,
+		SourceUserID:    c.UserID,
 	}
 }
 
-func (c *WsClient) onAddServerRequest(packetJson []byte, packetType byte) {
-	type AddServerRequest struct {
-		Name string
-	}
-
-	var addServerRequest = AddServerRequest{}
-
-	if err := json.Unmarshal(packetJson, &addServerRequest); err != nil {
-		c.WriteChan <- macros.ErrorDeserializing(err.Error(), packetType, c.UserID)
-		return
-	}
+type AddServerRequest struct {
+	Name string
+}
 
+func (c *WsClient) onAddServerRequest(addServerRequest AddServerRequest, ctx packetContext) {
 	const defaultPic = ""
 
 	serverID := database.AddNewServer(c.UserID, addServerRequest.Name, defaultPic)
@@ -659,24 +713,17 @@ func (c *WsClient) onAddServerRequest(packetJson []byte, packetType byte) {
 
 	messagesBytes, err := json.Marshal(serverResponse)
 	if err != nil {
-		macros.ErrorSerializing(err.Error(), packetType, c.UserID)
+		macros.ErrorSerializing(err.Error(), ctx.packetType, c.UserID)
 		return
 	}
-	c.WriteChan <- macros.PreparePacket(packetType, messagesBytes)
+	c.reply(macros.PreparePacket(ctx.packetType, messagesBytes))
 }
 
-func (c *WsClient) onServerDeleteRequest(jsonBytes []byte, packetType byte) {
-	type ServerToDelete struct {
-		ServerID uint64
-	}
-
-	var req ServerToDelete
-
-	if err := json.Unmarshal(jsonBytes, &req); err != nil {
-		c.WriteChan <- macros.ErrorDeserializing(err.Error(), packetType, c.UserID)
-		return
-	}
+type ServerToDelete struct {
+	ServerID uint64
+}
 
+func (c *WsClient) onServerDeleteRequest(req ServerToDelete, ctx packetContext) {
 	serverDeletion := database.ServerDelete{
 		ServerID: req.ServerID,
 		UserID:   c.UserID,
@@ -684,46 +731,39 @@ func (c *WsClient) onServerDeleteRequest(jsonBytes []byte, packetType byte) {
 
 	success := database.Delete(serverDeletion)
 	if !success {
-		c.WriteChan <- macros.RespondFailureReason("Failed deleting server ID [%d]", req.ServerID)
+		c.reply(macros.RespondFailureReason(macros.CodeFailed, "Failed deleting server ID [%d]", req.ServerID))
 		return
 	}
 
 	messagesBytes, err := json.Marshal(serverDeletion)
 	if err != nil {
-		macros.ErrorSerializing(err.Error(), packetType, c.UserID)
+		macros.ErrorSerializing(err.Error(), ctx.packetType, c.UserID)
 		return
 	}
 
 	members := database.GetServerMembersList(req.ServerID)
 	onlineMembers := clients.FilterOnlineMembers(members)
 
-	packet := macros.PreparePacket(packetType, messagesBytes)
+	packet := macros.PreparePacket(ctx.packetType, messagesBytes)
 
 	// have to send manually to deleter as they won't be part of broadcast list
-	c.WriteChan <- packet
+	c.reply(packet)
 
 	broadcastChan <- BroadcastData{
 		MessageBytes:   packet,
-		Type:           packetType,
+		Type:           ctx.packetType,
 		AffectedUserID: onlineMembers,
 	}
 }
 
-func (c *WsClient) onServerInviteRequest(packetJson []byte, packetType byte) {
-	type ServerInviteRequest struct {
-		ServerID     uint64
-		TargetUserID uint64
-		SingleUse    bool
-		Expiration   uint64
-	}
-
-	var req = ServerInviteRequest{}
-
-	if err := json.Unmarshal(packetJson, &req); err != nil {
-		c.WriteChan <- macros.ErrorDeserializing(err.Error(), packetType, c.UserID)
-		return
-	}
+type ServerInviteRequest struct {
+	ServerID     uint64
+	TargetUserID uint64
+	SingleUse    bool
+	Expiration   uint64
+}
 
+func (c *WsClient) onServerInviteRequest(req ServerInviteRequest, ctx packetContext) {
 	log.Trace("User ID [%d] is requesting to generate an invite link for server ID [%d]", c.UserID, req.ServerID)
 
 	inviteID := snowflake.Generate()
@@ -744,24 +784,29 @@ func (c *WsClient) onServerInviteRequest(packetJson []byte, packetType byte) {
 
 	messagesBytes, err := json.Marshal(strconv.FormatUint(inviteID, 10))
 	if err != nil {
-		macros.ErrorSerializing(err.Error(), packetType, c.UserID)
+		macros.ErrorSerializing(err.Error(), ctx.packetType, c.UserID)
 		return
 	}
-	c.WriteChan <- macros.PreparePacket(packetType, messagesBytes)
+	c.reply(macros.PreparePacket(ctx.packetType, messagesBytes))
 }
 
-func (c *WsClient) onServerDataUpdateRequest(packetJson []byte, packetType byte) {
-	type UpdateServerDataRequest struct {
-		ServerID uint64
-		Name     string
-		NewSN    bool
-	}
+type UpdateServerDataRequest struct {
+	ServerID      uint64
+	Name          string
+	NewSN         bool
+	RetentionDays int // 0 to keep messages of channels without their own policy forever
+	NewRD         bool
+}
 
-	var req UpdateServerDataRequest
+func (c *WsClient) onServerDataUpdateRequest(req UpdateServerDataRequest, ctx packetContext) {
+	if !req.NewSN && !req.NewRD {
+		c.reply(macros.RespondFailureReason(macros.CodeValidation, "Nothing to change"))
+		return
+	}
 
-	err := json.Unmarshal(packetJson, &req)
-	if err != nil {
-		c.WriteChan <- macros.ErrorDeserializing(err.Error(), packetType, c.UserID)
+	// retention period is checked before the name is changed, so a rejected request changes nothing
+	if req.NewRD && !checkRetentionDays(req.RetentionDays) {
+		c.reply(macros.RespondFailureReason(macros.CodeValidation, "Retention period has to be between 0 and %d days", maxRetentionDays))
 		return
 	}
 
@@ -770,32 +815,50 @@ func (c *WsClient) onServerDataUpdateRequest(packetJson []byte, packetType byte)
 		success := database.ChangeServerName(c.UserID, req.ServerID, req.Name)
 		if !success {
 			log.Hack("Couldnt' change name of server ID [%d] to [%s] requested by user ID [%d], possibly because they are not the owner", req.ServerID, req.Name, c.UserID)
-			c.WriteChan <- macros.RespondFailureReason("Failed changing name of server ID [%d]", req.ServerID)
+			c.reply(macros.RespondFailureReason(macros.CodeFailed, "Failed changing name of server ID [%d]", req.ServerID))
 			return
 		}
+	}
 
-		jsonBytes, err := json.Marshal(req)
-		if err != nil {
-			macros.ErrorSerializing(err.Error(), packetType, c.UserID)
+	// update how long messages of the server are kept
+	if req.NewRD {
+		success := database.SetServerRetention(c.UserID, req.ServerID, req.RetentionDays)
+		if !success {
+			c.reply(macros.RespondFailureReason(macros.CodeFailed, "Failed changing retention period of server ID [%d]", req.ServerID))
 			return
 		}
+	}
 
-		members := database.GetServerMembersList(req.ServerID)
-		onlineMembers := clients.FilterOnlineMembers(members)
+	jsonBytes, err := json.Marshal(req)
+	if err != nil {
+		macros.ErrorSerializing(err.Error(), ctx.packetType, c.UserID)
+		return
+	}
 
-		broadcastChan <- BroadcastData{
-			MessageBytes:   macros.PreparePacket(packetType, jsonBytes),
-			Type:           packetType,
-			AffectedUserID: onlineMembers,
-		}
+	members := database.GetServerMembersList(req.ServerID)
+	onlineMembers := clients.FilterOnlineMembers(members)
+
+	packet := macros.PreparePacket(ctx.packetType, jsonBytes)
+	c.replyBroadcast(packet)
+	broadcastChan <- BroadcastData{
+		MessageBytes:   packet,
+		Type:           ctx.packetType,
+		AffectedUserID: onlineMembers,
 	}
 }
 
+// when client requests list of direct messages they have, type 72
+func (c *WsClient) onDmListRequest(packetType byte) {
+	c.reply(macros.PreparePacket(packetType, database.GetDmListOfUser(c.UserID)))
+}
+
 func (c *WsClient) onInitialDataRequest(packetType byte) {
 	initialData, success := database.GetInitialData(c.UserID)
 	if !success {
 		return
 	}
+	// client needs it to resume the session after disconnecting
+	initialData.SessionID = c.SessionID
 
 	jsonUserID, err := json.Marshal(initialData)
 	if err != nil {
@@ -803,7 +866,7 @@ func (c *WsClient) onInitialDataRequest(packetType byte) {
 		return
 	}
 
-	c.WriteChan <- macros.PreparePacket(packetType, jsonUserID)
+	c.reply(macros.PreparePacket(packetType, jsonUserID))
 }
 
 func (c *WsClient) onImageHostAddressRequest(packetType byte) {
@@ -812,27 +875,19 @@ func (c *WsClient) onImageHostAddressRequest(packetType byte) {
 	if err != nil {
 		log.FatalError(err.Error(), "Error serializing ImageHost [%s]", ImageHost)
 	}
-	c.WriteChan <- macros.PreparePacket(packetType, imageHostJson)
+	c.reply(macros.PreparePacket(packetType, imageHostJson))
 }
 
-func (c *WsClient) onUpdateUserDataRequest(packetJson []byte, packetType byte) {
-	type UpdateUserDataRequest struct {
-		DisplayName string
-		Pronouns    string
-		StatusText  string
-		NewDN       bool
-		NewP        bool
-		NewST       bool
-	}
-
-	var req UpdateUserDataRequest
-
-	err := json.Unmarshal(packetJson, &req)
-	if err != nil {
-		c.WriteChan <- macros.ErrorDeserializing(err.Error(), packetType, c.UserID)
-		return
-	}
+type UpdateUserDataRequest struct {
+	DisplayName string
+	Pronouns    string
+	StatusText  string
+	NewDN       bool
+	NewP        bool
+	NewST       bool
+}
 
+func (c *WsClient) onUpdateUserDataRequest(req UpdateUserDataRequest, ctx packetContext) {
 	type UpdateUserDataResponse struct {
 		UserID      uint64
 		DisplayName string
@@ -855,13 +910,13 @@ func (c *WsClient) onUpdateUserDataRequest(packetJson []byte, packetType byte) {
 		log.Trace("Changing display name of user ID [%d] to [%s]", c.UserID, req.DisplayName)
 
 		if len(req.DisplayName) > 32 {
-			c.WriteChan <- macros.RespondFailureReason("Display name can't be longer than 32 bytes")
+			c.reply(macros.RespondFailureReason(macros.CodeValidation, "Display name can't be longer than 32 bytes"))
 			return
 		}
 
 		success := database.UpdateUserValue(c.UserID, req.DisplayName, "display_name")
 		if !success {
-			c.WriteChan <- macros.RespondFailureReason("Failed changing display name")
+			c.reply(macros.RespondFailureReason(macros.CodeFailed, "Failed changing display name"))
 			return
 		} else {
 			response.NewDN = true
@@ -873,13 +928,13 @@ func (c *WsClient) onUpdateUserDataRequest(packetJson []byte, packetType byte) {
 		log.Trace("Changing pronouns of user ID [%d] to [%s]", c.UserID, req.Pronouns)
 
 		if len(req.Pronouns) > 16 {
-			c.WriteChan <- macros.RespondFailureReason("Pronouns can't be longer than 16 bytes")
+			c.reply(macros.RespondFailureReason(macros.CodeValidation, "Pronouns can't be longer than 16 bytes"))
 			return
 		}
 
 		success := database.UpdateUserValue(c.UserID, req.Pronouns, "pronouns")
 		if !success {
-			c.WriteChan <- macros.RespondFailureReason("Failed changing pronouns")
+			c.reply(macros.RespondFailureReason(macros.CodeFailed, "Failed changing pronouns"))
 			return
 		} else {
 			response.NewP = true
@@ -891,13 +946,13 @@ func (c *WsClient) onUpdateUserDataRequest(packetJson []byte, packetType byte) {
 		log.Trace("Changing status text of user ID [%d] to [%s]", c.UserID, req.StatusText)
 
 		if len(req.StatusText) > 32 {
-			c.WriteChan <- macros.RespondFailureReason("Status text can't be longer than 32 bytes")
+			c.reply(macros.RespondFailureReason(macros.CodeValidation, "Status text can't be longer than 32 bytes"))
 			return
 		}
 
 		success := setUserStatusText(c.UserID, req.StatusText)
 		if !success {
-			c.WriteChan <- macros.RespondFailureReason("Failed changing status text")
+			c.reply(macros.RespondFailureReason(macros.CodeFailed, "Failed changing status text"))
 			return
 		} else {
 			response.NewST = true
@@ -908,14 +963,16 @@ func (c *WsClient) onUpdateUserDataRequest(packetJson []byte, packetType byte) {
 	if req.NewDN || req.NewP || req.NewST {
 		jsonBytes, err := json.Marshal(response)
 		if err != nil {
-			macros.ErrorSerializing(err.Error(), packetType, c.UserID)
+			macros.ErrorSerializing(err.Error(), ctx.packetType, c.UserID)
 			return
 		}
 
 		// broadcast it to every session of the user who changed their info
+		packet := macros.PreparePacket(ctx.packetType, jsonBytes)
+		c.replyBroadcast(packet)
 		broadcastChan <- BroadcastData{
-			MessageBytes:   macros.PreparePacket(packetType, jsonBytes),
-			Type:           packetType,
+			MessageBytes:   packet,
+			Type:           ctx.packetType,
 			AffectedUserID: []uint64{c.UserID},
 		}
 
@@ -933,21 +990,16 @@ func (c *WsClient) onUpdateUserDataRequest(packetJson []byte, packetType byte) {
 	}
 }
 
-func (c *WsClient) onUpdateUserStatusValue(packetJson []byte, packetType byte) {
-	type UpdateUserStatusRequest struct {
-		Status byte
-	}
-
-	var req = UpdateUserStatusRequest{}
+type UpdateUserStatusRequest struct {
+	Status byte
+}
 
-	if err := json.Unmarshal(packetJson, &req); err != nil {
-		c.WriteChan <- macros.ErrorDeserializing(err.Error(), packetType, c.UserID)
-		return
-	}
+func (c *WsClient) onUpdateUserStatusValue(req UpdateUserStatusRequest, ctx packetContext) {
 	// change status in database
 	success := database.UpdateUserValue(c.UserID, string(req.Status), "status")
 	if !success {
 		log.Warn("Failed to update user status value.")
+		c.reply(macros.RespondFailureReason(macros.CodeFailed, "Failed changing status"))
 		return
 	}
 
@@ -963,32 +1015,27 @@ func (c *WsClient) onUpdateUserStatusValue(packetJson []byte, packetType byte) {
 
 	jsonBytes, err := json.Marshal(newStatus)
 	if err != nil {
-		macros.ErrorSerializing(err.Error(), packetType, c.UserID)
+		macros.ErrorSerializing(err.Error(), ctx.packetType, c.UserID)
 		return
 	}
 
 	serverIDs := database.GetJoinedServersList(c.UserID)
 
 	// prepare broadcast data that will be sent to affected users
+	packet := macros.PreparePacket(ctx.packetType, jsonBytes)
+	c.replyBroadcast(packet)
 	broadcastChan <- BroadcastData{
-		MessageBytes:    macros.PreparePacket(packetType, jsonBytes),
-		Type:            packetType,
+		MessageBytes:    packet,
+		Type:            ctx.packetType,
 		AffectedServers: serverIDs,
 	}
 }
 
-func (c *WsClient) onChatMessageTyping(packetJson []byte, packetType byte) {
-	type StartedTyping struct {
-		Typing bool
-	}
-
-	var req StartedTyping
-
-	if err := json.Unmarshal(packetJson, &req); err != nil {
-		c.WriteChan <- macros.ErrorDeserializing(err.Error(), packetType, c.UserID)
-		return
-	}
+type StartedTyping struct {
+	Typing bool
+}
 
+func (c *WsClient) onChatMessageTyping(req StartedTyping, ctx packetContext) {
 	channelID := clients.GetCurrentChannelID(c.SessionID)
 
 	type Typing struct {
@@ -1005,61 +1052,75 @@ func (c *WsClient) onChatMessageTyping(packetJson []byte, packetType byte) {
 
 	jsonBytes, err := json.Marshal(resp)
 	if err != nil {
-		macros.ErrorSerializing(err.Error(), packetType, c.UserID)
+		macros.ErrorSerializing(err.Error(), ctx.packetType, c.UserID)
 		return
 	}
 
+	packet := macros.PreparePacket(ctx.packetType, jsonBytes)
+	c.replyBroadcast(packet)
 	broadcastChan <- BroadcastData{
-		MessageBytes:    macros.PreparePacket(packetType, jsonBytes),
-		Type:            packetType,
+		MessageBytes:    packet,
+		Type:            ctx.packetType,
 		AffectedChannel: channelID,
+		SourceUserID:    c.UserID,
 	}
 }
 
-func (c *WsClient) onChatMessageEditRequest(packetJson []byte, packetType byte) {
-	type EditedMessage struct {
+type EditedMessage struct {
+	MessageID uint64
+	Message   string
+}
+
+func (c *WsClient) onChatMessageEditRequest(req EditedMessage, ctx packetContext) {
+	editedAt := time.Now().UnixMilli()
+	channelID := database.EditChatMessage(req.MessageID, c.UserID, req.Message, editedAt)
+	if channelID == 0 {
+		log.Trace("Could not edit chat message ID [%d] requested by user ID [%d]", req.MessageID, c.UserID)
+		c.reply(macros.RespondFailureReason(macros.CodeFailed, "Failed editing message ID [%d], it may have been deleted", req.MessageID))
+		return
+	}
+
+	type EditedMessageResponse struct {
+		ChannelID uint64
 		MessageID uint64
 		Message   string
+		EditedAt  int64
 	}
 
-	var req EditedMessage
-
-	if err := json.Unmarshal(packetJson, &req); err != nil {
-		c.WriteChan <- macros.ErrorDeserializing(err.Error(), packetType, c.UserID)
+	jsonBytes, err := json.Marshal(EditedMessageResponse{ChannelID: channelID, MessageID: req.MessageID, Message: req.Message, EditedAt: editedAt})
+	if err != nil {
+		macros.ErrorSerializing(err.Error(), ctx.packetType, c.UserID)
+		c.reply(macros.RespondFailureReason(macros.CodeFailed, "Message ID [%d] was edited but the edit couldn't be sent", req.MessageID))
 		return
 	}
 
-	channelID := database.EditChatMessage(req.MessageID, c.UserID, req.Message)
-	if channelID == 0 {
-		log.Hack("Could not edit chat message ID [%d] requested by user ID [%d], possibly unauthorized", req.MessageID, c.UserID)
-		return
+	// edited replies in a thread only go to sessions that have the thread open
+	affectedChannel := channelID
+	if _, threadID := database.GetMessageLocation(req.MessageID); threadID != 0 {
+		affectedChannel = threadID
 	}
 
+	packet := macros.PreparePacket(ctx.packetType, jsonBytes)
+	c.replyBroadcast(packet)
+
 	broadcastChan <- BroadcastData{
-		MessageBytes:    macros.PreparePacket(packetType, packetJson),
-		Type:            packetType,
-		AffectedChannel: channelID,
+		MessageBytes:    packet,
+		Type:            ctx.packetType,
+		AffectedChannel: affectedChannel,
 	}
 }
 
-func (c *WsClient) onOpenDmRequest(packetJson []byte, packetType byte) {
-	type Request struct {
-		UserID uint64
-	}
-
-	var req Request
-
-	if err := json.Unmarshal(packetJson, &req); err != nil {
-		c.WriteChan <- macros.ErrorDeserializing(err.Error(), packetType, c.UserID)
-		return
-	}
+type OpenDmRequest struct {
+	UserID uint64
+}
 
+func (c *WsClient) onOpenDmRequest(req OpenDmRequest, ctx packetContext) {
 	err := database.Insert(database.DmChat{
 		UserID1: c.UserID,
 		UserID2: req.UserID,
 		ChatID:  snowflake.Generate()})
 	if err != nil {
-		c.WriteChan <- macros.RespondFailureReason("Failed creating DM chat")
+		c.reply(macros.RespondFailureReason(macros.CodeFailed, "Failed creating DM chat"))
 		return
 	}
 }
@@ -153,6 +153,7 @@ class ServerListClass {
             ChannelListClass.create()
             await WebsocketClass.requestChannelList()
             await WebsocketClass.requestMemberList()
+            await WebsocketClass.requestEmojiList()
         } else {
             DirectMessagesClass.create()
             MainClass.setCurrentChannelID('0')
@@ -170,8 +171,13 @@ class ServerListClass {
 
     static deleteServer(serverID) {
         console.log('Deleting server ID:', serverID)
-        // check if class is correct
-        document.getElementById(serverID).parentNode.remove()
+        const button = document.getElementById(serverID)
+
+        // already removed if user was kicked and got told about it twice
+        if (button === null) {
+            return
+        }
+        button.parentNode.remove()
         ServerListClass.calculateServerAmount()
     }
 
@@ -350,6 +350,9 @@ class ChatMessageListClass {
             }
         })
 
+        // show custom emoji of the server written as :shortcode:
+        msgTextDiv.innerHTML = ServerEmojiClass.replaceShortcodes(msgTextDiv.innerHTML)
+
 
         // append both name/date <div> and msg <div> to msgDatDiv
         msgTextContainer.appendChild(msgTextDiv)
@@ -669,16 +672,14 @@ class ChatMessageListClass {
                 MainClass.lastChannelID = MainClass.getCurrentChannelID()
             }
         } else {
-            // run if server sent json that doesn't contain any more messages
-            if (MainClass.getCurrentChannelID() === MainClass.lastChannelID) {
-                // this can only run if already in channel
-                console.warn(`Reached the beginning of the chat, don't request more`)
-                // will become false upon entering another channel
-                this.#reachedBeginningOfChannel = true
-            } else {
-                // and this only when entering a channel
-                console.warn('Current channel has no chat history')
-            }
+            // run if server sent json that doesn't contain any messages
+            console.warn('Current channel has no chat history')
+        }
+        // json[2] tells if there are older messages left, json[3] if there are newer ones
+        if (!json[2]) {
+            console.warn(`Reached the beginning of the chat, don't request more`)
+            // will become false upon entering another channel
+            this.#reachedBeginningOfChannel = true
         }
         this.setLoadingChatMessagesIndicator(false)
         this.amountOfMessagesChanged()
@@ -1304,6 +1305,45 @@ class ChatInputClass {
     }
 }
 
+class ServerEmojiClass {
+    static #emoji = new Map() // shortcode -> custom emoji of the current server
+
+    static setEmojiList(json) {
+        if (json.ServerID !== MainClass.getCurrentServerID()) {
+            return
+        }
+        this.#emoji.clear()
+        for (let i = 0; i < json.Emoji.length; i++) {
+            this.#emoji.set(json.Emoji[i].Shortcode, json.Emoji[i])
+        }
+    }
+
+    static emojiUpdated(json) {
+        if (json.ServerID !== MainClass.getCurrentServerID()) {
+            return
+        }
+        // the shortcode may have changed, so the old one is looked up by emoji ID
+        for (const [shortcode, emoji] of this.#emoji) {
+            if (emoji.EmojiID === json.Emoji.EmojiID) {
+                this.#emoji.delete(shortcode)
+            }
+        }
+        if (!json.Deleted) {
+            this.#emoji.set(json.Emoji.Shortcode, json.Emoji)
+        }
+    }
+
+    static replaceShortcodes(text) {
+        return text.replace(/:([a-zA-Z0-9_]{2,32}):/g, (match, shortcode) => {
+            const emoji = this.#emoji.get(shortcode)
+            if (emoji === undefined) {
+                return match
+            }
+            return `<img src='/content/emoji/${emoji.FileName}' class='emoji' alt=':${shortcode}:' title=':${shortcode}:'>`
+        })
+    }
+}
+
 class MentionUserClass {
     static word = ''
     static currentIndex = 0
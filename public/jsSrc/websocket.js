@@ -1,6 +1,57 @@
+// fallback for networks where websocket upgrades don't work,
+// packets arrive as server-sent events and are sent with POST requests
+class SseSocket {
+    constructor(endpoint) {
+        this.onopen = null
+        this.onclose = null
+        this.onmessage = null
+        this.connID = null
+        this.closed = false
+        this.sending = Promise.resolve() // POSTs are chained so packets arrive in order
+
+        this.eventSource = new EventSource(endpoint)
+        this.eventSource.addEventListener('conn', (event) => {
+            this.connID = event.data
+            if (this.onopen) {
+                this.onopen()
+            }
+        })
+        this.eventSource.addEventListener('close', (event) => {
+            console.warn('Server closed the connection:', event.data)
+            this.close()
+        })
+        this.eventSource.onmessage = (event) => {
+            const bytes = Uint8Array.from(atob(event.data), (char) => char.charCodeAt(0))
+            if (this.onmessage) {
+                this.onmessage({ data: bytes.buffer })
+            }
+        }
+        this.eventSource.onerror = () => this.close()
+    }
+
+    send(packet) {
+        this.sending = this.sending
+            .then(() => fetch(`/sse?conn=${this.connID}`, { method: 'POST', body: packet }))
+            .catch((error) => console.warn('Failed sending packet:', error))
+    }
+
+    close() {
+        if (this.closed) {
+            return
+        }
+        this.closed = true
+        this.eventSource.close()
+        if (this.onclose) {
+            this.onclose()
+        }
+    }
+}
+
 class WebsocketClass {
     static wsClient
     static wsConnected = false
+    static useSse = false // switched on if websocket can't connect
+    static failedUpgrades = 0
     // static reconnectAttempts = 0
 
     static REJECTION_MESSAGE = 0
@@ -10,6 +61,21 @@ class WebsocketClass {
     static DELETE_CHAT_MESSAGE = 3
     static STARTED_TYPING = 4
     static EDIT_CHAT_MESSAGE = 5
+    static START_THREAD = 6
+    static THREAD_HISTORY = 7
+    static UNSUBSCRIBE_THREAD = 8
+    static THREAD_UPDATE = 9
+    static ADD_REACTION = 10
+    static REMOVE_REACTION = 11
+    static PIN_MESSAGE = 12
+    static UNPIN_MESSAGE = 13
+    static PINNED_LIST = 14
+    static SEARCH_MESSAGES = 15
+    static MESSAGE_REVISIONS = 16
+    static SCHEDULE_MESSAGE = 17
+    static SCHEDULED_MESSAGES = 18
+    static EDIT_SCHEDULED = 19
+    static CANCEL_SCHEDULED = 20
 
     static ADD_SERVER = 21
     static UPDATE_SERVER_PIC = 22
@@ -17,11 +83,16 @@ class WebsocketClass {
     static SERVER_INVITE_LINK = 24
     static UPDATE_SERVER_DATA = 25
     static UPDATE_SERVER_BANNER = 26
+    static EMOJI_LIST = 27
+    static EMOJI_UPDATE = 28
 
     static ADD_CHANNEL = 31
     static CHANNEL_LIST = 32
     static DELETE_CHANNEL = 33
     static UPDATE_CHANNEL_DATA = 34
+    static SUBSCRIBE_CHANNEL = 35
+    static UNSUBSCRIBE_CHANNEL = 36
+    static MESSAGES_PRUNED = 37
 
     static ADD_SERVER_MEMBER = 41
     static SERVER_MEMBER_LIST = 42
@@ -40,15 +111,40 @@ class WebsocketClass {
     static REQUEST_DM_LIST = 72
     static DM_CHAT_HISTORY = 73
 
+    static MENTION = 81
+    static MENTION_INBOX = 82
+    static ACK_MENTION = 83
+    static ACK_CHANNEL = 84
+
+    static CREATE_POLL = 91
+    static VOTE_POLL = 92
+    static POLL_UPDATE = 93
+
+    static COMMAND_LIST = 101
+    static COMMAND_RESULT = 102
+
     static INITIAL_USER_DATA = 241
     static IMAGE_HOST_ADDRESS = 242
     static UPDATE_USER_DATA = 243
     static UPDATE_USER_PROFILE_PIC = 244
+    static SERVER_RESTARTING = 246
+
+    // seconds to wait before reconnecting, server tells it when restarting
+    static reconnectDelay = 5
 
     // static canSendPacket = true
     static timerStage = 0
     static lastSendAttempt
 
+    // packets of a previously viewed channel can still arrive while switching channels
+    static isStaleChannelPacket(channelID) {
+        if (channelID !== MainClass.getCurrentChannelID()) {
+            console.warn(`Ignoring packet meant for channel ID [${channelID}], current channel is [${MainClass.getCurrentChannelID()}]`)
+            return true
+        }
+        return false
+    }
+
     static async websocketConnected() {
         console.log('Refreshing websocket connections')
 
@@ -96,7 +192,12 @@ class WebsocketClass {
         // check if protocol is http or https
         const protocol = location.protocol === 'https:' ? 'wss://' : 'ws://'
         const endpoint = `${protocol}${window.location.host}/ws`
-        WebsocketClass.wsClient = new WebSocket(endpoint)
+        if (WebsocketClass.useSse) {
+            console.warn('Using server-sent events instead of websocket')
+            WebsocketClass.wsClient = new SseSocket('/sse')
+        } else {
+            WebsocketClass.wsClient = new WebSocket(endpoint)
+        }
 
         // make the websocket work with byte arrays
         WebsocketClass.wsClient.binaryType = 'arraybuffer'
@@ -105,11 +206,20 @@ class WebsocketClass {
             this.websocketBeforeConnected()
             console.log('Connected to WebSocket successfully.')
             WebsocketClass.wsConnected = true
+            WebsocketClass.failedUpgrades = 0
             await this.websocketConnected()
         }
 
         WebsocketClass.wsClient.onclose = async () => {
             console.warn('Connection lost to websocket')
+
+            // a proxy may be breaking the upgrade, if it never worked try server-sent events
+            if (!WebsocketClass.wsConnected && !WebsocketClass.useSse) {
+                WebsocketClass.failedUpgrades++
+                if (WebsocketClass.failedUpgrades >= 2) {
+                    WebsocketClass.useSse = true
+                }
+            }
             // if (WebsocketClass.reconnectAttempts > 60) {
             //     console.log('Failed reconnecting to the server')
             //     LoadingClass.setLoadingText('Failed reconnecting')
@@ -121,7 +231,8 @@ class WebsocketClass {
             WebsocketClass.wsConnected = false
             LoadingClass.fadeInLoading()
 
-            let counter = 5
+            let counter = WebsocketClass.reconnectDelay
+            WebsocketClass.reconnectDelay = 5
             while (counter > 0) {
                 const text = `${Translation.get('retryingIn')}: ${counter}`
                 LoadingClass.setLoadingText(text)
@@ -171,21 +282,34 @@ class WebsocketClass {
 
             switch (packetType) {
                 case WebsocketClass.REJECTION_MESSAGE: // Server sent rejection message
-                    console.warn('Server response:', json.Reason)
+                    if (json.Code === 'rate_limited') {
+                        console.warn(`${json.Reason}, can try again in ${json.RetryAfter} ms`)
+                        break
+                    }
+                    console.warn('Server response:', json.Code, json.Reason)
                     break
                 case WebsocketClass.ADD_CHAT_MESSAGE: // Server sent a chat message
+                    if (WebsocketClass.isStaleChannelPacket(json.ChannelID)) {
+                        break
+                    }
                     await ChatMessageListClass.chatMessageReceived(json)
                     break
                 case WebsocketClass.CHAT_HISTORY: // Server sent the requested chat history
                     await ChatMessageListClass.chatHistoryReceived(json)
                     break
                 case WebsocketClass.DELETE_CHAT_MESSAGE: // Server sent which message was deleted
+                    if (WebsocketClass.isStaleChannelPacket(json.ChannelID)) {
+                        break
+                    }
                     ChatMessageListClass.deleteChatMessage(json)
                     break
                 case WebsocketClass.STARTED_TYPING: // Server sent that someone started typing on given channel
                     ChatMessageListClass.someoneStartedTyping(json.Typing, json.UserID, json.ChannelID)
                     break
                 case WebsocketClass.EDIT_CHAT_MESSAGE: // Server sent info about an edited message
+                    if (WebsocketClass.isStaleChannelPacket(json.ChannelID)) {
+                        break
+                    }
                     ChatMessageListClass.editChatMessage(json.MessageID, json.Message)
                     break
                 case WebsocketClass.ADD_SERVER: // Server responded to the add server request
@@ -227,6 +351,14 @@ class WebsocketClass {
                     document.getElementById(json.ServerID).setAttribute('banner', json.Banner)
                     ServerBannerClass.setPicture(json.ServerID, json.Banner)
                     break
+                case WebsocketClass.EMOJI_LIST: // Server sent the requested custom emoji of a server
+                    console.log(`Custom emoji of server ID [${json.ServerID}] arrived`)
+                    ServerEmojiClass.setEmojiList(json)
+                    break
+                case WebsocketClass.EMOJI_UPDATE: // a custom emoji of a server was added, renamed or deleted
+                    console.log(`Custom emoji [${json.Emoji.Shortcode}] of server ID [${json.ServerID}] was updated`)
+                    ServerEmojiClass.emojiUpdated(json)
+                    break
                 case WebsocketClass.ADD_CHANNEL: // Server responded to the add channel request
                     console.log(`Adding new channel called [${json.Name}]`)
                     ChannelListClass.addChannel(json.ChannelID, json.Name)
@@ -407,6 +539,10 @@ class WebsocketClass {
                 case WebsocketClass.UPDATE_USER_PROFILE_PIC: // replied to profile pic change
                     MainClass.setOwnProfilePic(json.Pic)
                     break
+                case WebsocketClass.SERVER_RESTARTING: // server is shutting down, connection will be closed
+                    console.warn(`${json.Reason}, reconnecting in ${json.ReconnectAfter} seconds`)
+                    WebsocketClass.reconnectDelay = json.ReconnectAfter
+                    break
                 default:
                     console.log('Server sent unknown message type')
             }
@@ -573,6 +709,13 @@ class WebsocketClass {
         })
     }
 
+    static async requestEmojiList() {
+        console.log('Requesting custom emoji for current server ID', MainClass.getCurrentServerID())
+        await WebsocketClass.preparePacket(WebsocketClass.EMOJI_LIST, {
+            ServerID: MainClass.getCurrentServerID()
+        })
+    }
+
     static async requestMemberList() {
         console.log('Requesting member list for current server ID', MainClass.getCurrentServerID())
         await WebsocketClass.preparePacket(WebsocketClass.SERVER_MEMBER_LIST, {